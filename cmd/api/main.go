@@ -11,6 +11,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/database"
+	"github.com/maarifnu/cdn-fileserver/internal/metrics"
 	"github.com/maarifnu/cdn-fileserver/internal/routes"
 	"github.com/maarifnu/cdn-fileserver/internal/services"
 	"github.com/maarifnu/cdn-fileserver/pkg/logger"
@@ -52,15 +54,196 @@ func main() {
 		gin.SetMode(gin.DebugMode)
 	}
 
+	// Create storage backend
+	backend, err := services.NewBackend(cfg)
+	if err != nil {
+		logger.Fatalf("Failed to initialize storage backend: %v", err)
+	}
+	logger.Infof("Storage driver: %s", backend.Name())
+
+	// Open state database
+	db, err := database.Open(cfg.Database.Path)
+	if err != nil {
+		logger.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
 	// Create services
-	storageService := services.NewStorageService(cfg)
-	fileService := services.NewFileService(cfg, storageService)
+	storageService := services.NewStorageService(cfg, backend)
+
+	// Clean up after an unclean shutdown before serving requests
+	recovered := false
+	if cfg.Storage.Recovery.Enabled {
+		report, err := storageService.Recover(cfg.Storage.Recovery.GracePeriod)
+		if err != nil {
+			logger.Fatalf("Failed to recover storage: %v", err)
+		}
+		logger.Infof("Storage recovery removed %d temporary files, %d orphan files, %d orphan blobs and %d orphan metadata files",
+			report.TempFiles, report.OrphanFiles, report.OrphanBlobs, report.OrphanMeta)
+		recovered = report.OrphanMeta > 0
+	}
+
+	// Recover blob references from the sidecar files when none are recorded,
+	// such as on the first start with a storage written without them
+	if hasRefs, err := storageService.HasBlobRefs(); err != nil {
+		logger.Fatalf("Failed to read blob references: %v", err)
+	} else if !hasRefs {
+		count, err := storageService.RebuildBlobRefs()
+		if err != nil {
+			logger.Fatalf("Failed to rebuild blob references: %v", err)
+		}
+		if count > 0 {
+			logger.Infof("Blob references rebuilt for %d files", count)
+		}
+	}
+
+	// JWTs issued by another service
+	var jwtService *services.JWTService
+	if cfg.Security.JWT.Enabled {
+		jwtService, err = services.NewJWTService(cfg)
+		if err != nil {
+			logger.Fatalf("Failed to initialize JWT authentication: %v", err)
+		}
+		jwtService.Start()
+		defer jwtService.Stop()
+	}
+
+	// API tokens, with the config file tokens as bootstrap credentials. Tokens
+	// created through the API live in the database of one replica, so with
+	// several replicas only the config file tokens and JWTs are accepted.
+	tokenDB := db
+	if cfg.App.Replicas > 1 {
+		tokenDB = nil
+		logger.Info("Token management disabled: app.replicas is above 1")
+	}
+	tokenService, err := services.NewTokenService(cfg, tokenDB, jwtService)
+	if err != nil {
+		logger.Fatalf("Failed to initialize token store: %v", err)
+	}
+
+	// Presigned upload URLs for clients without a token
+	var uploadURLService *services.UploadURLService
+	if cfg.Security.UploadURL.Enabled {
+		uploadURLService, err = services.NewUploadURLService(cfg, db)
+		if err != nil {
+			logger.Fatalf("Failed to initialize upload urls: %v", err)
+		}
+	}
+
+	// Responses replayed for repeated upload and delete requests
+	var idempotencyService *services.IdempotencyService
+	if cfg.Idempotency.Enabled {
+		idempotencyService, err = services.NewIdempotencyService(cfg, db)
+		if err != nil {
+			logger.Fatalf("Failed to initialize idempotency keys: %v", err)
+		}
+		idempotencyService.Start()
+		defer idempotencyService.Stop()
+	}
+
+	var indexService *services.IndexService
+	if cfg.Storage.Index.Enabled {
+		indexService, err = services.NewIndexService(db)
+		if err != nil {
+			logger.Fatalf("Failed to initialize metadata index: %v", err)
+		}
+	}
+
+	// Webhook notifications
+	var webhookService *services.WebhookService
+	if len(cfg.Webhooks.Endpoints) > 0 {
+		webhookService, err = services.NewWebhookService(cfg, db)
+		if err != nil {
+			logger.Fatalf("Failed to initialize webhooks: %v", err)
+		}
+		webhookService.Start()
+		defer webhookService.Stop()
+	}
+
+	// Antivirus scanning of uploads
+	var scanService *services.ScanService
+	if cfg.Security.Antivirus.Enabled {
+		scanService, err = services.NewScanService(cfg)
+		if err != nil {
+			logger.Fatalf("Failed to initialize antivirus scanning: %v", err)
+		}
+		if engine, err := scanService.Version(); err != nil {
+			logger.Warnf("Antivirus daemon not reachable: %v", err)
+		} else {
+			logger.Infof("Scanning uploads with %s", engine)
+		}
+	}
+
+	fileService := services.NewFileService(cfg, storageService, indexService, webhookService, scanService)
+
+	// Rebuild the metadata index from the sidecar files when requested or empty
+	if indexService != nil {
+		count, err := indexService.Count()
+		if err != nil {
+			logger.Fatalf("Failed to read metadata index: %v", err)
+		}
+
+		if cfg.Storage.Index.RebuildOnStart || count == 0 || recovered {
+			indexed, err := fileService.RebuildIndex()
+			if err != nil {
+				logger.Fatalf("Failed to rebuild metadata index: %v", err)
+			}
+			logger.Infof("Metadata index rebuilt with %d files", indexed)
+		}
+	}
+
+	// Resumable uploads
+	var tusService *services.TusService
+	if cfg.Tus.Enabled {
+		tusService = services.NewTusService(cfg, fileService)
+		tusService.Start()
+		defer tusService.Stop()
+	}
+
+	// Purge deleted files once their retention elapses
+	if cfg.Storage.Trash.Enabled {
+		trashService := services.NewTrashService(cfg, fileService)
+		trashService.Start()
+		defer trashService.Stop()
+	}
+
+	// On-the-fly image variants
+	var imageService *services.ImageService
+	if cfg.Images.Enabled {
+		imageService = services.NewImageService(cfg, storageService)
+	}
+
+	// Integrity scrubber
+	var scrubService *services.ScrubService
+	if cfg.Storage.Scrub.Enabled {
+		scrubService, err = services.NewScrubService(cfg, storageService, db)
+		if err != nil {
+			logger.Fatalf("Failed to initialize integrity scrubber: %v", err)
+		}
+		scrubService.Start()
+		defer scrubService.Stop()
+	}
+
+	// Export storage totals alongside the request metrics
+	if cfg.Metrics.Enabled {
+		if err := metrics.RegisterStorageCollector(storageService.Stats, cfg.Metrics.StorageInterval); err != nil {
+			logger.Fatalf("Failed to register storage metrics: %v", err)
+		}
+	}
+
+	// Request and transfer rate limits
+	var rateLimitService *services.RateLimitService
+	if cfg.RateLimit.Enabled {
+		rateLimitService = services.NewRateLimitService(cfg)
+		rateLimitService.Start()
+		defer rateLimitService.Stop()
+	}
 
 	// Create Gin router
 	router := gin.New()
 
 	// Setup routes
-	routes.SetupRoutes(router, cfg, storageService, fileService)
+	routes.SetupRoutes(router, cfg, storageService, tokenService, fileService, tusService, imageService, webhookService, scrubService, rateLimitService, uploadURLService, idempotencyService)
 
 	// Create HTTP server
 	addr := fmt.Sprintf(":%d", cfg.App.Port)
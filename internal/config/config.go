@@ -1,44 +1,127 @@
 package config
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"math"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 // Config holds all configuration for the application
 type Config struct {
-	App      AppConfig      `mapstructure:"app"`
-	Storage  StorageConfig  `mapstructure:"storage"`
-	Tokens   []TokenConfig  `mapstructure:"tokens"`
-	CORS     CORSConfig     `mapstructure:"cors"`
-	Logging  LoggingConfig  `mapstructure:"logging"`
-	Security SecurityConfig `mapstructure:"security"`
+	App         AppConfig         `mapstructure:"app"`
+	Storage     StorageConfig     `mapstructure:"storage"`
+	Tokens      []TokenConfig     `mapstructure:"tokens"`
+	CORS        CORSConfig        `mapstructure:"cors"`
+	Logging     LoggingConfig     `mapstructure:"logging"`
+	Security    SecurityConfig    `mapstructure:"security"`
+	Database    DatabaseConfig    `mapstructure:"database"`
+	Tus         TusConfig         `mapstructure:"tus"`
+	Images      ImagesConfig      `mapstructure:"images"`
+	Metrics     MetricsConfig     `mapstructure:"metrics"`
+	Webhooks    WebhooksConfig    `mapstructure:"webhooks"`
+	RateLimit   RateLimitConfig   `mapstructure:"rate_limit"`
+	Idempotency IdempotencyConfig `mapstructure:"idempotency"`
 }
 
 // AppConfig holds application-level configuration
 type AppConfig struct {
-	Name    string `mapstructure:"name"`
-	Env     string `mapstructure:"env"`
-	Port    int    `mapstructure:"port"`
-	Version string `mapstructure:"version"`
-	Domain  string `mapstructure:"domain"`
+	Name     string `mapstructure:"name"`
+	Env      string `mapstructure:"env"`
+	Port     int    `mapstructure:"port"`
+	Version  string `mapstructure:"version"`
+	Domain   string `mapstructure:"domain"`
+	Replicas int    `mapstructure:"replicas"`
 }
 
+// Supported storage drivers
+const (
+	StorageDriverLocal = "local"
+	StorageDriverS3    = "s3"
+)
+
 // StorageConfig holds storage-related configuration
 type StorageConfig struct {
-	BasePath          string   `mapstructure:"base_path"`
-	MaxFileSize       int64    `mapstructure:"max_file_size"`
-	AllowedExtensions []string `mapstructure:"allowed_extensions"`
+	Driver            string           `mapstructure:"driver"`
+	BasePath          string           `mapstructure:"base_path"`
+	MaxFileSize       int64            `mapstructure:"max_file_size"`
+	MaxBatchFiles     int              `mapstructure:"max_batch_files"`
+	AllowedExtensions []string         `mapstructure:"allowed_extensions"`
+	S3                S3Config         `mapstructure:"s3"`
+	Index             IndexConfig      `mapstructure:"index"`
+	Scrub             ScrubConfig      `mapstructure:"scrub"`
+	Recovery          RecoveryConfig   `mapstructure:"recovery"`
+	Trash             TrashConfig      `mapstructure:"trash"`
+	Versioning        VersioningConfig `mapstructure:"versioning"`
+}
+
+// IndexConfig holds configuration for the metadata index
+type IndexConfig struct {
+	Enabled        bool `mapstructure:"enabled"`
+	RebuildOnStart bool `mapstructure:"rebuild_on_start"`
+}
+
+// ScrubConfig holds configuration for the background integrity scrubber
+type ScrubConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// RecoveryConfig holds configuration for the startup consistency check
+type RecoveryConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+}
+
+// TrashConfig holds configuration for soft deletes
+type TrashConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	Retention     time.Duration `mapstructure:"retention"`
+	PurgeInterval time.Duration `mapstructure:"purge_interval"`
+}
+
+// VersioningConfig holds configuration for replacing files in place
+type VersioningConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	CacheMaxAge time.Duration `mapstructure:"cache_max_age"`
+}
+
+// S3Config holds configuration for the S3-compatible storage driver
+type S3Config struct {
+	Endpoint  string `mapstructure:"endpoint"`
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	Prefix    string `mapstructure:"prefix"`
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	UseSSL    bool   `mapstructure:"use_ssl"`
+	PathStyle bool   `mapstructure:"path_style"`
 }
 
 // TokenConfig holds authentication token configuration
 type TokenConfig struct {
-	ID          string   `mapstructure:"id"`
-	Key         string   `mapstructure:"key"`
-	Name        string   `mapstructure:"name"`
-	Permissions []string `mapstructure:"permissions"`
+	ID          string              `mapstructure:"id"`
+	Key         string              `mapstructure:"key"`
+	Name        string              `mapstructure:"name"`
+	Permissions []string            `mapstructure:"permissions"`
+	Tags        map[string][]string `mapstructure:"tags"`
+	RateLimit   TokenRateLimit      `mapstructure:"rate_limit"`
+
+	// ExpiresAt is set when an authenticated token expires: stored tokens
+	// with an expiry, and JWTs
+	ExpiresAt *time.Time `mapstructure:"-"`
+}
+
+// TokenRateLimit overrides the rate limits for a single token; rules without
+// a rate keep the defaults
+type TokenRateLimit struct {
+	Requests      RateLimitRule `mapstructure:"requests"`
+	UploadBytes   RateLimitRule `mapstructure:"upload_bytes"`
+	DownloadBytes RateLimitRule `mapstructure:"download_bytes"`
 }
 
 // CORSConfig holds CORS configuration
@@ -47,6 +130,7 @@ type CORSConfig struct {
 	AllowedOrigins   []string `mapstructure:"allowed_origins"`
 	AllowedMethods   []string `mapstructure:"allowed_methods"`
 	AllowedHeaders   []string `mapstructure:"allowed_headers"`
+	ExposedHeaders   []string `mapstructure:"exposed_headers"`
 	AllowCredentials bool     `mapstructure:"allow_credentials"`
 }
 
@@ -64,8 +148,263 @@ type LoggingConfig struct {
 
 // SecurityConfig holds security-related configuration
 type SecurityConfig struct {
-	ValidateFileContent bool `mapstructure:"validate_file_content"`
-	SanitizeFilename    bool `mapstructure:"sanitize_filename"`
+	ValidateFileContent bool                `mapstructure:"validate_file_content"`
+	SanitizeFilename    bool                `mapstructure:"sanitize_filename"`
+	AllowedMimeTypes    map[string][]string `mapstructure:"allowed_mime_types"`
+	SignedURL           SignedURLConfig     `mapstructure:"signed_url"`
+	UploadURL           UploadURLConfig     `mapstructure:"upload_url"`
+	Antivirus           AntivirusConfig     `mapstructure:"antivirus"`
+	JWT                 JWTConfig           `mapstructure:"jwt"`
+}
+
+// SignedURLConfig holds configuration for signed, expiring download URLs
+type SignedURLConfig struct {
+	Secret     string        `mapstructure:"secret"`
+	DefaultTTL time.Duration `mapstructure:"default_ttl"`
+	MaxTTL     time.Duration `mapstructure:"max_ttl"`
+}
+
+// Enabled reports whether signed URLs can be minted and verified
+func (s *SignedURLConfig) Enabled() bool {
+	return s.Secret != ""
+}
+
+// UploadURLConfig holds configuration for presigned, single-use upload URLs
+type UploadURLConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	DefaultTTL time.Duration `mapstructure:"default_ttl"`
+	MaxTTL     time.Duration `mapstructure:"max_ttl"`
+}
+
+// AntivirusConfig holds configuration for scanning uploads with a
+// clamd-compatible daemon
+type AntivirusConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	Address    string        `mapstructure:"address"`
+	Timeout    time.Duration `mapstructure:"timeout"`
+	ChunkSize  int           `mapstructure:"chunk_size"`
+	Quarantine bool          `mapstructure:"quarantine"`
+	FailOpen   bool          `mapstructure:"fail_open"`
+}
+
+// Endpoint returns the network and address of the daemon, given as
+// tcp://host:port or unix:///path/to/socket
+func (a *AntivirusConfig) Endpoint() (string, string, error) {
+	network, address, ok := strings.Cut(a.Address, "://")
+	if !ok || address == "" || (network != "tcp" && network != "unix") {
+		return "", "", fmt.Errorf("antivirus address must be tcp://host:port or unix:///path")
+	}
+	return network, address, nil
+}
+
+// JWTConfig holds configuration for bearer JWTs issued by another service and
+// verified against its JWKS. Claims map to permissions and tag restrictions
+// the same way as for configured tokens.
+type JWTConfig struct {
+	Enabled            bool                `mapstructure:"enabled"`
+	JWKSFile           string              `mapstructure:"jwks_file"`
+	JWKSURL            string              `mapstructure:"jwks_url"`
+	RefreshInterval    time.Duration       `mapstructure:"refresh_interval"`
+	Issuer             string              `mapstructure:"issuer"`
+	Audience           string              `mapstructure:"audience"`
+	Algorithms         []string            `mapstructure:"algorithms"`
+	Leeway             time.Duration       `mapstructure:"leeway"`
+	PermissionsClaim   string              `mapstructure:"permissions_claim"`
+	RolesClaim         string              `mapstructure:"roles_claim"`
+	Roles              map[string][]string `mapstructure:"roles"`
+	TagsClaim          string              `mapstructure:"tags_claim"`
+	RequireTagsClaim   *bool               `mapstructure:"require_tags_claim"`
+	AllowedPermissions []string            `mapstructure:"allowed_permissions"`
+}
+
+// TagsClaimRequired reports whether JWTs without the tags claim are rejected;
+// it is the default, so a missing claim never grants every tag
+func (j *JWTConfig) TagsClaimRequired() bool {
+	return j.RequireTagsClaim == nil || *j.RequireTagsClaim
+}
+
+// validate checks the JWT configuration and applies defaults
+func (j *JWTConfig) validate() error {
+	if (j.JWKSFile == "") == (j.JWKSURL == "") {
+		return fmt.Errorf("jwt: exactly one of jwks_file and jwks_url is required")
+	}
+	if j.JWKSURL != "" && !strings.HasPrefix(j.JWKSURL, "https://") && !strings.HasPrefix(j.JWKSURL, "http://") {
+		return fmt.Errorf("jwt: jwks_url must be http or https")
+	}
+
+	if len(j.Algorithms) == 0 {
+		j.Algorithms = []string{"RS256", "ES256", "EdDSA"}
+	}
+	for _, alg := range j.Algorithms {
+		switch alg {
+		case "RS256", "ES256", "EdDSA":
+		default:
+			return fmt.Errorf("jwt: unsupported algorithm %s", alg)
+		}
+	}
+
+	if len(j.AllowedPermissions) == 0 {
+		j.AllowedPermissions = []string{"upload", "read", "list"}
+	}
+
+	if j.RefreshInterval <= 0 {
+		j.RefreshInterval = time.Hour
+	}
+	if j.Leeway < 0 {
+		return fmt.Errorf("jwt: invalid leeway %s", j.Leeway)
+	}
+	if j.PermissionsClaim == "" {
+		j.PermissionsClaim = "permissions"
+	}
+	if j.RolesClaim == "" {
+		j.RolesClaim = "roles"
+	}
+	if j.TagsClaim == "" {
+		j.TagsClaim = "tags"
+	}
+
+	return nil
+}
+
+// DatabaseConfig holds configuration for the embedded state database
+type DatabaseConfig struct {
+	Path string `mapstructure:"path"`
+}
+
+// TusConfig holds configuration for resumable uploads (tus protocol)
+type TusConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	StagingPath     string        `mapstructure:"staging_path"`
+	Expiration      time.Duration `mapstructure:"expiration"`
+	CleanupInterval time.Duration `mapstructure:"cleanup_interval"`
+}
+
+// IdempotencyConfig holds configuration for Idempotency-Key handling on
+// upload and delete routes
+type IdempotencyConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	TTL             time.Duration `mapstructure:"ttl"`
+	CleanupInterval time.Duration `mapstructure:"cleanup_interval"`
+}
+
+// ImagesConfig holds configuration for on-the-fly image variants
+type ImagesConfig struct {
+	Enabled          bool  `mapstructure:"enabled"`
+	MaxWidth         int   `mapstructure:"max_width"`
+	MaxHeight        int   `mapstructure:"max_height"`
+	AllowedWidths    []int `mapstructure:"allowed_widths"`
+	AllowedHeights   []int `mapstructure:"allowed_heights"`
+	AllowedQualities []int `mapstructure:"allowed_qualities"`
+	DefaultQuality   int   `mapstructure:"default_quality"`
+	MaxSourcePixels  int64 `mapstructure:"max_source_pixels"`
+	MaxVariants      int   `mapstructure:"max_variants"`
+}
+
+// MetricsConfig holds configuration for the Prometheus metrics endpoint
+type MetricsConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	Path            string        `mapstructure:"path"`
+	Permission      string        `mapstructure:"permission"`
+	StorageInterval time.Duration `mapstructure:"storage_interval"`
+}
+
+// Rate limit groups
+const (
+	RateLimitGroupUpload   = "upload"
+	RateLimitGroupDownload = "download"
+	RateLimitGroupAPI      = "api"
+)
+
+// RateLimitConfig holds token bucket limits. Group limits apply per token, or
+// per client IP for anonymous requests; the IP limit applies to every request
+// before authentication.
+type RateLimitConfig struct {
+	Enabled       bool                     `mapstructure:"enabled"`
+	IP            RateLimitRule            `mapstructure:"ip"`
+	Groups        map[string]RateLimitRule `mapstructure:"groups"`
+	UploadBytes   RateLimitRule            `mapstructure:"upload_bytes"`
+	DownloadBytes RateLimitRule            `mapstructure:"download_bytes"`
+	IdleTimeout   time.Duration            `mapstructure:"idle_timeout"`
+}
+
+// RateLimitRule is a token bucket refilled with Rate per second, requests or
+// bytes, holding up to Burst. A rule without a rate does not limit.
+type RateLimitRule struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// Limited reports whether the rule limits anything
+func (r *RateLimitRule) Limited() bool {
+	return r.Rate > 0
+}
+
+// validate checks a rule and defaults its burst to one second of rate
+func (r *RateLimitRule) validate(name string) error {
+	if r.Rate < 0 || r.Burst < 0 {
+		return fmt.Errorf("rate limit %s: rate and burst must not be negative", name)
+	}
+	if r.Limited() && r.Burst == 0 {
+		r.Burst = int(math.Ceil(r.Rate))
+	}
+	return nil
+}
+
+// validate checks the rate limit configuration and applies defaults
+func (r *RateLimitConfig) validate() error {
+	if err := r.IP.validate("ip"); err != nil {
+		return err
+	}
+	for group, rule := range r.Groups {
+		switch group {
+		case RateLimitGroupUpload, RateLimitGroupDownload, RateLimitGroupAPI:
+		default:
+			return fmt.Errorf("rate limit: unknown group %s", group)
+		}
+		if err := rule.validate(group); err != nil {
+			return err
+		}
+		r.Groups[group] = rule
+	}
+	if err := r.UploadBytes.validate("upload_bytes"); err != nil {
+		return err
+	}
+	if err := r.DownloadBytes.validate("download_bytes"); err != nil {
+		return err
+	}
+	if r.IdleTimeout <= 0 {
+		r.IdleTimeout = 10 * time.Minute
+	}
+	return nil
+}
+
+// WebhooksConfig holds configuration for file lifecycle webhooks
+type WebhooksConfig struct {
+	Endpoints      []WebhookConfig `mapstructure:"endpoints"`
+	Timeout        time.Duration   `mapstructure:"timeout"`
+	MaxAttempts    int             `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration   `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration   `mapstructure:"max_backoff"`
+	Workers        int             `mapstructure:"workers"`
+	LogRetention   time.Duration   `mapstructure:"log_retention"`
+}
+
+// WebhookConfig holds configuration for a single webhook endpoint
+type WebhookConfig struct {
+	ID     string   `mapstructure:"id"`
+	URL    string   `mapstructure:"url"`
+	Events []string `mapstructure:"events"`
+	Secret string   `mapstructure:"secret"`
+}
+
+// Subscribes reports whether the endpoint receives an event
+func (w *WebhookConfig) Subscribes(event string) bool {
+	for _, e := range w.Events {
+		if e == event || e == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 // HasPermission checks if a token has a specific permission
@@ -78,6 +417,52 @@ func (t *TokenConfig) HasPermission(permission string) bool {
 	return false
 }
 
+// AllowsTag checks if a permission of the token extends to a tag. Tags holds
+// glob patterns per permission, with "*" applying to permissions without an
+// entry of their own; a permission without patterns covers every tag.
+func (t *TokenConfig) AllowsTag(permission, tag string) bool {
+	patterns, ok := t.Tags[permission]
+	if !ok {
+		patterns, ok = t.Tags["*"]
+	}
+	if !ok {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTags checks that tag patterns are well-formed and only given for
+// permissions the token has
+func (t *TokenConfig) ValidateTags() error {
+	for permission, patterns := range t.Tags {
+		if permission != "*" && !t.HasPermission(permission) {
+			return fmt.Errorf("tags given for missing permission %s", permission)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid tag pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// CoversTag checks if any permission of the token extends to a tag
+func (t *TokenConfig) CoversTag(tag string) bool {
+	for _, p := range t.Permissions {
+		if t.AllowsTag(p, tag) {
+			return true
+		}
+	}
+	return false
+}
+
 // Load loads configuration from file
 func Load(configPath string) (*Config, error) {
 	v := viper.New()
@@ -121,7 +506,24 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid port: %d", c.App.Port)
 	}
 
-	if c.Storage.BasePath == "" {
+	if c.Storage.Driver == "" {
+		c.Storage.Driver = StorageDriverLocal
+	}
+
+	switch c.Storage.Driver {
+	case StorageDriverLocal:
+	case StorageDriverS3:
+		if c.Storage.S3.Endpoint == "" {
+			return fmt.Errorf("storage s3 endpoint is required")
+		}
+		if c.Storage.S3.Bucket == "" {
+			return fmt.Errorf("storage s3 bucket is required")
+		}
+	default:
+		return fmt.Errorf("unsupported storage driver: %s", c.Storage.Driver)
+	}
+
+	if c.Storage.Driver == StorageDriverLocal && c.Storage.BasePath == "" {
 		return fmt.Errorf("storage base path is required")
 	}
 
@@ -129,10 +531,171 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid max file size: %d", c.Storage.MaxFileSize)
 	}
 
+	if c.Storage.MaxBatchFiles <= 0 {
+		c.Storage.MaxBatchFiles = 50
+	}
+
 	if len(c.Storage.AllowedExtensions) == 0 {
 		return fmt.Errorf("no allowed file extensions configured")
 	}
 
+	if c.Storage.Scrub.Enabled && c.Storage.Scrub.Interval <= 0 {
+		c.Storage.Scrub.Interval = 24 * time.Hour
+	}
+
+	if c.Storage.Recovery.Enabled && c.Storage.Recovery.GracePeriod <= 0 {
+		c.Storage.Recovery.GracePeriod = time.Hour
+	}
+
+	if c.Storage.Trash.Enabled {
+		if c.Storage.Trash.Retention <= 0 {
+			c.Storage.Trash.Retention = 30 * 24 * time.Hour
+		}
+		if c.Storage.Trash.PurgeInterval <= 0 {
+			c.Storage.Trash.PurgeInterval = time.Hour
+		}
+	}
+
+	if c.Storage.Versioning.Enabled && c.Storage.Versioning.CacheMaxAge <= 0 {
+		c.Storage.Versioning.CacheMaxAge = 5 * time.Minute
+	}
+
+	if c.Database.Path == "" {
+		c.Database.Path = "./data/cdn.db"
+	}
+
+	// The database is local to each replica, so the features keeping state
+	// in it need a single replica
+	if c.App.Replicas <= 0 {
+		c.App.Replicas = 1
+	}
+	if c.App.Replicas > 1 {
+		if err := c.validateReplicas(); err != nil {
+			return err
+		}
+	}
+
+	if c.Tus.Enabled {
+		// Partial uploads are staged on local disk; with the local driver
+		// they are kept next to the files of their tag
+		if c.Tus.StagingPath == "" {
+			if c.Storage.Driver != StorageDriverLocal {
+				return fmt.Errorf("tus staging path is required with the %s driver", c.Storage.Driver)
+			}
+			c.Tus.StagingPath = c.Storage.BasePath
+		}
+		if c.Tus.Expiration <= 0 {
+			c.Tus.Expiration = 24 * time.Hour
+		}
+		if c.Tus.CleanupInterval <= 0 {
+			c.Tus.CleanupInterval = time.Hour
+		}
+	}
+
+	if c.Idempotency.Enabled {
+		if c.Idempotency.TTL <= 0 {
+			c.Idempotency.TTL = 24 * time.Hour
+		}
+		if c.Idempotency.CleanupInterval <= 0 {
+			c.Idempotency.CleanupInterval = time.Hour
+		}
+	}
+
+	if c.Images.Enabled {
+		if c.Images.MaxWidth <= 0 {
+			c.Images.MaxWidth = 2048
+		}
+		if c.Images.MaxHeight <= 0 {
+			c.Images.MaxHeight = 2048
+		}
+		if c.Images.DefaultQuality <= 0 {
+			c.Images.DefaultQuality = 82
+		}
+		if c.Images.DefaultQuality > 100 {
+			return fmt.Errorf("invalid image default quality: %d", c.Images.DefaultQuality)
+		}
+		if c.Images.MaxSourcePixels <= 0 {
+			c.Images.MaxSourcePixels = 40_000_000
+		}
+		if c.Images.MaxVariants <= 0 {
+			c.Images.MaxVariants = 50
+		}
+		for _, q := range c.Images.AllowedQualities {
+			if q < 1 || q > 100 {
+				return fmt.Errorf("invalid image allowed quality: %d", q)
+			}
+		}
+	}
+
+	if c.Metrics.Enabled {
+		if c.Metrics.Path == "" {
+			c.Metrics.Path = "/metrics"
+		}
+		if c.Metrics.StorageInterval <= 0 {
+			c.Metrics.StorageInterval = time.Minute
+		}
+	}
+
+	if len(c.Webhooks.Endpoints) > 0 {
+		if err := c.Webhooks.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Security.SignedURL.Enabled() {
+		if len(c.Security.SignedURL.Secret) < 32 {
+			return fmt.Errorf("signed url secret must be at least 32 characters")
+		}
+		if c.Security.SignedURL.DefaultTTL <= 0 {
+			c.Security.SignedURL.DefaultTTL = time.Hour
+		}
+		if c.Security.SignedURL.MaxTTL <= 0 {
+			c.Security.SignedURL.MaxTTL = 7 * 24 * time.Hour
+		}
+		if c.Security.SignedURL.DefaultTTL > c.Security.SignedURL.MaxTTL {
+			return fmt.Errorf("signed url default ttl exceeds max ttl")
+		}
+	}
+
+	if c.Security.UploadURL.Enabled {
+		if c.Security.UploadURL.DefaultTTL <= 0 {
+			c.Security.UploadURL.DefaultTTL = 15 * time.Minute
+		}
+		if c.Security.UploadURL.MaxTTL <= 0 {
+			c.Security.UploadURL.MaxTTL = time.Hour
+		}
+		if c.Security.UploadURL.DefaultTTL > c.Security.UploadURL.MaxTTL {
+			return fmt.Errorf("upload url default ttl exceeds max ttl")
+		}
+	}
+
+	if c.Security.Antivirus.Enabled {
+		if c.Security.Antivirus.Address == "" {
+			c.Security.Antivirus.Address = "tcp://127.0.0.1:3310"
+		}
+		if _, _, err := c.Security.Antivirus.Endpoint(); err != nil {
+			return err
+		}
+		if c.Security.Antivirus.Timeout <= 0 {
+			c.Security.Antivirus.Timeout = 30 * time.Second
+		}
+		if c.Security.Antivirus.ChunkSize <= 0 {
+			c.Security.Antivirus.ChunkSize = 64 * 1024
+		}
+	}
+
+	if c.Security.JWT.Enabled {
+		if err := c.Security.JWT.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.RateLimit.Enabled {
+		if err := c.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+
 	if len(c.Tokens) == 0 {
 		return fmt.Errorf("no authentication tokens configured")
 	}
@@ -151,19 +714,51 @@ func (c *Config) Validate() error {
 		if len(token.Permissions) == 0 {
 			return fmt.Errorf("token %d: at least one permission is required", i)
 		}
+		if err := token.ValidateTags(); err != nil {
+			return fmt.Errorf("token %d: %w", i, err)
+		}
+		for name, rule := range map[string]*RateLimitRule{
+			"requests":       &c.Tokens[i].RateLimit.Requests,
+			"upload_bytes":   &c.Tokens[i].RateLimit.UploadBytes,
+			"download_bytes": &c.Tokens[i].RateLimit.DownloadBytes,
+		} {
+			if err := rule.validate(name); err != nil {
+				return fmt.Errorf("token %d: %w", i, err)
+			}
+		}
 	}
 
 	return nil
 }
 
-// FindTokenByKey finds a token by its key
+// validateReplicas rejects the features that only work with a single replica
+func (c *Config) validateReplicas() error {
+	if c.Storage.Index.Enabled {
+		return fmt.Errorf("storage index requires a single replica: its entries are kept in the database of each replica")
+	}
+	if c.Security.UploadURL.Enabled {
+		return fmt.Errorf("upload urls require a single replica: a url could be used once on every replica")
+	}
+	if c.Tus.Enabled {
+		return fmt.Errorf("tus requires a single replica: partial uploads are kept on the local disk of a replica")
+	}
+	if c.Idempotency.Enabled {
+		return fmt.Errorf("idempotency requires a single replica: a retry reaching another replica would be processed again")
+	}
+	return nil
+}
+
+// FindTokenByKey finds a token by its key. Keys are compared in constant
+// time, and all of them are compared so the timing does not reveal which
+// token matched.
 func (c *Config) FindTokenByKey(key string) *TokenConfig {
+	var found *TokenConfig
 	for i := range c.Tokens {
-		if c.Tokens[i].Key == key {
-			return &c.Tokens[i]
+		if subtle.ConstantTimeCompare([]byte(c.Tokens[i].Key), []byte(key)) == 1 {
+			found = &c.Tokens[i]
 		}
 	}
-	return nil
+	return found
 }
 
 // GetBaseURL returns the base URL based on environment
@@ -173,3 +768,48 @@ func (c *Config) GetBaseURL() string {
 	}
 	return fmt.Sprintf("http://localhost:%d", c.App.Port)
 }
+
+// validate checks the webhook endpoints and applies delivery defaults
+func (w *WebhooksConfig) validate() error {
+	ids := map[string]bool{}
+	for i, endpoint := range w.Endpoints {
+		if endpoint.ID == "" {
+			return fmt.Errorf("webhook %d: ID is required", i)
+		}
+		if ids[endpoint.ID] {
+			return fmt.Errorf("webhook %d: duplicate ID %s", i, endpoint.ID)
+		}
+		ids[endpoint.ID] = true
+
+		if !strings.HasPrefix(endpoint.URL, "http://") && !strings.HasPrefix(endpoint.URL, "https://") {
+			return fmt.Errorf("webhook %d: url must be http or https", i)
+		}
+		if len(endpoint.Events) == 0 {
+			return fmt.Errorf("webhook %d: at least one event is required", i)
+		}
+		if endpoint.Secret == "" {
+			return fmt.Errorf("webhook %d: secret is required", i)
+		}
+	}
+
+	if w.Timeout <= 0 {
+		w.Timeout = 10 * time.Second
+	}
+	if w.MaxAttempts <= 0 {
+		w.MaxAttempts = 8
+	}
+	if w.InitialBackoff <= 0 {
+		w.InitialBackoff = 30 * time.Second
+	}
+	if w.MaxBackoff <= 0 {
+		w.MaxBackoff = 6 * time.Hour
+	}
+	if w.Workers <= 0 {
+		w.Workers = 4
+	}
+	if w.LogRetention <= 0 {
+		w.LogRetention = 7 * 24 * time.Hour
+	}
+
+	return nil
+}
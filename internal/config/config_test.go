@@ -0,0 +1,91 @@
+package config
+
+import "testing"
+
+func TestTokenAllowsTag(t *testing.T) {
+	tests := []struct {
+		name       string
+		tags       map[string][]string
+		permission string
+		tag        string
+		want       bool
+	}{
+		{name: "no restrictions", permission: "upload", tag: "anything", want: true},
+		{name: "exact match", tags: map[string][]string{"upload": {"school-a"}}, permission: "upload", tag: "school-a", want: true},
+		{name: "exact mismatch", tags: map[string][]string{"upload": {"school-a"}}, permission: "upload", tag: "school-b"},
+		{name: "glob match", tags: map[string][]string{"read": {"school-*"}}, permission: "read", tag: "school-b", want: true},
+		{name: "glob mismatch", tags: map[string][]string{"read": {"school-*"}}, permission: "read", tag: "media"},
+		{name: "glob does not cross slashes", tags: map[string][]string{"read": {"school-*"}}, permission: "read", tag: "school-a/private"},
+		{name: "several patterns", tags: map[string][]string{"read": {"media", "school-?"}}, permission: "read", tag: "school-c", want: true},
+		{name: "empty list grants no tag", tags: map[string][]string{"read": {}}, permission: "read", tag: "media"},
+		{name: "star applies to permissions without entry", tags: map[string][]string{"*": {"media"}}, permission: "upload", tag: "media", want: true},
+		{name: "star restricts permissions without entry", tags: map[string][]string{"*": {"media"}}, permission: "upload", tag: "school-a"},
+		{name: "own entry takes precedence over star", tags: map[string][]string{"*": {"media"}, "read": {"school-*"}}, permission: "read", tag: "school-a", want: true},
+		{name: "star does not widen own entry", tags: map[string][]string{"*": {"media"}, "read": {"school-*"}}, permission: "read", tag: "media"},
+		{name: "other permission unrestricted", tags: map[string][]string{"upload": {"school-a"}}, permission: "read", tag: "media", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &TokenConfig{Permissions: []string{"upload", "read"}, Tags: tt.tags}
+			if got := token.AllowsTag(tt.permission, tt.tag); got != tt.want {
+				t.Errorf("AllowsTag(%s, %s) = %v, want %v", tt.permission, tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCoversTag(t *testing.T) {
+	token := &TokenConfig{
+		Permissions: []string{"upload", "read"},
+		Tags: map[string][]string{
+			"upload": {"school-a"},
+			"read":   {"school-*"},
+		},
+	}
+
+	tests := []struct {
+		tag  string
+		want bool
+	}{
+		{tag: "school-a", want: true},
+		{tag: "school-b", want: true},
+		{tag: "media"},
+	}
+
+	for _, tt := range tests {
+		if got := token.CoversTag(tt.tag); got != tt.want {
+			t.Errorf("CoversTag(%s) = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+
+	// A token whose permissions grant no tag covers none
+	limited := &TokenConfig{Permissions: []string{"list"}, Tags: map[string][]string{"list": {}}}
+	if limited.CoversTag("media") {
+		t.Error("CoversTag is true for a token without any tag")
+	}
+}
+
+func TestTokenValidateTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string][]string
+		err  string
+	}{
+		{name: "valid", tags: map[string][]string{"upload": {"school-*"}, "*": {"media"}}},
+		{name: "missing permission", tags: map[string][]string{"delete": {"media"}}, err: "tags given for missing permission delete"},
+		{name: "malformed pattern", tags: map[string][]string{"upload": {"school-["}}, err: `invalid tag pattern "school-["`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&TokenConfig{Permissions: []string{"upload", "read"}, Tags: tt.tags}).ValidateTags()
+			if tt.err == "" && err != nil {
+				t.Fatalf("ValidateTags: %v", err)
+			}
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Fatalf("ValidateTags error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -34,7 +34,7 @@ func (h *DeleteHandler) Handle(c *gin.Context) {
 	}
 
 	// Delete file
-	err := h.fileService.Delete(tag, filename)
+	err := h.fileService.Delete(tag, filename, tokenName(c))
 	if err != nil {
 		if err.Error() == "file not found" {
 			utils.NotFoundResponse(c, "File not found")
@@ -1,22 +1,39 @@
 package handlers
 
 import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
 	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/metrics"
 	"github.com/maarifnu/cdn-fileserver/internal/middleware"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
 	"github.com/maarifnu/cdn-fileserver/internal/services"
 	"github.com/maarifnu/cdn-fileserver/internal/utils"
 	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
 )
 
 // DownloadHandler handles file download/view
 type DownloadHandler struct {
-	fileService *services.FileService
+	fileService  *services.FileService
+	imageService *services.ImageService
+	config       *config.Config
 }
 
-// NewDownloadHandler creates a new download handler
-func NewDownloadHandler(fs *services.FileService) *DownloadHandler {
+// NewDownloadHandler creates a new download handler; imageService may be nil,
+// in which case image variant parameters are ignored
+func NewDownloadHandler(fs *services.FileService, is *services.ImageService, cfg *config.Config) *DownloadHandler {
 	return &DownloadHandler{
-		fileService: fs,
+		fileService:  fs,
+		imageService: is,
+		config:       cfg,
 	}
 }
 
@@ -31,41 +48,153 @@ func (h *DownloadHandler) Handle(c *gin.Context) {
 		return
 	}
 
+	// A specific version may be requested; its content never changes
+	version := 0
+	if versionStr := c.Query("version"); versionStr != "" {
+		var err error
+		if version, err = strconv.Atoi(versionStr); err != nil || version < 1 {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid version: must be a positive integer")
+			return
+		}
+	}
+
 	// Get file metadata
-	meta, filePath, err := h.fileService.Download(tag, filename)
+	var meta *models.FileMeta
+	var reader io.ReadCloser
+	var info *services.ObjectInfo
+	var err error
+	if version > 0 {
+		meta, reader, info, err = h.fileService.DownloadVersion(tag, filename, version)
+	} else {
+		meta, reader, info, err = h.fileService.Download(tag, filename)
+	}
 	if err != nil {
 		logger.WithField("error", err).Warn("File not found")
 		utils.NotFoundResponse(c, "File not found")
 		return
 	}
+	defer reader.Close()
 
-	// Check if file is private
+	// Private files need a signed URL or a token with read permission for the
+	// tag; a token without it is refused rather than asked to authenticate
 	if !meta.Public {
-		// Check authentication
-		isAuth := middleware.IsAuthenticated(c)
-		if !isAuth {
-			logger.WithField("file_id", filename).Warn("Unauthorized access to private file")
-			utils.ForbiddenResponse(c, "This file is private and requires authentication")
+		fields := logrus.Fields{
+			"ip":      c.ClientIP(),
+			"tag":     tag,
+			"file_id": filename,
+		}
+		token := middleware.GetTokenFromContext(c)
+		if token != nil {
+			fields["token_name"] = token.Name
+		}
+
+		switch {
+		case middleware.IsAuthenticated(c):
+			logger.WithFields(fields).WithField("signed_url", middleware.IsSignedURL(c)).Debug("Private file access granted")
+		case token != nil:
+			logger.WithFields(fields).Warn("Private file access denied: token lacks read permission")
+			metrics.AuthFailures.WithLabelValues(metrics.AuthInsufficientPermission).Inc()
+			utils.ForbiddenResponse(c, "Token does not have read permission for this file")
 			return
+		default:
+			logger.WithFields(fields).Warn("Private file access denied: authentication required")
+			if c.Query("sig") == "" {
+				// Rejected signed URLs were already counted
+				metrics.AuthFailures.WithLabelValues(metrics.AuthMissingToken).Inc()
+			}
+			utils.UnauthorizedResponse(c, "This file is private and requires authentication")
+			return
+		}
+	}
+
+	// Resized or converted image variant requested
+	name, contentType := meta.OriginalName, meta.ContentType
+	variant := h.imageService != nil && services.HasImageOptions(c.Request.URL.Query())
+	if variant && version > 0 {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid image options: not supported for a specific version")
+		return
+	}
+	if variant {
+		if reader, info, contentType, err = h.variant(c, meta); err != nil {
+			return
+		}
+		defer reader.Close()
+
+		// Keep the download name in line with the converted format
+		if contentType != meta.ContentType {
+			if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+				name = strings.TrimSuffix(name, filepath.Ext(name)) + exts[len(exts)-1]
+			}
 		}
 	}
 
 	// Check if download parameter is set
 	download := c.Query("download")
 	if download == "true" {
-		c.Header("Content-Disposition", "attachment; filename=\""+meta.OriginalName+"\"")
+		// Non-ASCII names are encoded as RFC 2231 filename*
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": name,
+		}))
 	}
 
 	// Set Content-Type header
-	c.Header("Content-Type", meta.ContentType)
+	c.Header("Content-Type", contentType)
+
+	// The content digest doubles as a strong validator for conditional requests
+	if meta.Digest != "" && !variant {
+		c.Header("ETag", `"`+meta.Digest+`"`)
+		c.Header("Digest", utils.DigestHeader(meta.Digest))
+	}
 
-	// Set cache headers for public files
-	if meta.Public {
+	// Set cache headers for public files; signed access must not be shared.
+	// Files that can be replaced in place are only cached briefly.
+	if meta.Public && h.config.Storage.Versioning.Enabled && version == 0 {
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.config.Storage.Versioning.CacheMaxAge.Seconds())))
+	} else if meta.Public {
 		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	} else if middleware.IsSignedURL(c) {
+		c.Header("Cache-Control", "private, no-store")
 	}
 
-	// Serve file
-	c.File(filePath)
+	// Serve file; seekable content gets range and conditional request support
+	if content, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, meta.FileID, info.ModTime, content)
+	} else {
+		c.DataFromReader(http.StatusOK, info.Size, contentType, reader, nil)
+	}
+
+	if written := c.Writer.Size(); written > 0 {
+		metrics.DownloadBytes.WithLabelValues(tag).Add(float64(written))
+	}
 
 	logger.WithField("file_id", filename).Debug("File served successfully")
 }
+
+// variant opens the image variant described by the query, writing an error
+// response when it cannot be produced
+func (h *DownloadHandler) variant(c *gin.Context, meta *models.FileMeta) (io.ReadCloser, *services.ObjectInfo, string, error) {
+	if !h.imageService.IsSupported(meta.ContentType) {
+		err := fmt.Errorf("invalid image: %s cannot be resized", meta.ContentType)
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+		return nil, nil, "", err
+	}
+
+	opts, err := h.imageService.ParseOptions(c.Request.URL.Query())
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+		return nil, nil, "", err
+	}
+
+	reader, info, contentType, err := h.imageService.Variant(meta, opts)
+	if err != nil {
+		if services.IsValidationError(err) {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+		} else {
+			logger.WithField("error", err).Error("Failed to render image variant")
+			utils.InternalServerErrorResponse(c, "Failed to render image")
+		}
+		return nil, nil, "", err
+	}
+
+	return reader, info, contentType, nil
+}
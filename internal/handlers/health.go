@@ -13,14 +13,17 @@ import (
 type HealthHandler struct {
 	config         *config.Config
 	storageService *services.StorageService
+	scrubService   *services.ScrubService
 	startTime      time.Time
 }
 
-// NewHealthHandler creates a new health check handler
-func NewHealthHandler(cfg *config.Config, storage *services.StorageService) *HealthHandler {
+// NewHealthHandler creates a new health check handler; scrub may be nil when
+// the integrity scrubber is disabled
+func NewHealthHandler(cfg *config.Config, storage *services.StorageService, scrub *services.ScrubService) *HealthHandler {
 	return &HealthHandler{
 		config:         cfg,
 		storageService: storage,
+		scrubService:   scrub,
 		startTime:      time.Now(),
 	}
 }
@@ -38,10 +41,24 @@ func (h *HealthHandler) Handle(c *gin.Context) {
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"status":  "ok",
 		"version": h.config.App.Version,
 		"uptime":  uptime.String(),
 		"storage": storageInfo,
-	})
+	}
+
+	// Report the last integrity scrub; damaged content degrades the status
+	if h.scrubService != nil {
+		report, running := h.scrubService.Report()
+		response["integrity"] = gin.H{
+			"running":     running,
+			"last_report": report,
+		}
+		if report != nil && len(report.Issues) > 0 {
+			response["status"] = "degraded"
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/middleware"
 	"github.com/maarifnu/cdn-fileserver/internal/services"
 	"github.com/maarifnu/cdn-fileserver/internal/utils"
 	"github.com/maarifnu/cdn-fileserver/pkg/logger"
@@ -66,6 +67,12 @@ func (h *ListHandler) Handle(c *gin.Context) {
 		SortDesc: sortDesc,
 	}
 
+	// Tokens limited to some tags only see files in those tags
+	if tag != "" && !middleware.RequireTag(c, "list", tag) {
+		return
+	}
+	listReq.TagAllowed = tagFilter(c, "list")
+
 	// Get files
 	files, totalItems, err := h.fileService.List(listReq)
 	if err != nil {
@@ -75,7 +82,6 @@ func (h *ListHandler) Handle(c *gin.Context) {
 	}
 
 	// Build file responses with URLs
-	baseURL := h.config.GetBaseURL()
 	fileResponses := make([]map[string]interface{}, 0, len(files))
 
 	for _, file := range files {
@@ -83,12 +89,14 @@ func (h *ListHandler) Handle(c *gin.Context) {
 			"file_id":       file.FileID,
 			"original_name": file.OriginalName,
 			"tag":           file.Tag,
-			"url":           baseURL + "/" + file.Tag + "/" + file.FileID,
+			"url":           h.fileService.FileURL(file.Tag, file.FileID),
 			"size":          file.Size,
 			"content_type":  file.ContentType,
 			"public":        file.Public,
 			"uploaded_at":   file.UploadedAt,
 			"uploaded_by":   file.UploadedBy,
+			"digest":        file.Digest,
+			"version":       file.Version,
 		})
 	}
 
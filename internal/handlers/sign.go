@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/middleware"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// SignHandler mints signed download URLs
+type SignHandler struct {
+	fileService *services.FileService
+}
+
+// NewSignHandler creates a new sign handler
+func NewSignHandler(fs *services.FileService) *SignHandler {
+	return &SignHandler{
+		fileService: fs,
+	}
+}
+
+// SignRequest represents a signed URL request body
+type SignRequest struct {
+	ExpiresIn int64  `json:"expires_in"` // seconds, default from config
+	IP        string `json:"ip"`         // bind the URL to this client IP
+	BindIP    bool   `json:"bind_ip"`    // bind the URL to the caller's IP
+}
+
+// Handle processes a signed URL request
+func (h *SignHandler) Handle(c *gin.Context) {
+	tag := c.Param("tag")
+	filename := c.Param("filename")
+
+	// The body is optional
+	var req SignRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "Invalid request body")
+			return
+		}
+	}
+
+	if req.ExpiresIn < 0 {
+		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
+			"expires_in": "Expiry must be a positive number of seconds",
+		})
+		return
+	}
+
+	ip := req.IP
+	if ip == "" && req.BindIP {
+		ip = c.ClientIP()
+	}
+	if ip != "" && net.ParseIP(ip) == nil {
+		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
+			"ip": "Invalid IP address",
+		})
+		return
+	}
+
+	signed, err := h.fileService.SignURL(tag, filename, time.Duration(req.ExpiresIn)*time.Second, ip)
+	if err != nil {
+		switch {
+		case err.Error() == "file not found":
+			utils.NotFoundResponse(c, "File not found")
+		case services.IsValidationError(err):
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+		default:
+			logger.WithField("error", err).Error("Failed to sign URL")
+			utils.InternalServerErrorResponse(c, "Failed to sign URL")
+		}
+		return
+	}
+
+	token := middleware.GetTokenFromContext(c)
+	logger.WithFields(logrus.Fields{
+		"file_id":    filename,
+		"tag":        tag,
+		"token_name": token.Name,
+		"expires_at": signed.ExpiresAt,
+	}).Info("Signed URL created")
+
+	utils.SuccessResponse(c, http.StatusOK, "Signed URL created successfully", signed)
+}
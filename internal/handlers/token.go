@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/middleware"
+)
+
+// tagFilter returns a filter limiting listings to the tags in which the token
+// has a permission, or nil if the token is not limited
+func tagFilter(c *gin.Context, permission string) func(tag string) bool {
+	token := middleware.GetTokenFromContext(c)
+	if token == nil || len(token.Tags) == 0 {
+		return nil
+	}
+
+	return func(tag string) bool {
+		return token.AllowsTag(permission, tag)
+	}
+}
+
+// tokenName returns the name of the authenticated token
+func tokenName(c *gin.Context) string {
+	if token := middleware.GetTokenFromContext(c); token != nil {
+		return token.Name
+	}
+	return "Unknown"
+}
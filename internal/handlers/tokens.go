@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// TokenHandler handles the management of API tokens
+type TokenHandler struct {
+	tokenService *services.TokenService
+}
+
+// NewTokenHandler creates a new token handler
+func NewTokenHandler(ts *services.TokenService) *TokenHandler {
+	return &TokenHandler{
+		tokenService: ts,
+	}
+}
+
+// createTokenRequest is the body of a token creation request
+type createTokenRequest struct {
+	Name        string              `json:"name"`
+	Permissions []string            `json:"permissions"`
+	Tags        map[string][]string `json:"tags"`
+	ExpiresAt   *time.Time          `json:"expires_at"`
+}
+
+// expireTokenRequest is the optional body of a token expiry request
+type expireTokenRequest struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// List lists all tokens without their keys
+func (h *TokenHandler) List(c *gin.Context) {
+	tokens, err := h.tokenService.List()
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to list tokens")
+		utils.InternalServerErrorResponse(c, "Failed to retrieve tokens")
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Tokens retrieved successfully", gin.H{
+		"tokens": tokens,
+	})
+}
+
+// Create issues a new token; its key is only returned in this response
+func (h *TokenHandler) Create(c *gin.Context) {
+	var req createTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid request body: "+err.Error())
+		return
+	}
+
+	token, err := h.tokenService.Create(&services.TokenCreateRequest{
+		Name:        req.Name,
+		Permissions: req.Permissions,
+		Tags:        req.Tags,
+		ExpiresAt:   req.ExpiresAt,
+		CreatedBy:   tokenName(c),
+	})
+	if err != nil {
+		h.error(c, err, "Failed to create token")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"token_id":   token.ID,
+		"token_name": token.Name,
+		"created_by": token.CreatedBy,
+	}).Info("Token created")
+
+	utils.SuccessResponse(c, http.StatusCreated, "Token created successfully", token)
+}
+
+// Rotate replaces the key of a token; the new key is only returned in this
+// response
+func (h *TokenHandler) Rotate(c *gin.Context) {
+	token, err := h.tokenService.Rotate(c.Param("id"))
+	if err != nil {
+		h.error(c, err, "Failed to rotate token")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"token_id":   token.ID,
+		"rotated_by": tokenName(c),
+	}).Info("Token rotated")
+
+	utils.SuccessResponse(c, http.StatusOK, "Token rotated successfully", token)
+}
+
+// Expire sets when a token stops working, immediately unless a time is given
+func (h *TokenHandler) Expire(c *gin.Context) {
+	var req expireTokenRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid request body: "+err.Error())
+			return
+		}
+	}
+
+	expiresAt := time.Now()
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+
+	token, err := h.tokenService.Expire(c.Param("id"), expiresAt)
+	if err != nil {
+		h.error(c, err, "Failed to expire token")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"token_id":   token.ID,
+		"expires_at": expiresAt,
+		"expired_by": tokenName(c),
+	}).Info("Token expiry set")
+
+	utils.SuccessResponse(c, http.StatusOK, "Token expiry set successfully", token)
+}
+
+// Revoke permanently disables a token
+func (h *TokenHandler) Revoke(c *gin.Context) {
+	token, err := h.tokenService.Revoke(c.Param("id"))
+	if err != nil {
+		h.error(c, err, "Failed to revoke token")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"token_id":   token.ID,
+		"revoked_by": tokenName(c),
+	}).Info("Token revoked")
+
+	utils.SuccessResponse(c, http.StatusOK, "Token revoked successfully", token)
+}
+
+// error writes the response for a failed token operation
+func (h *TokenHandler) error(c *gin.Context, err error, message string) {
+	switch {
+	case err.Error() == "token not found":
+		utils.NotFoundResponse(c, "Token not found")
+	case services.IsValidationError(err):
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+	default:
+		logger.WithField("error", err).Error(message)
+		utils.InternalServerErrorResponse(c, message)
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/middleware"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// TrashHandler handles listing, restoring and purging deleted files
+type TrashHandler struct {
+	fileService *services.FileService
+}
+
+// NewTrashHandler creates a new trash handler
+func NewTrashHandler(fs *services.FileService) *TrashHandler {
+	return &TrashHandler{
+		fileService: fs,
+	}
+}
+
+// List lists the files in the trash, most recently deleted first
+func (h *TrashHandler) List(c *gin.Context) {
+	// Parse pagination parameters
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	tag := c.Query("tag")
+	if tag != "" && !middleware.RequireTag(c, "delete", tag) {
+		return
+	}
+
+	files, totalItems, err := h.fileService.ListTrash(&services.TrashListRequest{
+		Tag:        tag,
+		Page:       page,
+		Limit:      limit,
+		TagAllowed: tagFilter(c, "delete"),
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to list trash")
+		utils.InternalServerErrorResponse(c, "Failed to retrieve trash")
+		return
+	}
+
+	fileResponses := make([]map[string]interface{}, 0, len(files))
+	for _, file := range files {
+		fileResponses = append(fileResponses, trashedFileResponse(file))
+	}
+
+	// Calculate pagination metadata
+	totalPages := (totalItems + limit - 1) / limit
+	if totalPages < 1 {
+		totalPages = 1
+	}
+
+	utils.PaginationResponse(c, "Trash retrieved successfully", fileResponses, &utils.PaginationMeta{
+		CurrentPage:  page,
+		TotalPages:   totalPages,
+		TotalItems:   totalItems,
+		ItemsPerPage: limit,
+		HasNext:      page < totalPages,
+		HasPrev:      page > 1,
+	})
+}
+
+// Restore moves a file out of the trash
+func (h *TrashHandler) Restore(c *gin.Context) {
+	tag := c.Param("tag")
+	filename := c.Param("filename")
+
+	meta, err := h.fileService.Restore(tag, filename)
+	if err != nil {
+		switch err.Error() {
+		case "file not found":
+			utils.NotFoundResponse(c, "File not found in trash")
+		case "file already exists":
+			utils.ErrorResponse(c, http.StatusConflict, "Conflict", "A file with this name already exists")
+		default:
+			logger.WithField("error", err).Error("Failed to restore file")
+			utils.InternalServerErrorResponse(c, "Failed to restore file")
+		}
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "File restored successfully", map[string]interface{}{
+		"file_id":       meta.FileID,
+		"original_name": meta.OriginalName,
+		"tag":           meta.Tag,
+		"url":           h.fileService.FileURL(meta.Tag, meta.FileID),
+		"size":          meta.Size,
+		"content_type":  meta.ContentType,
+		"public":        meta.Public,
+		"uploaded_at":   meta.UploadedAt,
+		"uploaded_by":   meta.UploadedBy,
+		"digest":        meta.Digest,
+	})
+}
+
+// Purge permanently removes a file from the trash
+func (h *TrashHandler) Purge(c *gin.Context) {
+	tag := c.Param("tag")
+	filename := c.Param("filename")
+
+	if err := h.fileService.Purge(tag, filename); err != nil {
+		if err.Error() == "file not found" {
+			utils.NotFoundResponse(c, "File not found in trash")
+			return
+		}
+
+		logger.WithField("error", err).Error("Failed to purge file")
+		utils.InternalServerErrorResponse(c, "Failed to purge file")
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "File purged successfully", map[string]interface{}{
+		"file_id": filename,
+		"tag":     tag,
+	})
+}
+
+// trashedFileResponse builds the response entry of a trashed file
+func trashedFileResponse(file *models.FileMeta) map[string]interface{} {
+	return map[string]interface{}{
+		"file_id":       file.FileID,
+		"original_name": file.OriginalName,
+		"tag":           file.Tag,
+		"size":          file.Size,
+		"content_type":  file.ContentType,
+		"public":        file.Public,
+		"uploaded_at":   file.UploadedAt,
+		"uploaded_by":   file.UploadedBy,
+		"digest":        file.Digest,
+		"deleted_at":    file.DeletedAt,
+		"deleted_by":    file.DeletedBy,
+	}
+}
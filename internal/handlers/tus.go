@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/middleware"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// tus protocol constants
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// TusHandler handles resumable uploads using the tus 1.0 protocol
+type TusHandler struct {
+	tusService *services.TusService
+	config     *config.Config
+}
+
+// NewTusHandler creates a new tus handler
+func NewTusHandler(ts *services.TusService, cfg *config.Config) *TusHandler {
+	return &TusHandler{
+		tusService: ts,
+		config:     cfg,
+	}
+}
+
+// Options advertises the supported protocol version and extensions
+func (h *TusHandler) Options(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(h.config.Storage.MaxFileSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// Create processes an upload creation request
+func (h *TusHandler) Create(c *gin.Context) {
+	if !h.checkVersion(c) {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "Upload-Length header is required")
+		return
+	}
+
+	if length > h.config.Storage.MaxFileSize {
+		utils.ErrorResponse(c, http.StatusRequestEntityTooLarge, "Validation error",
+			"file size exceeds maximum limit")
+		return
+	}
+
+	metadata, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "Upload-Metadata header is malformed")
+		return
+	}
+
+	// Accept the filename keys used by common tus clients
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" {
+		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
+			"filename": "Filename metadata is required",
+		})
+		return
+	}
+
+	if metadata["tag"] == "" {
+		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
+			"tag": "Tag metadata is required",
+		})
+		return
+	}
+
+	// The token may be limited to some tags
+	if !middleware.RequireTag(c, "upload", metadata["tag"]) {
+		return
+	}
+
+	public, err := strconv.ParseBool(metadata["public"])
+	if err != nil {
+		public = false
+	}
+
+	// Get token info from context
+	token := middleware.GetTokenFromContext(c)
+	tokenID, tokenName := "", "Unknown"
+	if token != nil {
+		tokenID, tokenName = token.ID, token.Name
+	}
+
+	upload, err := h.tusService.Create(&services.TusCreateRequest{
+		Tag:        metadata["tag"],
+		Filename:   filename,
+		Public:     public,
+		Length:     length,
+		Metadata:   metadata,
+		TokenID:    tokenID,
+		UploadedBy: tokenName,
+	})
+	if err != nil {
+		h.handleError(c, err)
+		return
+	}
+
+	c.Header("Location", h.config.GetBaseURL()+"/api/uploads/"+upload.Tag+"/"+upload.ID)
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// Head reports the current offset of an upload
+func (h *TusHandler) Head(c *gin.Context) {
+	if !h.checkVersion(c) {
+		return
+	}
+
+	upload, ok := h.getUpload(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// Patch appends data to an upload
+func (h *TusHandler) Patch(c *gin.Context) {
+	if !h.checkVersion(c) {
+		return
+	}
+
+	if c.ContentType() != tusContentType {
+		utils.ErrorResponse(c, http.StatusUnsupportedMediaType, "Unsupported Media Type",
+			"Content-Type must be "+tusContentType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "Upload-Offset header is required")
+		return
+	}
+
+	if _, ok := h.getUpload(c); !ok {
+		return
+	}
+
+	upload, err := h.tusService.Append(c.Param("tag"), c.Param("id"), offset, c.Request.Body)
+	if upload != nil {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if err != nil {
+		h.handleError(c, err)
+		return
+	}
+
+	// The final request returns the stored file like POST /upload does
+	if upload.Result != nil {
+		utils.SuccessResponse(c, http.StatusOK, "File uploaded successfully", upload.Result)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Delete terminates an upload
+func (h *TusHandler) Delete(c *gin.Context) {
+	if !h.checkVersion(c) {
+		return
+	}
+
+	if _, ok := h.getUpload(c); !ok {
+		return
+	}
+
+	if err := h.tusService.Terminate(c.Param("tag"), c.Param("id")); err != nil {
+		h.handleError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// checkVersion sets the Tus-Resumable header and rejects unsupported clients
+func (h *TusHandler) checkVersion(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		utils.ErrorResponse(c, http.StatusPreconditionFailed, "Precondition Failed",
+			"Unsupported tus version, expected "+tusVersion)
+		return false
+	}
+
+	return true
+}
+
+// getUpload loads the upload addressed by the request and checks that it
+// belongs to the requesting token
+func (h *TusHandler) getUpload(c *gin.Context) (*services.TusUpload, bool) {
+	upload, err := h.tusService.Get(c.Param("tag"), c.Param("id"))
+	if err != nil {
+		h.handleError(c, err)
+		return nil, false
+	}
+
+	token := middleware.GetTokenFromContext(c)
+	if token == nil || token.ID != upload.TokenID {
+		utils.NotFoundResponse(c, "Upload not found")
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// handleError maps tus service errors to responses
+func (h *TusHandler) handleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrUploadNotFound):
+		utils.NotFoundResponse(c, "Upload not found")
+	case errors.Is(err, services.ErrUploadOffsetMismatch):
+		utils.ErrorResponse(c, http.StatusConflict, "Conflict", "Upload-Offset does not match the current offset")
+	case errors.Is(err, services.ErrUploadLocked):
+		utils.ErrorResponse(c, http.StatusLocked, "Locked", err.Error())
+	case services.IsValidationError(err):
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+	default:
+		logger.WithFields(logrus.Fields{
+			"upload_id": c.Param("id"),
+			"error":     err,
+		}).Error("Resumable upload failed")
+		utils.InternalServerErrorResponse(c, "Failed to process upload")
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header ("key base64value,...")
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			return nil, errors.New("empty metadata key")
+		}
+
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+
+	return metadata, nil
+}
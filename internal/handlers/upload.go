@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"errors"
+	"io"
 	"net/http"
+	"os"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -9,6 +12,7 @@ import (
 	"github.com/maarifnu/cdn-fileserver/internal/services"
 	"github.com/maarifnu/cdn-fileserver/internal/utils"
 	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
 )
 
 // UploadHandler handles file upload
@@ -23,20 +27,142 @@ func NewUploadHandler(fs *services.FileService) *UploadHandler {
 	}
 }
 
-// Handle processes file upload request
+// maxFormFieldSize limits the text fields of a streamed upload form
+const maxFormFieldSize = 4096
+
+// Handle processes file upload request. The form is read as a stream: when
+// the tag and public flag precede the file, as form fields or query
+// parameters, the file is written straight into storage; otherwise it is
+// spooled to a temporary file until the remaining fields were read.
 func (h *UploadHandler) Handle(c *gin.Context) {
-	// Get uploaded file
-	file, err := c.FormFile("file")
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
-		logger.WithField("error", err).Warn("No file uploaded")
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid request body: "+err.Error())
+		return
+	}
+
+	fields := map[string]string{}
+	for _, name := range []string{"tag", "public"} {
+		if value, ok := c.GetQuery(name); ok {
+			fields[name] = value
+		}
+	}
+
+	// A presigned upload URL fixes the tag and public flag
+	grant := middleware.GetUploadGrant(c)
+	if grant != nil {
+		fields["tag"] = grant.Tag
+		fields["public"] = strconv.FormatBool(grant.Public)
+	}
+
+	var spooled *os.File
+	var filename string
+	defer func() {
+		if spooled != nil {
+			spooled.Close()
+			os.Remove(spooled.Name())
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid request body: "+err.Error())
+			return
+		}
+
+		switch name := part.FormName(); name {
+		case "tag", "public":
+			if grant != nil {
+				break
+			}
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid request body: "+err.Error())
+				return
+			}
+			fields[name] = string(value)
+
+		case "file":
+			if filename != "" {
+				// Only the first file is uploaded
+				break
+			}
+			filename = part.FileName()
+
+			_, hasTag := fields["tag"]
+			_, hasPublic := fields["public"]
+			if hasTag && hasPublic {
+				h.upload(c, filename, -1, part, fields)
+				return
+			}
+
+			if spooled, err = h.spool(c, part); err != nil {
+				return
+			}
+		}
+		part.Close()
+	}
+
+	if filename == "" {
+		logger.Warn("No file uploaded")
 		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
 			"file": "File is required",
 		})
 		return
 	}
 
-	// Get tag
-	tag := c.PostForm("tag")
+	info, err := spooled.Stat()
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to open uploaded file")
+		utils.InternalServerErrorResponse(c, "Failed to upload file")
+		return
+	}
+
+	h.upload(c, filename, info.Size(), spooled, fields)
+}
+
+// Stream processes a raw upload; the request body is the file content and
+// the tag and filename are taken from the path
+func (h *UploadHandler) Stream(c *gin.Context) {
+	fields := map[string]string{
+		"tag":    c.Param("tag"),
+		"public": c.Query("public"),
+	}
+
+	h.upload(c, c.Param("name"), c.Request.ContentLength, c.Request.Body, fields)
+}
+
+// spool copies a file part to a temporary file, stopping one byte past the
+// maximum file size. It writes the error response itself on failure.
+func (h *UploadHandler) spool(c *gin.Context, part io.Reader) (*os.File, error) {
+	file, err := os.CreateTemp("", "cdn-upload-*")
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to create temporary file")
+		utils.InternalServerErrorResponse(c, "Failed to upload file")
+		return nil, err
+	}
+
+	_, err = io.Copy(file, io.LimitReader(part, h.fileService.MaxFileSize()+1))
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		h.uploadError(c, err)
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// upload validates the form fields and stores the content of an upload
+func (h *UploadHandler) upload(c *gin.Context, filename string, size int64, content io.Reader, fields map[string]string) {
+	tag := fields["tag"]
 	if tag == "" {
 		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
 			"tag": "Tag is required",
@@ -44,46 +170,162 @@ func (h *UploadHandler) Handle(c *gin.Context) {
 		return
 	}
 
+	// The token may be limited to some tags
+	if !middleware.RequireTag(c, "upload", tag) {
+		return
+	}
+
 	// Get public flag (default: false)
-	publicStr := c.DefaultPostForm("public", "false")
-	public, err := strconv.ParseBool(publicStr)
+	public, err := strconv.ParseBool(fields["public"])
 	if err != nil {
 		public = false
 	}
 
-	// Get token info from context
-	token := middleware.GetTokenFromContext(c)
-	tokenName := "Unknown"
-	if token != nil {
-		tokenName = token.Name
-	}
-
-	// Create upload request
-	uploadReq := &services.UploadRequest{
-		File:       file,
+	req := &services.UploadRequest{
+		Filename:   filename,
+		Size:       size,
+		Content:    content,
 		Tag:        tag,
 		Public:     public,
-		UploadedBy: tokenName,
+		UploadedBy: tokenName(c),
+	}
+	if grant := middleware.GetUploadGrant(c); grant != nil {
+		req.MaxSize = grant.MaxSize
+		req.Extensions = grant.Extensions
+	}
+
+	response, err := h.fileService.Upload(req)
+	if err != nil {
+		h.uploadError(c, err)
+		return
+	}
+
+	logger.WithField("file_id", response.FileID).Info("File uploaded successfully")
+
+	utils.SuccessResponse(c, http.StatusOK, "File uploaded successfully", response)
+}
+
+// uploadError writes the response for a failed upload
+func (h *UploadHandler) uploadError(c *gin.Context, err error) {
+	logger.WithField("error", err).Error("File upload failed")
+
+	var infected *services.InfectedError
+	switch {
+	case errors.As(err, &infected):
+		utils.ErrorResponse(c, http.StatusUnprocessableEntity, "Validation error", err.Error())
+	case errors.Is(err, services.ErrFileTooLarge):
+		utils.ErrorResponse(c, http.StatusRequestEntityTooLarge, "Validation error", err.Error())
+	case services.IsValidationError(err):
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+	default:
+		utils.InternalServerErrorResponse(c, "Failed to upload file")
 	}
+}
 
-	// Upload file
-	response, err := h.fileService.Upload(uploadReq)
+// Batch processes an upload of several files. Each file may override the
+// tag and public fields through tags[] and public[] at its position.
+func (h *UploadHandler) Batch(c *gin.Context) {
+	form, err := c.MultipartForm()
 	if err != nil {
-		logger.WithField("error", err).Error("File upload failed")
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid request body: "+err.Error())
+		return
+	}
+
+	files := form.File["files[]"]
+	if len(files) == 0 {
+		files = form.File["files"]
+	}
+	if len(files) == 0 {
+		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
+			"files[]": "At least one file is required",
+		})
+		return
+	}
+
+	tags := form.Value["tags[]"]
+	publics := form.Value["public[]"]
+	atomic, _ := strconv.ParseBool(c.PostForm("atomic"))
+
+	requests := make([]*services.UploadRequest, 0, len(files))
+	for i, file := range files {
+		tag := c.PostForm("tag")
+		if i < len(tags) && tags[i] != "" {
+			tag = tags[i]
+		}
 
-		// Check if it's a validation error
-		if err.Error() == "file is empty" ||
-			err.Error()[:8] == "invalid " ||
-			err.Error()[:5] == "file " {
-			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+		publicStr := c.DefaultPostForm("public", "false")
+		if i < len(publics) && publics[i] != "" {
+			publicStr = publics[i]
+		}
+		public, _ := strconv.ParseBool(publicStr)
+
+		src, err := file.Open()
+		if err != nil {
+			logger.WithField("error", err).Error("Failed to open uploaded file")
+			utils.InternalServerErrorResponse(c, "Failed to upload files")
 			return
 		}
+		defer src.Close()
 
-		utils.InternalServerErrorResponse(c, "Failed to upload file")
+		requests = append(requests, &services.UploadRequest{
+			Filename:   file.Filename,
+			Size:       file.Size,
+			Content:    src,
+			Tag:        tag,
+			Public:     public,
+			UploadedBy: tokenName(c),
+		})
+	}
+
+	results, err := h.fileService.UploadBatch(&services.BatchUploadRequest{
+		Files:      requests,
+		Atomic:     atomic,
+		TagAllowed: tagFilter(c, "upload"),
+	})
+	if err != nil && results == nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
 		return
 	}
 
-	logger.WithField("file_id", response.FileID).Info("File uploaded successfully")
+	uploaded := 0
+	for _, result := range results {
+		if result.Success {
+			uploaded++
+		}
+	}
+	data := gin.H{
+		"files":    results,
+		"uploaded": uploaded,
+		"failed":   len(results) - uploaded,
+		"atomic":   atomic,
+	}
 
-	utils.SuccessResponse(c, http.StatusOK, "File uploaded successfully", response)
+	logger.WithFields(logrus.Fields{
+		"uploaded": uploaded,
+		"failed":   len(results) - uploaded,
+		"atomic":   atomic,
+	}).Info("Batch upload processed")
+
+	switch {
+	case err != nil:
+		// Atomic batch aborted; nothing was kept
+		status, message := http.StatusBadRequest, err.Error()
+		if !services.IsValidationError(err) {
+			status, message = http.StatusInternalServerError, "Failed to upload files"
+		}
+		c.JSON(status, utils.APIResponse{
+			Success: false,
+			Message: "Batch upload failed",
+			Data:    data,
+			Error:   message,
+		})
+	case uploaded < len(results):
+		c.JSON(http.StatusMultiStatus, utils.APIResponse{
+			Success: false,
+			Message: "Some files failed to upload",
+			Data:    data,
+		})
+	default:
+		utils.SuccessResponse(c, http.StatusOK, "Files uploaded successfully", data)
+	}
 }
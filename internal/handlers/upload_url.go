@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/middleware"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// UploadURLHandler mints presigned upload URLs
+type UploadURLHandler struct {
+	uploadURLs *services.UploadURLService
+}
+
+// NewUploadURLHandler creates a new upload URL handler
+func NewUploadURLHandler(uploadURLs *services.UploadURLService) *UploadURLHandler {
+	return &UploadURLHandler{
+		uploadURLs: uploadURLs,
+	}
+}
+
+// UploadURLCreateRequest represents an upload URL request body
+type UploadURLCreateRequest struct {
+	Tag        string   `json:"tag"`
+	MaxSize    int64    `json:"max_size"`   // bytes, default the maximum file size
+	Extensions []string `json:"extensions"` // default all allowed extensions
+	Public     bool     `json:"public"`
+	ExpiresIn  int64    `json:"expires_in"` // seconds, default from config
+}
+
+// Create processes an upload URL request
+func (h *UploadURLHandler) Create(c *gin.Context) {
+	var req UploadURLCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "Invalid request body")
+		return
+	}
+
+	if req.Tag == "" {
+		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
+			"tag": "Tag is required",
+		})
+		return
+	}
+
+	// The token may be limited to some tags
+	if !middleware.RequireTag(c, "upload", req.Tag) {
+		return
+	}
+
+	token := middleware.GetTokenFromContext(c)
+	uploadURL, err := h.uploadURLs.Create(&services.UploadURLRequest{
+		Tag:        req.Tag,
+		MaxSize:    req.MaxSize,
+		Extensions: req.Extensions,
+		Public:     req.Public,
+		TTL:        time.Duration(req.ExpiresIn) * time.Second,
+		Token:      token,
+	})
+	if err != nil {
+		if services.IsValidationError(err) {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+			return
+		}
+
+		logger.WithField("error", err).Error("Failed to create upload URL")
+		utils.InternalServerErrorResponse(c, "Failed to create upload URL")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"grant_id":   uploadURL.ID,
+		"tag":        uploadURL.Tag,
+		"token_name": token.Name,
+		"expires_at": uploadURL.ExpiresAt,
+	}).Info("Upload URL created")
+
+	utils.SuccessResponse(c, http.StatusCreated, "Upload URL created successfully", uploadURL)
+}
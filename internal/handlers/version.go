@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// VersionHandler handles replacing files in place and their version history
+type VersionHandler struct {
+	fileService *services.FileService
+}
+
+// NewVersionHandler creates a new version handler
+func NewVersionHandler(fs *services.FileService) *VersionHandler {
+	return &VersionHandler{
+		fileService: fs,
+	}
+}
+
+// Replace processes a request to replace the content of a file
+func (h *VersionHandler) Replace(c *gin.Context) {
+	tag := c.Param("tag")
+	filename := c.Param("filename")
+
+	// Get uploaded file
+	file, err := c.FormFile("file")
+	if err != nil {
+		logger.WithField("error", err).Warn("No file uploaded")
+		utils.ValidationErrorResponse(c, "Validation error", map[string]string{
+			"file": "File is required",
+		})
+		return
+	}
+
+	// Visibility is kept unless given
+	var public *bool
+	if publicStr := c.PostForm("public"); publicStr != "" {
+		if value, err := strconv.ParseBool(publicStr); err == nil {
+			public = &value
+		}
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to open uploaded file")
+		utils.InternalServerErrorResponse(c, "Failed to replace file")
+		return
+	}
+	defer src.Close()
+
+	response, err := h.fileService.Replace(&services.ReplaceRequest{
+		Tag:        tag,
+		FileID:     filename,
+		Filename:   file.Filename,
+		Size:       file.Size,
+		Content:    src,
+		Public:     public,
+		UploadedBy: tokenName(c),
+	})
+	if err != nil {
+		var infected *services.InfectedError
+		switch {
+		case err.Error() == "file not found":
+			utils.NotFoundResponse(c, "File not found")
+		case errors.As(err, &infected):
+			utils.ErrorResponse(c, http.StatusUnprocessableEntity, "Validation error", err.Error())
+		case services.IsValidationError(err):
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+		default:
+			logger.WithField("error", err).Error("File replace failed")
+			utils.InternalServerErrorResponse(c, "Failed to replace file")
+		}
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "File replaced successfully", response)
+}
+
+// List lists all versions of a file, newest first
+func (h *VersionHandler) List(c *gin.Context) {
+	tag := c.Param("tag")
+	filename := c.Param("filename")
+
+	versions, err := h.fileService.Versions(tag, filename)
+	if err != nil {
+		if err.Error() == "file not found" {
+			utils.NotFoundResponse(c, "File not found")
+			return
+		}
+
+		logger.WithField("error", err).Error("Failed to list versions")
+		utils.InternalServerErrorResponse(c, "Failed to retrieve versions")
+		return
+	}
+
+	fileURL := h.fileService.FileURL(tag, filename)
+	versionResponses := make([]map[string]interface{}, 0, len(versions))
+	for i, meta := range versions {
+		versionResponses = append(versionResponses, map[string]interface{}{
+			"version":       meta.Version,
+			"current":       i == 0,
+			"url":           fileURL + "?version=" + strconv.Itoa(meta.Version),
+			"original_name": meta.OriginalName,
+			"size":          meta.Size,
+			"content_type":  meta.ContentType,
+			"uploaded_at":   meta.UploadedAt,
+			"uploaded_by":   meta.UploadedBy,
+			"digest":        meta.Digest,
+		})
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Versions retrieved successfully", gin.H{
+		"file_id":  filename,
+		"tag":      tag,
+		"versions": versionResponses,
+	})
+}
+
+// Rollback makes a prior version the current content of a file
+func (h *VersionHandler) Rollback(c *gin.Context) {
+	tag := c.Param("tag")
+	filename := c.Param("filename")
+
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 1 {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid version: must be a positive integer")
+		return
+	}
+
+	response, err := h.fileService.Rollback(tag, filename, version, tokenName(c))
+	if err != nil {
+		switch {
+		case err.Error() == "file not found":
+			utils.NotFoundResponse(c, "File not found")
+		case err.Error() == "version not found":
+			utils.NotFoundResponse(c, "Version not found")
+		case err.Error() == "version content missing":
+			utils.ErrorResponse(c, http.StatusGone, "Gone", "The content of this version is no longer stored")
+		case services.IsValidationError(err):
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", err.Error())
+		default:
+			logger.WithField("error", err).Error("File rollback failed")
+			utils.InternalServerErrorResponse(c, "Failed to restore version")
+		}
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Version restored successfully", response)
+}
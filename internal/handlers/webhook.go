@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// WebhookHandler handles the webhook delivery log
+type WebhookHandler struct {
+	webhookService *services.WebhookService
+}
+
+// NewWebhookHandler creates a new webhook handler
+func NewWebhookHandler(ws *services.WebhookService) *WebhookHandler {
+	return &WebhookHandler{
+		webhookService: ws,
+	}
+}
+
+// Deliveries lists webhook deliveries, newest first
+func (h *WebhookHandler) Deliveries(c *gin.Context) {
+	// Parse pagination parameters
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	deliveries, totalItems, err := h.webhookService.Deliveries(&services.DeliveryListRequest{
+		Status:   c.Query("status"),
+		Event:    c.Query("event"),
+		Endpoint: c.Query("endpoint"),
+		Page:     page,
+		Limit:    limit,
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to list webhook deliveries")
+		utils.InternalServerErrorResponse(c, "Failed to retrieve webhook deliveries")
+		return
+	}
+
+	// Calculate pagination metadata
+	totalPages := (totalItems + limit - 1) / limit
+	if totalPages < 1 {
+		totalPages = 1
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Webhook deliveries retrieved successfully", gin.H{
+		"deliveries": deliveries,
+		"pagination": &utils.PaginationMeta{
+			CurrentPage:  page,
+			TotalPages:   totalPages,
+			TotalItems:   totalItems,
+			ItemsPerPage: limit,
+			HasNext:      page < totalPages,
+			HasPrev:      page > 1,
+		},
+	})
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cdn"
+
+// Registry holds all application metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// RequestsTotal counts HTTP requests by method, route and status
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests.",
+	}, []string{"method", "route", "status"})
+
+	// RequestDuration observes HTTP request latency by method, route and status
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// UploadBytes counts bytes of stored uploads by tag
+	UploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Total bytes of successfully stored uploads.",
+	}, []string{"tag"})
+
+	// DownloadBytes counts bytes served by tag
+	DownloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_bytes_total",
+		Help:      "Total bytes of file content served.",
+	}, []string{"tag"})
+
+	// AuthFailures counts rejected authentication attempts by reason
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Total number of rejected authentication attempts.",
+	}, []string{"reason"})
+
+	// InfectedUploads counts uploads rejected by the antivirus scan, by tag
+	InfectedUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "infected_uploads_total",
+		Help:      "Total number of uploads rejected because malware was detected.",
+	}, []string{"tag"})
+
+	// RateLimited counts requests rejected by a rate limit, by limit
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Total number of requests rejected by a rate limit.",
+	}, []string{"limit"})
+)
+
+// Authentication failure reasons
+const (
+	AuthMissingToken           = "missing_token"
+	AuthInvalidToken           = "invalid_token"
+	AuthInsufficientPermission = "insufficient_permission"
+	AuthInvalidSignedURL       = "invalid_signed_url"
+	AuthInvalidUploadURL       = "invalid_upload_url"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestsTotal,
+		RequestDuration,
+		UploadBytes,
+		DownloadBytes,
+		AuthFailures,
+		RateLimited,
+		InfectedUploads,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() gin.HandlerFunc {
+	handler := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	return gin.WrapH(handler)
+}
+
+// StorageStatsFunc returns the number of stored files and their total size
+type StorageStatsFunc func() (files int64, bytes int64, err error)
+
+// storageCollector exports storage totals, caching them because computing
+// them walks the whole storage
+type storageCollector struct {
+	stats    StorageStatsFunc
+	interval time.Duration
+
+	mu        sync.Mutex
+	files     int64
+	bytes     int64
+	updatedAt time.Time
+
+	filesDesc *prometheus.Desc
+	bytesDesc *prometheus.Desc
+}
+
+// RegisterStorageCollector exports storage totals computed by stats, at most
+// once per interval
+func RegisterStorageCollector(stats StorageStatsFunc, interval time.Duration) error {
+	return Registry.Register(&storageCollector{
+		stats:     stats,
+		interval:  interval,
+		filesDesc: prometheus.NewDesc(namespace+"_storage_files", "Number of stored files.", nil, nil),
+		bytesDesc: prometheus.NewDesc(namespace+"_storage_bytes", "Total size of stored files in bytes.", nil, nil),
+	})
+}
+
+// Describe implements prometheus.Collector
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.filesDesc
+	ch <- c.bytesDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.updatedAt) >= c.interval {
+		files, bytes, err := c.stats()
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.filesDesc, err)
+			ch <- prometheus.NewInvalidMetric(c.bytesDesc, err)
+			return
+		}
+		c.files, c.bytes, c.updatedAt = files, bytes, time.Now()
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.filesDesc, prometheus.GaugeValue, float64(c.files))
+	ch <- prometheus.MustNewConstMetric(c.bytesDesc, prometheus.GaugeValue, float64(c.bytes))
+}
@@ -1,17 +1,23 @@
 package middleware
 
 import (
+	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/metrics"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
 	"github.com/maarifnu/cdn-fileserver/internal/utils"
 	"github.com/maarifnu/cdn-fileserver/pkg/logger"
 	"github.com/sirupsen/logrus"
 )
 
 // TokenAuth is a middleware for token-based authentication
-func TokenAuth(cfg *config.Config, requiredPermission string) gin.HandlerFunc {
+func TokenAuth(tokens *services.TokenService, requiredPermission string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Extract token from Authorization header
 		token := extractTokenFromHeader(c)
@@ -27,18 +33,20 @@ func TokenAuth(cfg *config.Config, requiredPermission string) gin.HandlerFunc {
 				"ip":   c.ClientIP(),
 				"path": c.Request.URL.Path,
 			}).Warn("Missing authentication token")
+			metrics.AuthFailures.WithLabelValues(metrics.AuthMissingToken).Inc()
 
 			utils.UnauthorizedResponse(c, "Invalid or missing token")
 			return
 		}
 
-		// Find token in config
-		tokenConfig := cfg.FindTokenByKey(token)
+		// Find token in the token store or config
+		tokenConfig := tokens.Authenticate(token)
 		if tokenConfig == nil {
 			logger.WithFields(logrus.Fields{
 				"ip":   c.ClientIP(),
 				"path": c.Request.URL.Path,
 			}).Warn("Invalid authentication token")
+			metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidToken).Inc()
 
 			utils.UnauthorizedResponse(c, "Invalid or missing token")
 			return
@@ -52,11 +60,17 @@ func TokenAuth(cfg *config.Config, requiredPermission string) gin.HandlerFunc {
 				"token_name": tokenConfig.Name,
 				"required":   requiredPermission,
 			}).Warn("Insufficient permissions")
+			metrics.AuthFailures.WithLabelValues(metrics.AuthInsufficientPermission).Inc()
 
 			utils.ForbiddenResponse(c, "Token does not have "+requiredPermission+" permission")
 			return
 		}
 
+		// Routes addressing a tag also need the permission for that tag
+		if tag := c.Param("tag"); tag != "" && !checkTag(c, tokenConfig, requiredPermission, tag) {
+			return
+		}
+
 		// Store token info in context
 		c.Set("token", tokenConfig)
 		c.Set("token_name", tokenConfig.Name)
@@ -71,7 +85,7 @@ func TokenAuth(cfg *config.Config, requiredPermission string) gin.HandlerFunc {
 }
 
 // OptionalAuth is middleware for optional authentication (for public/private file access)
-func OptionalAuth(cfg *config.Config) gin.HandlerFunc {
+func OptionalAuth(cfg *config.Config, tokens *services.TokenService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Extract token from Authorization header
 		token := extractTokenFromHeader(c)
@@ -81,19 +95,51 @@ func OptionalAuth(cfg *config.Config) gin.HandlerFunc {
 			token = c.Query("token")
 		}
 
-		// If token provided, validate it
+		// If token provided, validate it; a bad token is an error even for
+		// public files rather than a silent fallback to anonymous access
 		if token != "" {
-			tokenConfig := cfg.FindTokenByKey(token)
-			if tokenConfig != nil {
-				// Store token info in context
-				c.Set("token", tokenConfig)
-				c.Set("token_name", tokenConfig.Name)
+			tokenConfig := tokens.Authenticate(token)
+			if tokenConfig == nil {
+				logger.WithFields(logrus.Fields{
+					"ip":   c.ClientIP(),
+					"path": c.Request.URL.Path,
+				}).Warn("Invalid authentication token")
+				metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidToken).Inc()
+
+				utils.UnauthorizedResponse(c, "Invalid or missing token")
+				return
+			}
+
+			// Store token info in context; private files need the read
+			// permission for their tag
+			canRead := tokenConfig.HasPermission("read") && tokenConfig.AllowsTag("read", c.Param("tag"))
+			c.Set("token", tokenConfig)
+			c.Set("token_name", tokenConfig.Name)
+			c.Set("authenticated", canRead)
+
+			logger.WithFields(logrus.Fields{
+				"token_name": tokenConfig.Name,
+				"path":       c.Request.URL.Path,
+				"can_read":   canRead,
+			}).Debug("Optional authentication successful")
+		} else if c.Query("sig") != "" && cfg.Security.SignedURL.Enabled() {
+			// Signed URLs grant access to the single file they were minted for
+			if err := verifySignedURL(c, cfg); err != nil {
+				logger.WithFields(logrus.Fields{
+					"ip":     c.ClientIP(),
+					"path":   c.Request.URL.Path,
+					"reason": err.Error(),
+				}).Warn("Invalid signed URL")
+				metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidSignedURL).Inc()
+				c.Set("authenticated", false)
+			} else {
 				c.Set("authenticated", true)
+				c.Set("signed_url", true)
 
 				logger.WithFields(logrus.Fields{
-					"token_name": tokenConfig.Name,
-					"path":       c.Request.URL.Path,
-				}).Debug("Optional authentication successful")
+					"ip":   c.ClientIP(),
+					"path": c.Request.URL.Path,
+				}).Debug("Signed URL authentication successful")
 			}
 		} else {
 			c.Set("authenticated", false)
@@ -103,6 +149,71 @@ func OptionalAuth(cfg *config.Config) gin.HandlerFunc {
 	}
 }
 
+// verifySignedURL validates the expires, ip and sig query parameters against
+// the requested tag and filename
+func verifySignedURL(c *gin.Context, cfg *config.Config) error {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or malformed expiry")
+	}
+
+	if time.Now().Unix() > expires {
+		return fmt.Errorf("signed url expired")
+	}
+
+	ip := c.Query("ip")
+	if ip != "" && ip != c.ClientIP() {
+		return fmt.Errorf("client ip does not match")
+	}
+
+	if !utils.VerifyFileURLSignature(cfg.Security.SignedURL.Secret, c.Param("tag"), c.Param("filename"), expires, ip, c.Query("sig")) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
+
+// RequireTag checks that the authenticated token may use a permission in a
+// tag, writing a forbidden response if not. Handlers use it for tags that are
+// not part of the route.
+func RequireTag(c *gin.Context, permission, tag string) bool {
+	token := GetTokenFromContext(c)
+	if token == nil {
+		return true
+	}
+	return checkTag(c, token, permission, tag)
+}
+
+// checkTag checks if a token may use a permission in a tag, writing a
+// forbidden response if not. Routes open to any valid token require the token
+// to cover the tag at all.
+func checkTag(c *gin.Context, token *config.TokenConfig, permission, tag string) bool {
+	allowed := token.AllowsTag(permission, tag)
+	if permission == "" {
+		allowed = token.CoversTag(tag)
+	}
+	if allowed {
+		return true
+	}
+
+	logger.WithFields(logrus.Fields{
+		"ip":         c.ClientIP(),
+		"path":       c.Request.URL.Path,
+		"token_name": token.Name,
+		"required":   permission,
+		"tag":        tag,
+	}).Warn("Tag not permitted for token")
+	metrics.AuthFailures.WithLabelValues(metrics.AuthInsufficientPermission).Inc()
+
+	utils.ForbiddenResponse(c, "Token does not have access to tag "+tag)
+	return false
+}
+
+// IsSignedURL reports whether the request was authorised by a signed URL
+func IsSignedURL(c *gin.Context) bool {
+	return c.GetBool("signed_url")
+}
+
 // extractTokenFromHeader extracts the token from the Authorization header
 func extractTokenFromHeader(c *gin.Context) string {
 	authHeader := c.GetHeader("Authorization")
@@ -119,6 +230,97 @@ func extractTokenFromHeader(c *gin.Context) string {
 	return strings.TrimSpace(parts[1])
 }
 
+// UploadAuth authenticates uploads either with a presigned upload URL or,
+// without one, like TokenAuth with the upload permission. A presigned URL
+// acts as the token that minted it, limited to the URL's tag, and stops
+// working when that token is revoked or loses access to the tag. The URL is
+// only checked here; ClaimUploadURL uses it up.
+func UploadAuth(tokens *services.TokenService, uploadURLs *services.UploadURLService) gin.HandlerFunc {
+	tokenAuth := TokenAuth(tokens, "upload")
+
+	return func(c *gin.Context) {
+		key := c.Query("upload_token")
+		if key == "" || uploadURLs == nil {
+			tokenAuth(c)
+			return
+		}
+
+		grant, err := uploadURLs.Verify(key)
+		if err != nil {
+			invalidUploadURL(c, err)
+			return
+		}
+
+		if !tokens.Permits(grant.TokenID, "upload", grant.Tag) {
+			invalidUploadURL(c, fmt.Errorf("token %s no longer permits the upload", grant.TokenID))
+			return
+		}
+
+		c.Set("token", &config.TokenConfig{
+			ID:          grant.TokenID,
+			Name:        grant.TokenName,
+			Permissions: []string{"upload"},
+			Tags:        map[string][]string{"upload": {grant.Tag}},
+		})
+		c.Set("token_name", grant.TokenName)
+		c.Set("upload_grant", grant)
+
+		logger.WithFields(logrus.Fields{
+			"token_name": grant.TokenName,
+			"grant_id":   grant.ID,
+			"path":       c.Request.URL.Path,
+		}).Debug("Upload URL authentication successful")
+
+		c.Next()
+	}
+}
+
+// ClaimUploadURL uses up the presigned upload URL of a request, and releases
+// it again when the upload fails. It runs after Idempotency, so a repeated
+// upload is answered with the stored response instead of being refused.
+func ClaimUploadURL(uploadURLs *services.UploadURLService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		grant := GetUploadGrant(c)
+		if grant == nil {
+			c.Next()
+			return
+		}
+
+		if err := uploadURLs.Claim(grant.ID); err != nil {
+			invalidUploadURL(c, err)
+			return
+		}
+
+		c.Next()
+
+		if c.Writer.Status() != http.StatusOK {
+			uploadURLs.Release(grant.ID)
+		}
+	}
+}
+
+// invalidUploadURL rejects a request with an unusable upload URL
+func invalidUploadURL(c *gin.Context, err error) {
+	logger.WithFields(logrus.Fields{
+		"ip":     c.ClientIP(),
+		"path":   c.Request.URL.Path,
+		"reason": err.Error(),
+	}).Warn("Invalid upload URL")
+	metrics.AuthFailures.WithLabelValues(metrics.AuthInvalidUploadURL).Inc()
+
+	utils.UnauthorizedResponse(c, "Invalid, expired or used upload URL")
+}
+
+// GetUploadGrant retrieves the presigned upload URL grant from context
+func GetUploadGrant(c *gin.Context) *services.UploadGrant {
+	if grant, exists := c.Get("upload_grant"); exists {
+		if uploadGrant, ok := grant.(*services.UploadGrant); ok {
+			return uploadGrant
+		}
+	}
+	return nil
+}
+
 // GetTokenFromContext retrieves token config from context
 func GetTokenFromContext(c *gin.Context) *config.TokenConfig {
 	if token, exists := c.Get("token"); exists {
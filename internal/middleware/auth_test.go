@@ -0,0 +1,326 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/database"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+)
+
+const testSignedURLSecret = "0123456789abcdef0123456789abcdef"
+
+// downloadAccess is what OptionalAuth grants a download request
+type downloadAccess struct {
+	Status        int
+	Authenticated bool
+	SignedURL     bool
+}
+
+// requestDownload sends a download request from ip through OptionalAuth
+func requestDownload(t *testing.T, cfg *config.Config, target, ip, key string) downloadAccess {
+	t.Helper()
+
+	tokens, err := services.NewTokenService(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+
+	router := gin.New()
+	router.GET("/:tag/:filename", OptionalAuth(cfg, tokens), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"authenticated": IsAuthenticated(c),
+			"signed_url":    IsSignedURL(c),
+		})
+	})
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = ip + ":40000"
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	access := downloadAccess{Status: w.Code}
+	if w.Code == http.StatusOK {
+		var body struct {
+			Authenticated bool `json:"authenticated"`
+			SignedURL     bool `json:"signed_url"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		access.Authenticated, access.SignedURL = body.Authenticated, body.SignedURL
+	}
+	return access
+}
+
+// signedTarget returns a download path signed for tag and filename
+func signedTarget(secret, tag, filename string, expires int64, ip string) url.Values {
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {utils.SignFileURL(secret, tag, filename, expires, ip)},
+	}
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	return query
+}
+
+func TestOptionalAuthSignedURL(t *testing.T) {
+	cfg := &config.Config{
+		Security: config.SecurityConfig{
+			SignedURL: config.SignedURLConfig{Secret: testSignedURLSecret},
+		},
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Second).Unix()
+
+	tests := []struct {
+		name   string
+		path   string
+		query  func() url.Values
+		ip     string
+		signed bool
+	}{
+		{
+			name:   "valid",
+			path:   "/docs/report.pdf",
+			query:  func() url.Values { return signedTarget(testSignedURLSecret, "docs", "report.pdf", future, "") },
+			ip:     "203.0.113.7",
+			signed: true,
+		},
+		{
+			name:  "expired",
+			path:  "/docs/report.pdf",
+			query: func() url.Values { return signedTarget(testSignedURLSecret, "docs", "report.pdf", past, "") },
+			ip:    "203.0.113.7",
+		},
+		{
+			name: "expiry extended",
+			path: "/docs/report.pdf",
+			query: func() url.Values {
+				query := signedTarget(testSignedURLSecret, "docs", "report.pdf", past, "")
+				query.Set("expires", strconv.FormatInt(future, 10))
+				return query
+			},
+			ip: "203.0.113.7",
+		},
+		{
+			name: "malformed expiry",
+			path: "/docs/report.pdf",
+			query: func() url.Values {
+				query := signedTarget(testSignedURLSecret, "docs", "report.pdf", future, "")
+				query.Set("expires", "tomorrow")
+				return query
+			},
+			ip: "203.0.113.7",
+		},
+		{
+			name:  "other file",
+			path:  "/docs/salaries.pdf",
+			query: func() url.Values { return signedTarget(testSignedURLSecret, "docs", "report.pdf", future, "") },
+			ip:    "203.0.113.7",
+		},
+		{
+			name:  "other tag",
+			path:  "/private/report.pdf",
+			query: func() url.Values { return signedTarget(testSignedURLSecret, "docs", "report.pdf", future, "") },
+			ip:    "203.0.113.7",
+		},
+		{
+			name: "other secret",
+			path: "/docs/report.pdf",
+			query: func() url.Values {
+				return signedTarget("another secret of thirty-two bytes", "docs", "report.pdf", future, "")
+			},
+			ip: "203.0.113.7",
+		},
+		{
+			name: "tampered signature",
+			path: "/docs/report.pdf",
+			query: func() url.Values {
+				query := signedTarget(testSignedURLSecret, "docs", "report.pdf", future, "")
+				query.Set("sig", query.Get("sig")[1:]+"A")
+				return query
+			},
+			ip: "203.0.113.7",
+		},
+		{
+			name: "bound to the client ip",
+			path: "/docs/report.pdf",
+			query: func() url.Values {
+				return signedTarget(testSignedURLSecret, "docs", "report.pdf", future, "203.0.113.7")
+			},
+			ip:     "203.0.113.7",
+			signed: true,
+		},
+		{
+			name: "bound to another ip",
+			path: "/docs/report.pdf",
+			query: func() url.Values {
+				return signedTarget(testSignedURLSecret, "docs", "report.pdf", future, "203.0.113.7")
+			},
+			ip: "198.51.100.1",
+		},
+		{
+			name: "ip binding removed",
+			path: "/docs/report.pdf",
+			query: func() url.Values {
+				query := signedTarget(testSignedURLSecret, "docs", "report.pdf", future, "203.0.113.7")
+				query.Del("ip")
+				return query
+			},
+			ip: "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := requestDownload(t, cfg, tt.path+"?"+tt.query().Encode(), tt.ip, "")
+
+			// An invalid signature falls back to anonymous access, which only
+			// serves public files
+			want := downloadAccess{Status: http.StatusOK, Authenticated: tt.signed, SignedURL: tt.signed}
+			if access != want {
+				t.Errorf("access = %+v, want %+v", access, want)
+			}
+		})
+	}
+}
+
+func TestOptionalAuthReadPermission(t *testing.T) {
+	cfg := &config.Config{
+		Tokens: []config.TokenConfig{
+			{ID: "reader", Key: "reader-key", Name: "Reader", Permissions: []string{"read"}},
+			{ID: "uploader", Key: "uploader-key", Name: "Uploader", Permissions: []string{"upload", "list"}},
+			{ID: "school", Key: "school-key", Name: "School", Permissions: []string{"read"}, Tags: map[string][]string{"read": {"school-*"}}},
+		},
+		Security: config.SecurityConfig{
+			SignedURL: config.SignedURLConfig{Secret: testSignedURLSecret},
+		},
+	}
+
+	tests := []struct {
+		name string
+		path string
+		key  string
+		want downloadAccess
+	}{
+		{name: "anonymous", path: "/docs/report.pdf", want: downloadAccess{Status: http.StatusOK}},
+		{name: "read permission", path: "/docs/report.pdf", key: "reader-key", want: downloadAccess{Status: http.StatusOK, Authenticated: true}},
+		{name: "without read permission", path: "/docs/report.pdf", key: "uploader-key", want: downloadAccess{Status: http.StatusOK}},
+		{name: "read on the tag", path: "/school-a/report.pdf", key: "school-key", want: downloadAccess{Status: http.StatusOK, Authenticated: true}},
+		{name: "read on another tag", path: "/docs/report.pdf", key: "school-key", want: downloadAccess{Status: http.StatusOK}},
+		{name: "invalid token", path: "/docs/report.pdf", key: "guess", want: downloadAccess{Status: http.StatusUnauthorized}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if access := requestDownload(t, cfg, tt.path, "203.0.113.7", tt.key); access != tt.want {
+				t.Errorf("access = %+v, want %+v", access, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadURLAuth(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{MaxFileSize: 1024, AllowedExtensions: []string{"txt"}},
+		Security: config.SecurityConfig{
+			UploadURL: config.UploadURLConfig{Enabled: true, DefaultTTL: 15 * time.Minute, MaxTTL: time.Hour},
+		},
+	}
+	db, err := database.Open(filepath.Join(t.TempDir(), "cdn.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	tokens, err := services.NewTokenService(cfg, db, nil)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+	uploadURLs, err := services.NewUploadURLService(cfg, db)
+	if err != nil {
+		t.Fatalf("NewUploadURLService: %v", err)
+	}
+
+	issued, err := tokens.Create(&services.TokenCreateRequest{
+		Name:        "School A",
+		Permissions: []string{"upload"},
+		Tags:        map[string][]string{"upload": {"school-a"}},
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	token := tokens.Authenticate(issued.Key)
+
+	// mint returns the upload_token of a new upload URL for tag
+	mint := func(tag string) string {
+		minted, err := uploadURLs.Create(&services.UploadURLRequest{Tag: tag, Token: token})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		parsed, _ := url.Parse(minted.URL)
+		return parsed.Query().Get("upload_token")
+	}
+
+	router := gin.New()
+	router.POST("/upload", UploadAuth(tokens, uploadURLs), ClaimUploadURL(uploadURLs), func(c *gin.Context) {
+		if c.Query("fail") != "" {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	upload := func(key string, fail bool) int {
+		query := url.Values{"upload_token": {key}}
+		if fail {
+			query.Set("fail", "1")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload?"+query.Encode(), nil))
+		return w.Code
+	}
+
+	key := mint("school-a")
+	tests := []struct {
+		name   string
+		key    string
+		fail   bool
+		status int
+	}{
+		{name: "failed upload", key: key, fail: true, status: http.StatusBadRequest},
+		{name: "retry after a failed upload", key: key, status: http.StatusOK},
+		{name: "reuse after success", key: key, status: http.StatusUnauthorized},
+		{name: "wrong secret", key: strings.SplitN(key, ".", 2)[0] + ".wrong", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if status := upload(tt.key, tt.fail); status != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.status)
+		}
+	}
+
+	// A URL stops working when the token that minted it is revoked
+	key = mint("school-a")
+	if _, err := tokens.Revoke(issued.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if status := upload(key, false); status != http.StatusUnauthorized {
+		t.Errorf("after revoke: status = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
@@ -18,6 +18,7 @@ func CORSMiddleware(cfg *config.Config) gin.HandlerFunc {
 		AllowOrigins:     cfg.CORS.AllowedOrigins,
 		AllowMethods:     cfg.CORS.AllowedMethods,
 		AllowHeaders:     cfg.CORS.AllowedHeaders,
+		ExposeHeaders:    cfg.CORS.ExposedHeaders,
 		AllowCredentials: cfg.CORS.AllowCredentials,
 		MaxAge:           86400, // 24 hours
 	}
@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// maxIdempotencyKeyLength limits the length of an Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// Idempotency replays the stored response of a successful request when it is
+// repeated with the same Idempotency-Key header. Keys are scoped to the
+// token, or to the presigned upload URL, and a key reused for a different
+// request is rejected. It runs after authentication.
+func Idempotency(idempotency *services.IdempotencyService) gin.HandlerFunc {
+	if idempotency == nil {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid Idempotency-Key header: at most 255 characters")
+			c.Abort()
+			return
+		}
+
+		scope := "ip:" + c.ClientIP() + ":" + key
+		if grant := GetUploadGrant(c); grant != nil {
+			scope = "upload_url:" + grant.ID + ":" + key
+		} else if token := GetTokenFromContext(c); token != nil {
+			scope = "token:" + token.ID + ":" + key
+		}
+
+		if !idempotency.Lock(scope) {
+			utils.ErrorResponse(c, http.StatusConflict, "Conflict", "A request with this Idempotency-Key is in progress")
+			c.Abort()
+			return
+		}
+		defer idempotency.Unlock(scope)
+
+		stored, err := idempotency.Get(scope)
+		if err != nil {
+			logger.WithField("error", err).Error("Failed to load idempotency key")
+			utils.InternalServerErrorResponse(c, "Failed to process request")
+			c.Abort()
+			return
+		}
+
+		body := newFingerprintReader(c.Request)
+		c.Request.Body = body
+
+		// A repeated request is read to compare its fingerprint, but not
+		// processed again
+		if stored != nil {
+			if _, err := io.Copy(io.Discard, body); err != nil {
+				utils.ErrorResponse(c, http.StatusBadRequest, "Validation error", "invalid request body: "+err.Error())
+				c.Abort()
+				return
+			}
+
+			if body.Fingerprint() != stored.Fingerprint {
+				utils.ErrorResponse(c, http.StatusUnprocessableEntity, "Validation error",
+					"Idempotency-Key was already used for a different request")
+				c.Abort()
+				return
+			}
+
+			logger.WithFields(logrus.Fields{
+				"path":            c.Request.URL.Path,
+				"idempotency_key": key,
+			}).Info("Replaying idempotent response")
+
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(stored.Status, stored.ContentType, stored.Body)
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// Only successful responses are kept; failed requests may be retried
+		status := c.Writer.Status()
+		if status < 200 || status >= 300 {
+			return
+		}
+
+		// Handlers may stop reading before the end of a form
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			logger.WithField("error", err).Warn("Failed to read request body for idempotency key")
+			return
+		}
+
+		err = idempotency.Save(scope, &services.IdempotentResponse{
+			Fingerprint: body.Fingerprint(),
+			Status:      status,
+			ContentType: c.Writer.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		})
+		if err != nil {
+			logger.WithField("error", err).Error("Failed to save idempotency key")
+		}
+	}
+}
+
+// responseRecorder keeps a copy of the response body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// Write writes the response and keeps a copy
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString writes the response and keeps a copy
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// fingerprintReader hashes a request body as it is read. The fingerprint
+// covers the method, the URL and the body; multipart boundaries are left out
+// because clients pick a new one when they rebuild a form for a retry.
+type fingerprintReader struct {
+	io.ReadCloser
+	hash      hash.Hash
+	delimiter []byte
+	pending   []byte
+}
+
+// newFingerprintReader wraps the body of a request
+func newFingerprintReader(r *http.Request) *fingerprintReader {
+	f := &fingerprintReader{
+		ReadCloser: r.Body,
+		hash:       sha256.New(),
+	}
+
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && params["boundary"] != "" {
+		f.delimiter = []byte("--" + params["boundary"])
+	}
+
+	f.hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	return f
+}
+
+// Read reads from the body and hashes the bytes
+func (f *fingerprintReader) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	f.write(p[:n])
+	return n, err
+}
+
+// write hashes body bytes, leaving out boundary delimiters. A tail that may
+// be the start of a delimiter is held back until more bytes arrive.
+func (f *fingerprintReader) write(data []byte) {
+	if f.delimiter == nil {
+		f.hash.Write(data)
+		return
+	}
+
+	f.pending = append(f.pending, data...)
+	for {
+		i := bytes.Index(f.pending, f.delimiter)
+		if i < 0 {
+			break
+		}
+		f.hash.Write(f.pending[:i])
+		f.pending = f.pending[i+len(f.delimiter):]
+	}
+
+	if keep := len(f.delimiter) - 1; len(f.pending) > keep {
+		f.hash.Write(f.pending[:len(f.pending)-keep])
+		f.pending = append(f.pending[:0], f.pending[len(f.pending)-keep:]...)
+	}
+}
+
+// Fingerprint returns the hex SHA-256 of the request once the body was
+// read to the end
+func (f *fingerprintReader) Fingerprint() string {
+	f.hash.Write(f.pending)
+	f.pending = nil
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
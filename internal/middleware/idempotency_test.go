@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/database"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+)
+
+// multipartBody encodes a form with one file, using a new boundary each time
+func multipartBody(t *testing.T, content string) (string, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write([]byte(content))
+	writer.WriteField("tag", "docs")
+	writer.Close()
+	return buf.String(), writer.FormDataContentType()
+}
+
+func TestIdempotency(t *testing.T) {
+	cfg := &config.Config{Idempotency: config.IdempotencyConfig{Enabled: true, TTL: time.Hour}}
+	db, err := database.Open(filepath.Join(t.TempDir(), "cdn.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	idempotency, err := services.NewIdempotencyService(cfg, db)
+	if err != nil {
+		t.Fatalf("NewIdempotencyService: %v", err)
+	}
+
+	// The handler answers with the number of requests it processed
+	processed := 0
+	router := gin.New()
+	router.POST("/:path", func(c *gin.Context) {
+		if id := c.GetHeader("X-Token"); id != "" {
+			c.Set("token", &config.TokenConfig{ID: id})
+		}
+	}, Idempotency(idempotency), func(c *gin.Context) {
+		processed++
+		if c.Query("fail") != "" {
+			c.String(http.StatusBadRequest, "failed")
+			return
+		}
+		c.String(http.StatusOK, strconv.Itoa(processed))
+	})
+
+	form, formType := multipartBody(t, "hello")
+	rebuilt, rebuiltType := multipartBody(t, "hello")
+	changed, changedType := multipartBody(t, "hello!")
+	if formType == rebuiltType {
+		t.Fatal("forms share a boundary")
+	}
+
+	// An in-progress request holds its key
+	if !idempotency.Lock("ip:10.0.0.1:busy") {
+		t.Fatal("Lock failed")
+	}
+	defer idempotency.Unlock("ip:10.0.0.1:busy")
+
+	tests := []struct {
+		name        string
+		target      string
+		key         string
+		token       string
+		body        string
+		contentType string
+		status      int
+		response    string
+		replayed    bool
+	}{
+		{name: "first request", target: "/upload", key: "k1", body: "a", status: http.StatusOK, response: "1"},
+		{name: "repeated request", target: "/upload", key: "k1", body: "a", status: http.StatusOK, response: "1", replayed: true},
+		{name: "different body", target: "/upload", key: "k1", body: "b", status: http.StatusUnprocessableEntity},
+		{name: "different query", target: "/upload?public=true", key: "k1", body: "a", status: http.StatusUnprocessableEntity},
+		{name: "different path", target: "/other", key: "k1", body: "a", status: http.StatusUnprocessableEntity},
+		{name: "same key of a token", target: "/upload", key: "k1", token: "school", body: "a", status: http.StatusOK, response: "2"},
+		{name: "without key", target: "/upload", body: "a", status: http.StatusOK, response: "3"},
+		{name: "without key again", target: "/upload", body: "a", status: http.StatusOK, response: "4"},
+		{name: "failed request", target: "/upload?fail=1", key: "k2", body: "a", status: http.StatusBadRequest},
+		{name: "retry of a failed request", target: "/upload?fail=1", key: "k2", body: "a", status: http.StatusBadRequest},
+		{name: "form", target: "/upload", key: "k3", body: form, contentType: formType, status: http.StatusOK, response: "7"},
+		{name: "form rebuilt with a new boundary", target: "/upload", key: "k3", body: rebuilt, contentType: rebuiltType, status: http.StatusOK, response: "7", replayed: true},
+		{name: "form with other content", target: "/upload", key: "k3", body: changed, contentType: changedType, status: http.StatusUnprocessableEntity},
+		{name: "in progress", target: "/upload", key: "busy", body: "a", status: http.StatusConflict},
+		{name: "key too long", target: "/upload", key: strings.Repeat("k", 256), body: "a", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+		req.RemoteAddr = "10.0.0.1:40000"
+		if tt.key != "" {
+			req.Header.Set("Idempotency-Key", tt.key)
+		}
+		if tt.token != "" {
+			req.Header.Set("X-Token", tt.token)
+		}
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if tt.response != "" && w.Body.String() != tt.response {
+			t.Errorf("%s: response = %q, want %q", tt.name, w.Body.String(), tt.response)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+			t.Errorf("%s: replayed = %v, want %v", tt.name, replayed, tt.replayed)
+		}
+	}
+}
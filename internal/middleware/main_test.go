@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Initialize(logger.Config{Level: "error", Output: "console"}); err != nil {
+		panic(err)
+	}
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
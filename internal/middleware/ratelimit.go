@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/metrics"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// IPRateLimit limits all requests per client IP, before authentication
+func IPRateLimit(limits *services.RateLimitService, cfg *config.Config) gin.HandlerFunc {
+	rule := cfg.RateLimit.IP
+	if limits == nil || !rule.Limited() {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	return func(c *gin.Context) {
+		result := limits.Allow("ip:"+c.ClientIP(), rule)
+		if !result.Allowed {
+			rejectRateLimited(c, "ip", result.Reset)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RateLimit limits the requests of a route group per token, or per client IP
+// for anonymous requests, and the bytes they transfer. It runs after
+// authentication so tokens get their own limits.
+func RateLimit(limits *services.RateLimitService, cfg *config.Config, group string) gin.HandlerFunc {
+	if limits == nil {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	return func(c *gin.Context) {
+		client := "ip:" + c.ClientIP()
+		var overrides config.TokenRateLimit
+		if token := GetTokenFromContext(c); token != nil {
+			client = "token:" + token.ID
+			overrides = token.RateLimit
+		}
+
+		// Requests
+		rule := cfg.RateLimit.Groups[group]
+		if overrides.Requests.Limited() {
+			rule = overrides.Requests
+		}
+		if rule.Limited() {
+			result := limits.Allow(group+":"+client, rule)
+			c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+			c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			if !result.Allowed {
+				rejectRateLimited(c, group, result.Reset)
+				return
+			}
+		}
+
+		// Bytes, charged after the transfer
+		var name string
+		switch group {
+		case config.RateLimitGroupUpload:
+			name, rule = "upload_bytes", cfg.RateLimit.UploadBytes
+			if overrides.UploadBytes.Limited() {
+				rule = overrides.UploadBytes
+			}
+		case config.RateLimitGroupDownload:
+			name, rule = "download_bytes", cfg.RateLimit.DownloadBytes
+			if overrides.DownloadBytes.Limited() {
+				rule = overrides.DownloadBytes
+			}
+		default:
+			c.Next()
+			return
+		}
+		if !rule.Limited() {
+			c.Next()
+			return
+		}
+
+		key := name + ":" + client
+		if exhausted, wait := limits.Exhausted(key, rule); exhausted {
+			rejectRateLimited(c, name, wait)
+			return
+		}
+
+		if group == config.RateLimitGroupUpload {
+			body := &countingReader{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+			c.Next()
+			limits.Consume(key, rule, body.n)
+		} else {
+			c.Next()
+			limits.Consume(key, rule, int64(max(c.Writer.Size(), 0)))
+		}
+	}
+}
+
+// rejectRateLimited writes a rate limit response
+func rejectRateLimited(c *gin.Context, limit string, wait time.Duration) {
+	seconds := ceilSeconds(wait)
+
+	logger.WithFields(logrus.Fields{
+		"ip":          c.ClientIP(),
+		"path":        c.Request.URL.Path,
+		"limit":       limit,
+		"retry_after": seconds,
+	}).Warn("Rate limit exceeded")
+	metrics.RateLimited.WithLabelValues(limit).Inc()
+
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	utils.TooManyRequestsResponse(c, fmt.Sprintf("Rate limit exceeded, retry after %ds", seconds))
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return max(int(math.Ceil(d.Seconds())), 0)
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read reads from the body and counts the bytes
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/services"
+)
+
+// rateLimitRouter returns a router limiting /:group routes, taking the token
+// named in the X-Token header as authenticated
+func rateLimitRouter(cfg *config.Config, tokens map[string]*config.TokenConfig) *gin.Engine {
+	limits := services.NewRateLimitService(cfg)
+
+	router := gin.New()
+	router.Use(IPRateLimit(limits, cfg))
+	for _, group := range []string{config.RateLimitGroupAPI, config.RateLimitGroupUpload} {
+		router.POST("/"+group, func(c *gin.Context) {
+			if token, ok := tokens[c.GetHeader("X-Token")]; ok {
+				c.Set("token", token)
+			}
+		}, RateLimit(limits, cfg, group), func(c *gin.Context) {
+			io.Copy(io.Discard, c.Request.Body)
+			c.Status(http.StatusOK)
+		})
+	}
+	return router
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			Enabled: true,
+			IP:      config.RateLimitRule{Rate: 0.001, Burst: 100},
+			Groups: map[string]config.RateLimitRule{
+				config.RateLimitGroupAPI: {Rate: 0.001, Burst: 2},
+			},
+			UploadBytes: config.RateLimitRule{Rate: 1, Burst: 10},
+		},
+	}
+	tokens := map[string]*config.TokenConfig{
+		"school": {ID: "school"},
+		"limited": {ID: "limited", RateLimit: config.TokenRateLimit{
+			Requests: config.RateLimitRule{Rate: 0.001, Burst: 1},
+		}},
+	}
+	router := rateLimitRouter(cfg, tokens)
+
+	tests := []struct {
+		name      string
+		path      string
+		ip        string
+		token     string
+		body      string
+		status    int
+		remaining string
+	}{
+		{name: "first anonymous", path: "/api", ip: "10.0.0.1", status: http.StatusOK, remaining: "1"},
+		{name: "second anonymous", path: "/api", ip: "10.0.0.1", status: http.StatusOK, remaining: "0"},
+		{name: "anonymous over the limit", path: "/api", ip: "10.0.0.1", status: http.StatusTooManyRequests, remaining: "0"},
+		{name: "other client IP", path: "/api", ip: "10.0.0.2", status: http.StatusOK, remaining: "1"},
+		{name: "token from a limited IP", path: "/api", ip: "10.0.0.1", token: "school", status: http.StatusOK, remaining: "1"},
+		{name: "token override", path: "/api", ip: "10.0.0.3", token: "limited", status: http.StatusOK, remaining: "0"},
+		{name: "token override over the limit", path: "/api", ip: "10.0.0.4", token: "limited", status: http.StatusTooManyRequests, remaining: "0"},
+		{name: "upload within the byte budget", path: "/upload", ip: "10.0.0.1", body: strings.Repeat("x", 25), status: http.StatusOK},
+		{name: "upload after the budget went into debt", path: "/upload", ip: "10.0.0.1", body: "x", status: http.StatusTooManyRequests},
+		{name: "upload by another client", path: "/upload", ip: "10.0.0.2", body: "x", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+		req.RemoteAddr = tt.ip + ":40000"
+		if tt.token != "" {
+			req.Header.Set("X-Token", tt.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if tt.remaining != "" && w.Header().Get("RateLimit-Remaining") != tt.remaining {
+			t.Errorf("%s: RateLimit-Remaining = %q, want %q", tt.name, w.Header().Get("RateLimit-Remaining"), tt.remaining)
+		}
+		if tt.status == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", tt.name)
+		}
+	}
+}
+
+func TestIPRateLimit(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: config.RateLimitConfig{
+			Enabled: true,
+			IP:      config.RateLimitRule{Rate: 0.001, Burst: 1},
+		},
+	}
+	router := rateLimitRouter(cfg, nil)
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodPost, "/api", nil)
+		req.RemoteAddr = "10.0.0.1:40000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i, w.Code, want)
+		}
+	}
+}
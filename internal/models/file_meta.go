@@ -3,104 +3,125 @@ package models
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
 	"time"
 )
 
-// FileMeta represents file metadata
-type FileMeta struct {
-	FileID       string    `json:"file_id"`
-	OriginalName string    `json:"original_name"`
-	Tag          string    `json:"tag"`
-	Size         int64     `json:"size"`
-	ContentType  string    `json:"content_type"`
-	Public       bool      `json:"public"`
-	UploadedAt   time.Time `json:"uploaded_at"`
-	UploadedBy   string    `json:"uploaded_by"`
-}
+// MetaSuffix is appended to a file ID to form the key of its metadata sidecar
+const MetaSuffix = ".meta.json"
 
-// Save saves metadata to a JSON file
-func (fm *FileMeta) Save(storagePath string) error {
-	metaPath := fm.GetMetaPath(storagePath)
+// BlobPrefix is the key prefix of the shared content store
+const BlobPrefix = ".blobs/"
 
-	// Ensure directory exists
-	metaDir := filepath.Dir(metaPath)
-	if err := os.MkdirAll(metaDir, 0755); err != nil {
-		return fmt.Errorf("failed to create metadata directory: %w", err)
-	}
+// TrashPrefix is the key prefix of deleted files awaiting purge
+const TrashPrefix = ".trash/"
 
-	// Marshal to JSON
-	data, err := json.MarshalIndent(fm, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %w", err)
-	}
+// VersionPrefix is the key prefix of the prior versions of replaced files
+const VersionPrefix = ".versions/"
 
-	// Write to file
-	if err := os.WriteFile(metaPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write metadata file: %w", err)
-	}
+// QuarantinePrefix is the key prefix of infected uploads kept for review
+const QuarantinePrefix = ".quarantine/"
 
-	return nil
+// Antivirus scan statuses
+const (
+	ScanClean     = "clean"
+	ScanInfected  = "infected"
+	ScanUnscanned = "unscanned"
+)
+
+// ScanResult records the antivirus scan of a file
+type ScanResult struct {
+	Status    string    `json:"status"`
+	Signature string    `json:"signature,omitempty"`
+	Engine    string    `json:"engine,omitempty"`
+	ScannedAt time.Time `json:"scanned_at"`
 }
 
-// Load loads metadata from a JSON file
-func (fm *FileMeta) Load(storagePath string) error {
-	metaPath := fm.GetMetaPath(storagePath)
+// FileMeta represents file metadata
+type FileMeta struct {
+	FileID       string      `json:"file_id"`
+	OriginalName string      `json:"original_name"`
+	Tag          string      `json:"tag"`
+	Size         int64       `json:"size"`
+	ContentType  string      `json:"content_type"`
+	Public       bool        `json:"public"`
+	UploadedAt   time.Time   `json:"uploaded_at"`
+	UploadedBy   string      `json:"uploaded_by"`
+	Digest       string      `json:"digest,omitempty"`
+	Version      int         `json:"version"`
+	DeletedAt    *time.Time  `json:"deleted_at,omitempty"`
+	DeletedBy    string      `json:"deleted_by,omitempty"`
+	Scan         *ScanResult `json:"scan,omitempty"`
+}
 
-	// Read file
-	data, err := os.ReadFile(metaPath)
+// Marshal encodes metadata as indented JSON
+func (fm *FileMeta) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(fm, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to read metadata file: %w", err)
-	}
-
-	// Unmarshal JSON
-	if err := json.Unmarshal(data, fm); err != nil {
-		return fmt.Errorf("failed to unmarshal metadata: %w", err)
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
 	}
-
-	return nil
+	return data, nil
 }
 
-// Delete deletes the metadata file
-func (fm *FileMeta) Delete(storagePath string) error {
-	metaPath := fm.GetMetaPath(storagePath)
+// FileKey returns the storage key of the actual file
+func (fm *FileMeta) FileKey() string {
+	return fm.Tag + "/" + fm.FileID
+}
 
-	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to delete metadata file: %w", err)
+// ContentKey returns the storage key holding the file content: the shared blob
+// for deduplicated files, the file itself for files stored before deduplication
+func (fm *FileMeta) ContentKey() string {
+	if fm.Digest != "" {
+		return BlobKey(fm.Digest)
 	}
-
-	return nil
+	if fm.Trashed() {
+		return TrashPrefix + fm.FileKey()
+	}
+	return fm.FileKey()
 }
 
-// Exists checks if metadata file exists
-func (fm *FileMeta) Exists(storagePath string) bool {
-	metaPath := fm.GetMetaPath(storagePath)
-	_, err := os.Stat(metaPath)
-	return err == nil
+// RefKey returns the reference a version of the file holds on its blob
+func (fm *FileMeta) RefKey() string {
+	if fm.Version > 1 {
+		return fmt.Sprintf("%s@v%d", fm.FileKey(), fm.Version)
+	}
+	return fm.FileKey()
 }
 
-// GetMetaPath returns the path to the metadata file
-func (fm *FileMeta) GetMetaPath(storagePath string) string {
-	return filepath.Join(storagePath, fm.Tag, fm.FileID+".meta.json")
+// MetaKey returns the storage key of the metadata file, which lives in the
+// trash once the file was deleted
+func (fm *FileMeta) MetaKey() string {
+	if fm.Trashed() {
+		return TrashPrefix + fm.FileKey() + MetaSuffix
+	}
+	return fm.FileKey() + MetaSuffix
 }
 
-// GetFilePath returns the path to the actual file
-func (fm *FileMeta) GetFilePath(storagePath string) string {
-	return filepath.Join(storagePath, fm.Tag, fm.FileID)
+// Trashed reports whether the file was deleted and awaits purge
+func (fm *FileMeta) Trashed() bool {
+	return fm.DeletedAt != nil
 }
 
-// LoadFromFile loads metadata from a specific file path
-func LoadFromFile(metaPath string) (*FileMeta, error) {
-	data, err := os.ReadFile(metaPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read metadata file: %w", err)
-	}
-
+// ParseFileMeta decodes metadata from JSON
+func ParseFileMeta(data []byte) (*FileMeta, error) {
 	var meta FileMeta
 	if err := json.Unmarshal(data, &meta); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
 	}
 
+	// Files stored before versioning are their own first version
+	if meta.Version < 1 {
+		meta.Version = 1
+	}
+
 	return &meta, nil
 }
+
+// VersionMetaKey returns the storage key of the metadata of a prior version
+func VersionMetaKey(tag, fileID string, version int) string {
+	return fmt.Sprintf("%s%s/%s/%d%s", VersionPrefix, tag, fileID, version, MetaSuffix)
+}
+
+// BlobKey returns the storage key of the blob with the given hex SHA-256 digest
+func BlobKey(digest string) string {
+	return BlobPrefix + digest[:2] + "/" + digest
+}
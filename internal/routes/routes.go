@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/maarifnu/cdn-fileserver/internal/config"
 	"github.com/maarifnu/cdn-fileserver/internal/handlers"
+	"github.com/maarifnu/cdn-fileserver/internal/metrics"
 	"github.com/maarifnu/cdn-fileserver/internal/middleware"
 	"github.com/maarifnu/cdn-fileserver/internal/services"
 )
@@ -13,19 +14,40 @@ func SetupRoutes(
 	router *gin.Engine,
 	cfg *config.Config,
 	storageService *services.StorageService,
+	tokenService *services.TokenService,
 	fileService *services.FileService,
+	tusService *services.TusService,
+	imageService *services.ImageService,
+	webhookService *services.WebhookService,
+	scrubService *services.ScrubService,
+	rateLimitService *services.RateLimitService,
+	uploadURLService *services.UploadURLService,
+	idempotencyService *services.IdempotencyService,
 ) {
 	// Create handlers
 	uploadHandler := handlers.NewUploadHandler(fileService)
-	downloadHandler := handlers.NewDownloadHandler(fileService)
+	downloadHandler := handlers.NewDownloadHandler(fileService, imageService, cfg)
 	listHandler := handlers.NewListHandler(fileService, cfg)
 	deleteHandler := handlers.NewDeleteHandler(fileService)
-	healthHandler := handlers.NewHealthHandler(cfg, storageService)
+	healthHandler := handlers.NewHealthHandler(cfg, storageService, scrubService)
+
+	// Rate limits per route group, applied once the caller is authenticated
+	uploadLimit := middleware.RateLimit(rateLimitService, cfg, config.RateLimitGroupUpload)
+	downloadLimit := middleware.RateLimit(rateLimitService, cfg, config.RateLimitGroupDownload)
+	apiLimit := middleware.RateLimit(rateLimitService, cfg, config.RateLimitGroupAPI)
+
+	// Replays responses of upload and delete requests repeated with the same
+	// Idempotency-Key
+	idempotent := middleware.Idempotency(idempotencyService)
 
 	// Apply global middleware
 	router.Use(middleware.RecoveryMiddleware())
 	router.Use(middleware.LoggerMiddleware())
+	if cfg.Metrics.Enabled {
+		router.Use(middleware.MetricsMiddleware())
+	}
 	router.Use(middleware.CORSMiddleware(cfg))
+	router.Use(middleware.IPRateLimit(rateLimitService, cfg))
 
 	// Security headers middleware
 	router.Use(func(c *gin.Context) {
@@ -38,8 +60,17 @@ func SetupRoutes(
 	// Public routes
 	router.GET("/health", healthHandler.Handle)
 
+	// Prometheus metrics, optionally restricted to tokens with a permission
+	if cfg.Metrics.Enabled {
+		if cfg.Metrics.Permission != "" {
+			router.GET(cfg.Metrics.Path, middleware.TokenAuth(tokenService, cfg.Metrics.Permission), metrics.Handler())
+		} else {
+			router.GET(cfg.Metrics.Path, metrics.Handler())
+		}
+	}
+
 	// File download/view route with optional authentication
-	router.GET("/:tag/:filename", middleware.OptionalAuth(cfg), downloadHandler.Handle)
+	router.GET("/:tag/:filename", middleware.OptionalAuth(cfg, tokenService), downloadLimit, downloadHandler.Handle)
 
 	// API group - requires authentication
 	api := router.Group("/api")
@@ -48,13 +79,86 @@ func SetupRoutes(
 		files := api.Group("/files")
 		{
 			// List files - requires list permission
-			files.GET("", middleware.TokenAuth(cfg, "list"), listHandler.Handle)
+			files.GET("", middleware.TokenAuth(tokenService, "list"), apiLimit, listHandler.Handle)
 
 			// Delete file - requires delete permission
-			files.DELETE("/:tag/:filename", middleware.TokenAuth(cfg, "delete"), deleteHandler.Handle)
+			files.DELETE("/:tag/:filename", middleware.TokenAuth(tokenService, "delete"), apiLimit, idempotent, deleteHandler.Handle)
+
+			// Replace in place and version history
+			if cfg.Storage.Versioning.Enabled {
+				versionHandler := handlers.NewVersionHandler(fileService)
+				files.PUT("/:tag/:filename", middleware.TokenAuth(tokenService, "upload"), uploadLimit, idempotent, versionHandler.Replace)
+				files.GET("/:tag/:filename/versions", middleware.TokenAuth(tokenService, "list"), apiLimit, versionHandler.List)
+				files.POST("/:tag/:filename/versions/:version/restore", middleware.TokenAuth(tokenService, "upload"), apiLimit, versionHandler.Rollback)
+			}
+
+			// Mint signed download URL - requires read permission
+			if cfg.Security.SignedURL.Enabled() {
+				signHandler := handlers.NewSignHandler(fileService)
+				files.POST("/:tag/:filename/sign", middleware.TokenAuth(tokenService, "read"), apiLimit, signHandler.Handle)
+			}
+		}
+
+		// Trash - requires delete permission
+		if cfg.Storage.Trash.Enabled {
+			trashHandler := handlers.NewTrashHandler(fileService)
+
+			trash := api.Group("/trash")
+			{
+				trash.GET("", middleware.TokenAuth(tokenService, "delete"), apiLimit, trashHandler.List)
+				trash.POST("/:tag/:filename/restore", middleware.TokenAuth(tokenService, "delete"), apiLimit, trashHandler.Restore)
+				trash.DELETE("/:tag/:filename", middleware.TokenAuth(tokenService, "delete"), apiLimit, idempotent, trashHandler.Purge)
+			}
+		}
+
+		// Token management - requires admin permission
+		if tokenService.Managed() {
+			tokenHandler := handlers.NewTokenHandler(tokenService)
+
+			tokens := api.Group("/tokens")
+			{
+				tokens.GET("", middleware.TokenAuth(tokenService, "admin"), apiLimit, tokenHandler.List)
+				tokens.POST("", middleware.TokenAuth(tokenService, "admin"), apiLimit, tokenHandler.Create)
+				tokens.POST("/:id/rotate", middleware.TokenAuth(tokenService, "admin"), apiLimit, tokenHandler.Rotate)
+				tokens.POST("/:id/expire", middleware.TokenAuth(tokenService, "admin"), apiLimit, tokenHandler.Expire)
+				tokens.DELETE("/:id", middleware.TokenAuth(tokenService, "admin"), apiLimit, tokenHandler.Revoke)
+			}
+		}
+
+		// Mint presigned upload URL - requires upload permission
+		if uploadURLService != nil {
+			uploadURLHandler := handlers.NewUploadURLHandler(uploadURLService)
+			api.POST("/upload-urls", middleware.TokenAuth(tokenService, "upload"), apiLimit, uploadURLHandler.Create)
+		}
+
+		// Webhook delivery log - requires admin permission
+		if webhookService != nil {
+			webhookHandler := handlers.NewWebhookHandler(webhookService)
+			api.GET("/webhooks/deliveries", middleware.TokenAuth(tokenService, "admin"), apiLimit, webhookHandler.Deliveries)
+		}
+
+		// Resumable uploads (tus protocol) - requires upload permission
+		if tusService != nil {
+			tusHandler := handlers.NewTusHandler(tusService, cfg)
+
+			uploads := api.Group("/uploads")
+			{
+				uploads.OPTIONS("", tusHandler.Options)
+				uploads.OPTIONS("/:tag/:id", tusHandler.Options)
+				uploads.POST("", middleware.TokenAuth(tokenService, "upload"), uploadLimit, tusHandler.Create)
+				uploads.HEAD("/:tag/:id", middleware.TokenAuth(tokenService, "upload"), uploadLimit, tusHandler.Head)
+				uploads.PATCH("/:tag/:id", middleware.TokenAuth(tokenService, "upload"), uploadLimit, tusHandler.Patch)
+				uploads.DELETE("/:tag/:id", middleware.TokenAuth(tokenService, "upload"), uploadLimit, tusHandler.Delete)
+			}
 		}
 	}
 
-	// Upload route - requires upload permission
-	router.POST("/upload", middleware.TokenAuth(cfg, "upload"), uploadHandler.Handle)
+	// Upload route - requires upload permission or a presigned upload URL
+	router.POST("/upload", middleware.UploadAuth(tokenService, uploadURLService), uploadLimit, idempotent, middleware.ClaimUploadURL(uploadURLService), uploadHandler.Handle)
+
+	// Raw upload streaming the request body - requires upload permission
+	router.PUT("/upload/:tag/:name", middleware.TokenAuth(tokenService, "upload"), uploadLimit, idempotent, uploadHandler.Stream)
+
+	// Batch upload - requires upload permission
+	router.POST("/upload/batch", middleware.TokenAuth(tokenService, "upload"), uploadLimit, idempotent, uploadHandler.Batch)
 }
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+)
+
+// ErrObjectNotFound is returned by a Backend when the requested key does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes an object held by a storage backend
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// WalkFunc is called for every object visited by Backend.Walk
+type WalkFunc func(info ObjectInfo) error
+
+// Backend is a storage driver. Keys are slash-separated paths relative to the
+// storage root, e.g. "images/photo_a1b2c3d4.jpg".
+type Backend interface {
+	// Name returns the driver name as used in the configuration
+	Name() string
+
+	// Put stores the content of r under key, replacing any existing object
+	Put(key string, r io.Reader) (int64, error)
+
+	// Get opens the object stored under key
+	Get(key string) (io.ReadCloser, *ObjectInfo, error)
+
+	// Stat returns information about the object stored under key
+	Stat(key string) (*ObjectInfo, error)
+
+	// Delete removes the object stored under key; a missing object is not an error
+	Delete(key string) error
+
+	// Rename moves the object stored under src to dst, replacing any existing object
+	Rename(src, dst string) error
+
+	// List returns the objects directly under a directory prefix such as "images/"
+	List(prefix string) ([]ObjectInfo, error)
+
+	// Walk visits every object whose key starts with prefix
+	Walk(prefix string, fn WalkFunc) error
+}
+
+// NewBackend creates the storage backend selected by storage.driver
+func NewBackend(cfg *config.Config) (Backend, error) {
+	switch cfg.Storage.Driver {
+	case "", config.StorageDriverLocal:
+		return NewLocalBackend(cfg.Storage.BasePath), nil
+	case config.StorageDriverS3:
+		backend, err := NewS3Backend(cfg.Storage.S3)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage driver: %s", cfg.Storage.Driver)
+	}
+}
+
+// validateKey rejects keys that could escape the storage root
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid object key: %q", key)
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return fmt.Errorf("invalid object key: %q", key)
+		}
+	}
+
+	return nil
+}
+
+// isInternalKey reports whether a key belongs to server-managed data rather than
+// a user file (any path segment starting with a dot, e.g. ".gitkeep")
+func isInternalKey(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
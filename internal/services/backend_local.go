@@ -0,0 +1,236 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+)
+
+// LocalBackend stores objects as files below a base directory
+type LocalBackend struct {
+	basePath string
+}
+
+// NewLocalBackend creates a new local disk backend
+func NewLocalBackend(basePath string) *LocalBackend {
+	return &LocalBackend{
+		basePath: basePath,
+	}
+}
+
+// Name returns the driver name
+func (b *LocalBackend) Name() string {
+	return config.StorageDriverLocal
+}
+
+// Put writes the content of r to the file for key
+func (b *LocalBackend) Put(key string, r io.Reader) (int64, error) {
+	filePath, err := b.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Create directory if it doesn't exist
+	if err := utils.CreateDirectory(filepath.Dir(filePath)); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Write through a temporary file so a crash never leaves a truncated object
+	written, err := utils.WriteFileAtomic(filePath, r, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	return written, nil
+}
+
+// Get opens the file for key
+func (b *LocalBackend) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	filePath, err := b.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	if info.IsDir() {
+		file.Close()
+		return nil, nil, ErrObjectNotFound
+	}
+
+	return file, &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Stat returns information about the file for key
+func (b *LocalBackend) Stat(key string) (*ObjectInfo, error) {
+	filePath, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	if info.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+
+	return &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the file for key
+func (b *LocalBackend) Delete(key string) error {
+	filePath, err := b.path(key)
+	if err != nil {
+		return err
+	}
+
+	return utils.DeleteFile(filePath)
+}
+
+// Rename moves the file for src to dst
+func (b *LocalBackend) Rename(src, dst string) error {
+	srcPath, err := b.path(src)
+	if err != nil {
+		return err
+	}
+
+	dstPath, err := b.path(dst)
+	if err != nil {
+		return err
+	}
+
+	// Create directory if it doesn't exist
+	if err := utils.CreateDirectory(filepath.Dir(dstPath)); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrObjectNotFound
+		}
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return nil
+}
+
+// List returns the files directly inside the directory prefix
+func (b *LocalBackend) List(prefix string) ([]ObjectInfo, error) {
+	dirPath := b.basePath
+	if prefix != "" {
+		var err error
+		if dirPath, err = b.path(strings.TrimSuffix(prefix, "/")); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	objects := make([]ObjectInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:     prefix + entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return objects, nil
+}
+
+// Walk visits every file whose key starts with prefix
+func (b *LocalBackend) Walk(prefix string, fn WalkFunc) error {
+	// Start from the deepest directory contained in the prefix
+	root := b.basePath
+	if dir := prefix[:strings.LastIndex(prefix, "/")+1]; dir != "" {
+		var err error
+		if root, err = b.path(strings.TrimSuffix(dir, "/")); err != nil {
+			return err
+		}
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		// Skip directories
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.basePath, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// File removed while walking
+			return nil
+		}
+
+		return fn(ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+
+	if err != nil && err != filepath.SkipDir {
+		return err
+	}
+
+	return nil
+}
+
+// path maps a key to a path below the base directory
+func (b *LocalBackend) path(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(b.basePath, filepath.FromSlash(key)), nil
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize bounds the memory used per upload when the object size is unknown
+const s3PartSize = 16 << 20 // 16 MB
+
+// S3Backend stores objects in an S3-compatible bucket
+type S3Backend struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Backend creates a new S3-compatible backend and checks that the bucket exists
+func NewS3Backend(cfg config.S3Config) (*S3Backend, error) {
+	options := &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	}
+	if cfg.PathStyle {
+		options.BucketLookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(cfg.Endpoint, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check s3 bucket: %w", err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("s3 bucket %q does not exist", cfg.Bucket)
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3Backend{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: prefix,
+	}, nil
+}
+
+// Name returns the driver name
+func (b *S3Backend) Name() string {
+	return config.StorageDriverS3
+}
+
+// Put uploads the content of r as the object for key
+func (b *S3Backend) Put(key string, r io.Reader) (int64, error) {
+	if err := validateKey(key); err != nil {
+		return 0, err
+	}
+
+	// Payloads are sent unsigned rather than with aws-chunked signing, which not
+	// every S3-compatible server implements; use TLS to protect them in transit
+	info, err := b.client.PutObject(context.Background(), b.bucket, b.prefix+key, r, readerSize(r), minio.PutObjectOptions{
+		PartSize:             s3PartSize,
+		DisableContentSha256: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload object: %w", err)
+	}
+
+	return info.Size, nil
+}
+
+// Get opens the object for key; the returned reader is seekable
+func (b *S3Backend) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return nil, nil, err
+	}
+
+	object, err := b.client.GetObject(context.Background(), b.bucket, b.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, b.translateError(err)
+	}
+
+	// GetObject is lazy, Stat performs the request and reports missing objects
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, nil, b.translateError(err)
+	}
+
+	return object, &ObjectInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+// Stat returns information about the object for key
+func (b *S3Backend) Stat(key string) (*ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+
+	stat, err := b.client.StatObject(context.Background(), b.bucket, b.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, b.translateError(err)
+	}
+
+	return &ObjectInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+// Delete removes the object for key
+func (b *S3Backend) Delete(key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	if err := b.client.RemoveObject(context.Background(), b.bucket, b.prefix+key, minio.RemoveObjectOptions{}); err != nil {
+		if err := b.translateError(err); err != ErrObjectNotFound {
+			return fmt.Errorf("failed to delete object: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Rename copies the object for src to dst and removes the original
+func (b *S3Backend) Rename(src, dst string) error {
+	if err := validateKey(src); err != nil {
+		return err
+	}
+	if err := validateKey(dst); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, err := b.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: b.bucket, Object: b.prefix + dst},
+		minio.CopySrcOptions{Bucket: b.bucket, Object: b.prefix + src})
+	if err != nil {
+		if err := b.translateError(err); err == ErrObjectNotFound {
+			return err
+		}
+		return fmt.Errorf("failed to copy object: %w", err)
+	}
+
+	if err := b.client.RemoveObject(ctx, b.bucket, b.prefix+src, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+
+	return nil
+}
+
+// List returns the objects directly under the directory prefix
+func (b *S3Backend) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := b.list(prefix, false, func(info ObjectInfo) error {
+		objects = append(objects, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// Walk visits every object whose key starts with prefix
+func (b *S3Backend) Walk(prefix string, fn WalkFunc) error {
+	return b.list(prefix, true, fn)
+}
+
+// list iterates over the objects below prefix
+func (b *S3Backend) list(prefix string, recursive bool, fn WalkFunc) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objects := b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{
+		Prefix:    b.prefix + prefix,
+		Recursive: recursive,
+	})
+
+	for object := range objects {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list objects: %w", object.Err)
+		}
+
+		// Skip common prefixes returned for non-recursive listings
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+
+		info := ObjectInfo{
+			Key:     strings.TrimPrefix(object.Key, b.prefix),
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readerSize returns the length of in-memory readers and -1 for streams
+func readerSize(r io.Reader) int64 {
+	if sized, ok := r.(interface{ Len() int }); ok {
+		return int64(sized.Len())
+	}
+	return -1
+}
+
+// translateError maps S3 "not found" responses to ErrObjectNotFound
+func (b *S3Backend) translateError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrObjectNotFound
+	}
+	return err
+}
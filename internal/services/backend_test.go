@@ -0,0 +1,440 @@
+package services
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+)
+
+const (
+	fakeS3Bucket = "cdn"
+	fakeS3Prefix = "files"
+)
+
+// fakeS3 serves the subset of the S3 API used by S3Backend for a single
+// bucket addressed in path style: object PUT/GET/HEAD/DELETE, server-side
+// copies, multipart uploads and ListObjectsV2
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+// newS3TestBackend returns an S3 backend storing below a key prefix of a
+// fake bucket, together with the fake
+func newS3TestBackend(t *testing.T) (*S3Backend, *fakeS3) {
+	t.Helper()
+
+	fake := &fakeS3{
+		objects: map[string]fakeS3Object{},
+		uploads: map[string]map[int][]byte{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	backend, err := NewS3Backend(config.S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    fakeS3Bucket,
+		Prefix:    fakeS3Prefix,
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Backend: %v", err)
+	}
+
+	// Nothing may be written outside the configured prefix
+	t.Cleanup(func() {
+		for _, key := range fake.keys() {
+			if !strings.HasPrefix(key, fakeS3Prefix+"/") {
+				t.Errorf("object stored outside the prefix: %s", key)
+			}
+		}
+	})
+
+	return backend, fake
+}
+
+// forEachBackend runs test against a local backend and an S3 backend
+func forEachBackend(t *testing.T, test func(t *testing.T, backend Backend)) {
+	t.Run("local", func(t *testing.T) {
+		test(t, NewLocalBackend(t.TempDir()))
+	})
+	t.Run("s3", func(t *testing.T) {
+		backend, _ := newS3TestBackend(t)
+		test(t, backend)
+	})
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != fakeS3Bucket {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.list(w, query)
+	case key == "":
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		parts[number] = data
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, parts[number]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[key] = fakeS3Object{data: data, modTime: time.Now()}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		object, ok := f.objects[sourceKey]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		object.modTime = time.Now()
+		f.objects[key] = object
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(object.data), LastModified: object.modTime.UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = fakeS3Object{data: data, modTime: time.Now()}
+		w.Header().Set("ETag", etag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(object.data))
+		http.ServeContent(w, r, "", object.modTime, bytes.NewReader(object.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list answers ListObjectsV2 in a single page
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		Delimiter      string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{Name: fakeS3Bucket, Prefix: query.Get("prefix"), Delimiter: query.Get("delimiter")}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := map[string]bool{}
+	for _, key := range keys {
+		rest, ok := strings.CutPrefix(key, result.Prefix)
+		if !ok {
+			continue
+		}
+
+		if result.Delimiter != "" {
+			if i := strings.Index(rest, result.Delimiter); i >= 0 {
+				prefix := result.Prefix + rest[:i+len(result.Delimiter)]
+				if !seen[prefix] {
+					seen[prefix] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{prefix})
+				}
+				continue
+			}
+		}
+
+		object := f.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: object.modTime.UTC().Format(time.RFC3339Nano),
+			ETag:         etag(object.data),
+			Size:         int64(len(object.data)),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	writeXML(w, result)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
+
+// readObject returns the content of the object for key
+func readObject(t *testing.T, backend Backend, key string) string {
+	t.Helper()
+
+	reader, info, err := backend.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	if info.Key != key || info.Size != int64(len(data)) {
+		t.Errorf("Get(%s) info = %+v, want %d bytes", key, info, len(data))
+	}
+	return string(data)
+}
+
+// walkKeys returns the sorted keys visited by Walk
+func walkKeys(t *testing.T, backend Backend, prefix string) []string {
+	t.Helper()
+
+	var keys []string
+	err := backend.Walk(prefix, func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk(%q): %v", prefix, err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestBackendConformance(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		put := func(key, content string) {
+			t.Helper()
+			size, err := backend.Put(key, strings.NewReader(content))
+			if err != nil {
+				t.Fatalf("Put(%s): %v", key, err)
+			}
+			if size != int64(len(content)) {
+				t.Errorf("Put(%s) = %d bytes, want %d", key, size, len(content))
+			}
+		}
+
+		put("docs/a.txt", "alpha")
+		put("docs/.a.txt.meta.json", "{}")
+		put("docs/nested/b.txt", "beta")
+		put("media/c.txt", "gamma")
+
+		// Put and Get
+		if got := readObject(t, backend, "docs/a.txt"); got != "alpha" {
+			t.Errorf("Get = %q, want alpha", got)
+		}
+		put("docs/a.txt", "alpha, rewritten")
+		if got := readObject(t, backend, "docs/a.txt"); got != "alpha, rewritten" {
+			t.Errorf("Get after overwrite = %q", got)
+		}
+
+		// Content of unknown length
+		streamed := strings.Repeat("stream ", 1000)
+		size, err := backend.Put("docs/streamed.txt", io.LimitReader(strings.NewReader(streamed), int64(len(streamed))))
+		if err != nil || size != int64(len(streamed)) {
+			t.Fatalf("Put stream = %d, %v", size, err)
+		}
+		if got := readObject(t, backend, "docs/streamed.txt"); got != streamed {
+			t.Errorf("Get stream returned %d bytes, want %d", len(got), len(streamed))
+		}
+
+		// Stat
+		info, err := backend.Stat("media/c.txt")
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if info.Key != "media/c.txt" || info.Size != 5 || time.Since(info.ModTime) > time.Minute {
+			t.Errorf("Stat = %+v", info)
+		}
+		if _, err := backend.Stat("media/missing.txt"); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Stat missing = %v, want ErrObjectNotFound", err)
+		}
+		if _, _, err := backend.Get("media/missing.txt"); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Get missing = %v, want ErrObjectNotFound", err)
+		}
+
+		// List only returns the objects directly under the prefix
+		objects, err := backend.List("docs/")
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		var listed []string
+		for _, object := range objects {
+			listed = append(listed, object.Key)
+		}
+		sort.Strings(listed)
+		if got, want := strings.Join(listed, ","), "docs/.a.txt.meta.json,docs/a.txt,docs/streamed.txt"; got != want {
+			t.Errorf("List = %s, want %s", got, want)
+		}
+		if objects, err := backend.List("missing/"); err != nil || len(objects) != 0 {
+			t.Errorf("List missing = %v, %v", objects, err)
+		}
+
+		// Walk visits every key starting with the prefix, at any depth
+		if got, want := strings.Join(walkKeys(t, backend, "docs/"), ","), "docs/.a.txt.meta.json,docs/a.txt,docs/nested/b.txt,docs/streamed.txt"; got != want {
+			t.Errorf("Walk(docs/) = %s, want %s", got, want)
+		}
+		if got, want := strings.Join(walkKeys(t, backend, "docs/a"), ","), "docs/a.txt"; got != want {
+			t.Errorf("Walk(docs/a) = %s, want %s", got, want)
+		}
+		if got := walkKeys(t, backend, ""); len(got) != 5 {
+			t.Errorf("Walk() = %v, want 5 keys", got)
+		}
+		if got := walkKeys(t, backend, "missing/"); len(got) != 0 {
+			t.Errorf("Walk(missing/) = %v", got)
+		}
+
+		// An error returned by the callback stops the walk
+		visited := 0
+		err = backend.Walk("", func(ObjectInfo) error {
+			visited++
+			return errStopWalk
+		})
+		if !errors.Is(err, errStopWalk) || visited != 1 {
+			t.Errorf("Walk stopped = %v after %d objects", err, visited)
+		}
+
+		// Rename
+		if err := backend.Rename("docs/nested/b.txt", ".trash/docs/b.txt"); err != nil {
+			t.Fatalf("Rename: %v", err)
+		}
+		if _, err := backend.Stat("docs/nested/b.txt"); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Stat renamed source = %v, want ErrObjectNotFound", err)
+		}
+		if got := readObject(t, backend, ".trash/docs/b.txt"); got != "beta" {
+			t.Errorf("Get renamed = %q, want beta", got)
+		}
+		if err := backend.Rename("docs/missing.txt", "docs/other.txt"); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Rename missing = %v, want ErrObjectNotFound", err)
+		}
+
+		// Delete, including of a missing object
+		if err := backend.Delete("media/c.txt"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := backend.Stat("media/c.txt"); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Stat deleted = %v, want ErrObjectNotFound", err)
+		}
+		if err := backend.Delete("media/c.txt"); err != nil {
+			t.Errorf("Delete missing: %v", err)
+		}
+
+		// Keys escaping the storage are rejected
+		if _, err := backend.Put("../escape.txt", strings.NewReader("x")); err == nil {
+			t.Error("Put accepted a key outside the storage")
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// blobTempPrefix holds content while it is being hashed
+const blobTempPrefix = models.BlobPrefix + "tmp/"
+
+// blobRefsPrefix holds an empty marker object for every reference to a blob,
+// at .blobs/refs/<digest>/<tag>/<fileID>[@vN]. The references live in the
+// backend, so that all instances sharing the storage see the same ones.
+const blobRefsPrefix = models.BlobPrefix + "refs/"
+
+// errStopWalk ends a walk early
+var errStopWalk = errors.New("stop walk")
+
+// blobRefKey returns the key of the marker of a reference to a blob
+func blobRefKey(digest, ref string) string {
+	return blobRefsPrefix + digest + "/" + ref
+}
+
+// parseBlobRefKey splits the key of a reference marker into the digest and
+// the reference
+func parseBlobRefKey(key string) (string, string, bool) {
+	return strings.Cut(strings.TrimPrefix(key, blobRefsPrefix), "/")
+}
+
+// putBlob stores content under its SHA-256 digest and adds ref to the blob's
+// references. Content that is already stored is not written twice.
+func (s *StorageService) putBlob(src io.Reader, ref string) (string, int64, error) {
+	// The digest is only known once all bytes were read, so the content is
+	// staged under a temporary key first
+	tempKey := blobTempPrefix + uuid.New().String()
+	hash := sha256.New()
+
+	size, err := s.backend.Put(tempKey, io.TeeReader(src, hash))
+	if err != nil {
+		s.backend.Delete(tempKey)
+		return "", 0, err
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+	key := models.BlobKey(digest)
+
+	// Serialise with releaseBlob within this instance; other instances are
+	// handled by the order of the steps below and in releaseBlob
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	// The reference is recorded before the blob is looked at, so a release on
+	// another instance that could still remove the blob sees it and puts the
+	// blob back
+	if err := s.addBlobRef(digest, ref); err != nil {
+		s.backend.Delete(tempKey)
+		return "", 0, err
+	}
+
+	_, err = s.backend.Stat(key)
+	switch {
+	case err == nil:
+		s.backend.Delete(tempKey)
+		logger.WithField("digest", digest).Debug("Stored content deduplicated")
+	case errors.Is(err, ErrObjectNotFound):
+		if err := s.backend.Rename(tempKey, key); err != nil {
+			s.backend.Delete(tempKey)
+			s.backend.Delete(blobRefKey(digest, ref))
+			return "", 0, err
+		}
+	default:
+		s.backend.Delete(tempKey)
+		s.backend.Delete(blobRefKey(digest, ref))
+		return "", 0, err
+	}
+
+	return digest, size, nil
+}
+
+// retainBlob adds ref to the references of a stored blob
+func (s *StorageService) retainBlob(digest, ref string) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	if err := s.addBlobRef(digest, ref); err != nil {
+		return err
+	}
+
+	if _, err := s.backend.Stat(models.BlobKey(digest)); err != nil {
+		s.backend.Delete(blobRefKey(digest, ref))
+		if errors.Is(err, ErrObjectNotFound) {
+			return fmt.Errorf("file not found")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// releaseBlob removes ref from the blob's references and deletes the blob
+// once none are left
+func (s *StorageService) releaseBlob(digest, ref string) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	if err := s.backend.Delete(blobRefKey(digest, ref)); err != nil {
+		return fmt.Errorf("failed to release blob reference: %w", err)
+	}
+
+	if used, err := s.blobInUse(digest); err != nil || used {
+		return err
+	}
+
+	// Another instance may add a reference at the same time. The blob is
+	// moved aside and only deleted if no reference appeared meanwhile;
+	// otherwise it is put back.
+	key := models.BlobKey(digest)
+	asideKey := blobTempPrefix + uuid.New().String()
+	if err := s.backend.Rename(key, asideKey); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	used, err := s.blobInUse(digest)
+	if err != nil || used {
+		if restoreErr := s.backend.Rename(asideKey, key); restoreErr != nil {
+			logger.WithFields(logrus.Fields{
+				"digest": digest,
+				"key":    asideKey,
+				"error":  restoreErr,
+			}).Error("Failed to restore blob")
+			return restoreErr
+		}
+		return err
+	}
+
+	if err := s.backend.Delete(asideKey); err != nil {
+		return err
+	}
+	logger.WithField("digest", digest).Debug("Unreferenced content removed")
+
+	return nil
+}
+
+// addBlobRef records a reference to a blob
+func (s *StorageService) addBlobRef(digest, ref string) error {
+	if _, err := s.backend.Put(blobRefKey(digest, ref), strings.NewReader("")); err != nil {
+		return fmt.Errorf("failed to record blob reference: %w", err)
+	}
+	return nil
+}
+
+// blobInUse reports whether any reference to a blob is recorded
+func (s *StorageService) blobInUse(digest string) (bool, error) {
+	used := false
+	err := s.backend.Walk(blobRefsPrefix+digest+"/", func(info ObjectInfo) error {
+		used = true
+		return errStopWalk
+	})
+	if err != nil && !errors.Is(err, errStopWalk) {
+		return false, fmt.Errorf("failed to read blob references: %w", err)
+	}
+	return used, nil
+}
+
+// blobDigests returns the digests of all referenced blobs
+func (s *StorageService) blobDigests() ([]string, error) {
+	var digests []string
+	err := s.backend.Walk(blobRefsPrefix, func(info ObjectInfo) error {
+		digest, _, ok := parseBlobRefKey(info.Key)
+		if ok && (len(digests) == 0 || digests[len(digests)-1] != digest) {
+			digests = append(digests, digest)
+		}
+		return nil
+	})
+	return digests, err
+}
+
+// blobRefs returns the files referring to a blob
+func (s *StorageService) blobRefs(digest string) ([]string, error) {
+	refs := []string{}
+	err := s.backend.Walk(blobRefsPrefix+digest+"/", func(info ObjectInfo) error {
+		if _, ref, ok := parseBlobRefKey(info.Key); ok {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// HasBlobRefs reports whether any blob references are recorded
+func (s *StorageService) HasBlobRefs() (bool, error) {
+	found := false
+	err := s.backend.Walk(blobRefsPrefix, func(info ObjectInfo) error {
+		found = true
+		return errStopWalk
+	})
+	if err != nil && !errors.Is(err, errStopWalk) {
+		return false, err
+	}
+	return found, nil
+}
+
+// RebuildBlobRefs records the blob references of the metadata sidecars of
+// live, trashed and prior versions of files
+func (s *StorageService) RebuildBlobRefs() (int, error) {
+	metas, err := s.ListFiles("", nil, "")
+	if err != nil {
+		return 0, err
+	}
+
+	trashed, err := s.ListTrash("")
+	if err != nil {
+		return 0, err
+	}
+
+	versions, err := s.listVersions(models.VersionPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	metas = append(metas, trashed...)
+	return s.rebuildBlobRefs(append(metas, versions...), time.Time{})
+}
+
+// rebuildBlobRefs records the blob references of metas, and removes other
+// references recorded before cutoff. Younger references may belong to an
+// upload still in progress on another instance.
+func (s *StorageService) rebuildBlobRefs(metas []*models.FileMeta, cutoff time.Time) (int, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	recorded := map[string]ObjectInfo{}
+	err := s.backend.Walk(blobRefsPrefix, func(info ObjectInfo) error {
+		recorded[info.Key] = info
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to rebuild blob references: %w", err)
+	}
+
+	count := 0
+	for _, meta := range metas {
+		if meta.Digest == "" {
+			continue
+		}
+
+		key := blobRefKey(meta.Digest, meta.RefKey())
+		if _, ok := recorded[key]; ok {
+			delete(recorded, key)
+		} else if err := s.addBlobRef(meta.Digest, meta.RefKey()); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	for key, info := range recorded {
+		if info.ModTime.Before(cutoff) {
+			if err := s.backend.Delete(key); err != nil {
+				return 0, fmt.Errorf("failed to rebuild blob references: %w", err)
+			}
+		}
+	}
+
+	return count, nil
+}
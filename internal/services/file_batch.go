@@ -0,0 +1,142 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// BatchUploadRequest represents a batch upload. In atomic mode either all
+// files are stored or none; TagAllowed, when set, limits the tags files may
+// be uploaded to.
+type BatchUploadRequest struct {
+	Files      []*UploadRequest
+	Atomic     bool
+	TagAllowed func(tag string) bool
+}
+
+// BatchUploadResult is the outcome of one file of a batch upload
+type BatchUploadResult struct {
+	Index    int             `json:"index"`
+	Filename string          `json:"filename"`
+	Success  bool            `json:"success"`
+	File     *UploadResponse `json:"file,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// UploadBatch uploads several files. Failed files do not stop the others
+// unless the batch is atomic, in which case files stored so far are removed
+// again and the error of the failed file is returned.
+func (fs *FileService) UploadBatch(req *BatchUploadRequest) ([]*BatchUploadResult, error) {
+	if len(req.Files) == 0 {
+		return nil, fmt.Errorf("invalid batch: no files")
+	}
+	if len(req.Files) > fs.config.Storage.MaxBatchFiles {
+		return nil, fmt.Errorf("invalid batch: at most %d files are allowed", fs.config.Storage.MaxBatchFiles)
+	}
+
+	results := make([]*BatchUploadResult, len(req.Files))
+	for i, file := range req.Files {
+		results[i] = &BatchUploadResult{
+			Index:    i,
+			Filename: file.Filename,
+		}
+	}
+
+	if !req.Atomic {
+		for i, file := range req.Files {
+			meta, err := fs.storeBatchFile(req, file)
+			if err != nil {
+				results[i].Error = batchError(err)
+				continue
+			}
+
+			fs.announce(meta)
+			results[i].Success = true
+			results[i].File = fs.uploadResponse(meta)
+		}
+		return results, nil
+	}
+
+	// Check everything that can be checked before storing anything
+	for i, file := range req.Files {
+		if err := fs.checkBatchFile(req, file); err != nil {
+			return abortBatch(results, i, err), err
+		}
+	}
+
+	stored := make([]*models.FileMeta, 0, len(req.Files))
+	for i, file := range req.Files {
+		meta, err := fs.store(file)
+		if err != nil {
+			for _, meta := range stored {
+				fs.discard(meta)
+			}
+			return abortBatch(results, i, err), err
+		}
+		stored = append(stored, meta)
+	}
+
+	for i, meta := range stored {
+		fs.announce(meta)
+		results[i].Success = true
+		results[i].File = fs.uploadResponse(meta)
+	}
+	return results, nil
+}
+
+// storeBatchFile checks and stores one file of a batch
+func (fs *FileService) storeBatchFile(req *BatchUploadRequest, file *UploadRequest) (*models.FileMeta, error) {
+	if err := fs.checkBatchFile(req, file); err != nil {
+		return nil, err
+	}
+	return fs.store(file)
+}
+
+// checkBatchFile validates one file of a batch and checks its tag is allowed
+func (fs *FileService) checkBatchFile(req *BatchUploadRequest, file *UploadRequest) error {
+	if err := fs.validateUpload(file); err != nil {
+		return err
+	}
+	if req.TagAllowed != nil && !req.TagAllowed(file.Tag) {
+		return fmt.Errorf("invalid tag: token does not have access to tag %s", file.Tag)
+	}
+	return nil
+}
+
+// discard removes a stored upload that was never announced
+func (fs *FileService) discard(meta *models.FileMeta) {
+	if err := fs.storageService.DeleteFile(meta); err != nil {
+		logger.Warnf("Failed to remove file of aborted batch: %v", err)
+	}
+	if err := fs.storageService.DeleteMeta(meta); err != nil {
+		logger.Warnf("Failed to remove metadata of aborted batch: %v", err)
+	}
+	if fs.index != nil {
+		if err := fs.index.Delete(meta.Tag, meta.FileID); err != nil {
+			logger.Warnf("Failed to remove metadata from index: %v", err)
+		}
+	}
+}
+
+// abortBatch marks all files of an aborted batch as failed
+func abortBatch(results []*BatchUploadResult, failed int, err error) []*BatchUploadResult {
+	for i, result := range results {
+		result.Error = "not uploaded: another file of the batch failed"
+		if i == failed {
+			result.Error = batchError(err)
+		}
+	}
+	return results
+}
+
+// batchError describes the failure of a file, hiding internal errors
+func batchError(err error) string {
+	if IsValidationError(err) {
+		return err.Error()
+	}
+
+	logger.WithField("error", err).Error("Batch file upload failed")
+	return "failed to upload file"
+}
@@ -1,177 +1,483 @@
 package services
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
-	"os"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/metrics"
 	"github.com/maarifnu/cdn-fileserver/internal/models"
 	"github.com/maarifnu/cdn-fileserver/internal/utils"
 	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
 )
 
 // FileService handles file operations
 type FileService struct {
 	config         *config.Config
 	storageService *StorageService
+	index          *IndexService
+	webhooks       *WebhookService
+	scanner        *ScanService
+
+	// versionLocks serialise version changes per file so version numbers
+	// stay unique
+	versionLocks sync.Map
 }
 
-// NewFileService creates a new file service
-func NewFileService(cfg *config.Config, storage *StorageService) *FileService {
+// NewFileService creates a new file service; index may be nil, in which case
+// listings are served by walking the metadata sidecars in storage, webhooks
+// may be nil when no endpoints are configured and scanner may be nil when
+// uploads are not scanned for malware
+func NewFileService(cfg *config.Config, storage *StorageService, index *IndexService, webhooks *WebhookService, scanner *ScanService) *FileService {
 	return &FileService{
 		config:         cfg,
 		storageService: storage,
+		index:          index,
+		webhooks:       webhooks,
+		scanner:        scanner,
 	}
 }
 
-// UploadRequest represents a file upload request
+// ErrFileTooLarge is returned when an upload exceeds the maximum file size
+var ErrFileTooLarge = errors.New("file size exceeds maximum limit")
+
+// UploadRequest represents a file upload request. Size is -1 when the length
+// of a streamed upload is not known in advance. MaxSize and Extensions
+// further restrict the configured limits when set.
 type UploadRequest struct {
-	File         *multipart.FileHeader
-	Tag          string
-	Public       bool
-	UploadedBy   string
+	Filename   string
+	Size       int64
+	Content    io.Reader
+	Tag        string
+	Public     bool
+	UploadedBy string
+	MaxSize    int64
+	Extensions []string
 }
 
 // UploadResponse represents a file upload response
 type UploadResponse struct {
-	FileID       string    `json:"file_id"`
-	OriginalName string    `json:"original_name"`
-	URL          string    `json:"url"`
-	Tag          string    `json:"tag"`
-	Size         int64     `json:"size"`
-	ContentType  string    `json:"content_type"`
-	Public       bool      `json:"public"`
-	UploadedAt   time.Time `json:"uploaded_at"`
-	UploadedBy   string    `json:"uploaded_by"`
+	FileID       string             `json:"file_id"`
+	OriginalName string             `json:"original_name"`
+	URL          string             `json:"url"`
+	Tag          string             `json:"tag"`
+	Size         int64              `json:"size"`
+	ContentType  string             `json:"content_type"`
+	Public       bool               `json:"public"`
+	UploadedAt   time.Time          `json:"uploaded_at"`
+	UploadedBy   string             `json:"uploaded_by"`
+	Digest       string             `json:"digest"`
+	Version      int                `json:"version"`
+	Scan         *models.ScanResult `json:"scan,omitempty"`
 }
 
 // Upload handles file upload
 func (fs *FileService) Upload(req *UploadRequest) (*UploadResponse, error) {
-	// Validate tag
-	if err := utils.ValidateTag(req.Tag); err != nil {
-		return nil, fmt.Errorf("invalid tag: %w", err)
-	}
-
-	// Validate file size
-	if err := utils.ValidateFileSize(req.File.Size, fs.config.Storage.MaxFileSize); err != nil {
+	meta, err := fs.store(req)
+	if err != nil {
 		return nil, err
 	}
 
-	// Validate file extension
-	if err := utils.ValidateFileExtension(req.File.Filename, fs.config.Storage.AllowedExtensions); err != nil {
-		return nil, err
-	}
+	fs.announce(meta)
 
-	// Generate unique filename
-	fileID := utils.GenerateUniqueFilename(req.File.Filename)
+	return fs.uploadResponse(meta), nil
+}
 
-	// Open uploaded file
-	src, err := req.File.Open()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open uploaded file: %w", err)
+// store validates and saves an upload without announcing it
+func (fs *FileService) store(req *UploadRequest) (*models.FileMeta, error) {
+	if err := fs.validateUpload(req); err != nil {
+		return nil, err
 	}
-	defer src.Close()
 
-	// Save file to storage
-	if err := fs.storageService.SaveFile(req.Tag, fileID, src); err != nil {
-		return nil, fmt.Errorf("failed to save file: %w", err)
-	}
+	// Streamed uploads are aborted as soon as they exceed the maximum size
+	maxSize := fs.maxSize(req)
+	limited := &sizeLimitReader{r: req.Content, remaining: maxSize}
 
-	// Get file path for content type detection
-	filePath, err := fs.storageService.GetFile(req.Tag, fileID)
+	content, contentType, err := fs.sniffContent(req.Filename, limited)
 	if err != nil {
-		// Cleanup on error
-		fs.storageService.DeleteFile(req.Tag, fileID)
-		return nil, fmt.Errorf("failed to get file path: %w", err)
+		if limited.exceeded {
+			return nil, errFileTooLarge(maxSize)
+		}
+		return nil, err
 	}
 
-	// Detect content type
-	contentType, err := utils.GetContentType(filePath)
-	if err != nil {
-		logger.Warnf("Failed to detect content type: %v", err)
-		contentType = "application/octet-stream"
-	}
+	// Generate unique filename
+	fileID := utils.GenerateUniqueFilename(req.Filename, fs.config.Security.SanitizeFilename)
 
 	// Create metadata
 	meta := &models.FileMeta{
 		FileID:       fileID,
-		OriginalName: req.File.Filename,
+		OriginalName: req.Filename,
 		Tag:          req.Tag,
-		Size:         req.File.Size,
+		Size:         req.Size,
 		ContentType:  contentType,
 		Public:       req.Public,
 		UploadedAt:   time.Now(),
 		UploadedBy:   req.UploadedBy,
+		Version:      1,
+	}
+
+	// Save file to storage
+	size, err := fs.saveContent(meta, content)
+	if err != nil {
+		if limited.exceeded {
+			return nil, errFileTooLarge(maxSize)
+		}
+		return nil, err
+	}
+	meta.Size = size
+
+	if size == 0 {
+		fs.storageService.DeleteFile(meta)
+		return nil, fmt.Errorf("file is empty")
 	}
 
 	// Save metadata
-	if err := meta.Save(fs.config.Storage.BasePath); err != nil {
+	if err := fs.storageService.SaveMeta(meta); err != nil {
 		// Cleanup on error
-		fs.storageService.DeleteFile(req.Tag, fileID)
+		fs.storageService.DeleteFile(meta)
 		return nil, fmt.Errorf("failed to save metadata: %w", err)
 	}
 
-	// Build URL
-	baseURL := fs.config.GetBaseURL()
-	fileURL := fmt.Sprintf("%s/%s/%s", baseURL, req.Tag, fileID)
+	// Update metadata index
+	if fs.index != nil {
+		if err := fs.index.Put(meta); err != nil {
+			logger.Warnf("Failed to index metadata: %v", err)
+		}
+	}
+
+	return meta, nil
+}
+
+// saveContent stores the content of a file version. With a scanner, the
+// content is streamed to the antivirus daemon while it is stored, and
+// infected content is removed again before the file becomes visible.
+func (fs *FileService) saveContent(meta *models.FileMeta, content io.Reader) (int64, error) {
+	if fs.scanner == nil {
+		return fs.storageService.SaveFile(meta, content)
+	}
+
+	type scanOutcome struct {
+		result *models.ScanResult
+		err    error
+	}
 
-	logger.WithField("file_id", fileID).Info("File uploaded successfully")
+	pr, pw := io.Pipe()
+	done := make(chan scanOutcome, 1)
+	go func() {
+		result, err := fs.scanner.Scan(pr)
+		// Keep reading so a failed scan never blocks storing
+		io.Copy(io.Discard, pr)
+		done <- scanOutcome{result, err}
+	}()
+
+	size, err := fs.storageService.SaveFile(meta, io.TeeReader(content, pw))
+	pw.CloseWithError(err)
+	outcome := <-done
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case outcome.err != nil:
+		if !fs.config.Security.Antivirus.FailOpen {
+			fs.storageService.DeleteFile(meta)
+			return 0, fmt.Errorf("failed to scan file: %w", outcome.err)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"file_id": meta.FileID,
+			"error":   outcome.err,
+		}).Warn("Antivirus scan failed, storing file unscanned")
+		meta.Scan = &models.ScanResult{Status: models.ScanUnscanned, ScannedAt: time.Now()}
+
+	case outcome.result.Status == models.ScanInfected:
+		meta.Scan = outcome.result
+		fields := logrus.Fields{
+			"file_id":     meta.FileID,
+			"tag":         meta.Tag,
+			"signature":   outcome.result.Signature,
+			"uploaded_by": meta.UploadedBy,
+		}
+
+		if fs.config.Security.Antivirus.Quarantine {
+			if err := fs.storageService.QuarantineFile(meta); err != nil {
+				logger.WithField("error", err).Error("Failed to quarantine infected file")
+			} else {
+				fields["quarantined"] = true
+			}
+		}
+		fs.storageService.DeleteFile(meta)
+
+		logger.WithFields(fields).Warn("Infected upload rejected")
+		metrics.InfectedUploads.WithLabelValues(meta.Tag).Inc()
+		return 0, &InfectedError{Signature: outcome.result.Signature}
+
+	default:
+		meta.Scan = outcome.result
+	}
+
+	return size, nil
+}
+
+// validateUpload checks the tag, size and extension of an upload
+func (fs *FileService) validateUpload(req *UploadRequest) error {
+	// Validate tag
+	if err := utils.ValidateTag(req.Tag); err != nil {
+		return fmt.Errorf("invalid tag: %w", err)
+	}
 
+	// Validate file size; uploads of unknown length are checked while stored
+	if maxSize := fs.maxSize(req); req.Size > maxSize {
+		return errFileTooLarge(maxSize)
+	}
+	if req.Size >= 0 {
+		if err := utils.ValidateFileSize(req.Size, fs.config.Storage.MaxFileSize); err != nil {
+			return err
+		}
+	}
+
+	// Validate file extension
+	if err := utils.ValidateFileExtension(req.Filename, fs.config.Storage.AllowedExtensions); err != nil {
+		return err
+	}
+	if len(req.Extensions) > 0 {
+		if err := utils.ValidateFileExtension(req.Filename, req.Extensions); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MaxFileSize returns the maximum size of an uploaded file in bytes
+func (fs *FileService) MaxFileSize() int64 {
+	return fs.config.Storage.MaxFileSize
+}
+
+// maxSize returns the maximum size of an upload in bytes
+func (fs *FileService) maxSize(req *UploadRequest) int64 {
+	if req.MaxSize > 0 && req.MaxSize < fs.config.Storage.MaxFileSize {
+		return req.MaxSize
+	}
+	return fs.config.Storage.MaxFileSize
+}
+
+// errFileTooLarge returns ErrFileTooLarge with the exceeded limit
+func errFileTooLarge(limit int64) error {
+	if limit%(1024*1024) == 0 {
+		return fmt.Errorf("%w (%d MB)", ErrFileTooLarge, limit/1024/1024)
+	}
+	return fmt.Errorf("%w (%s)", ErrFileTooLarge, utils.FormatFileSize(limit))
+}
+
+// announce records a stored upload in the metrics and notifies webhooks
+func (fs *FileService) announce(meta *models.FileMeta) {
+	metrics.UploadBytes.WithLabelValues(meta.Tag).Add(float64(meta.Size))
+
+	if fs.webhooks != nil {
+		fs.webhooks.Notify(EventFileUploaded, meta, fs.FileURL(meta.Tag, meta.FileID))
+	}
+
+	logger.WithField("file_id", meta.FileID).Info("File uploaded successfully")
+}
+
+// uploadResponse describes a stored file version
+func (fs *FileService) uploadResponse(meta *models.FileMeta) *UploadResponse {
 	return &UploadResponse{
-		FileID:       fileID,
-		OriginalName: req.File.Filename,
-		URL:          fileURL,
-		Tag:          req.Tag,
-		Size:         req.File.Size,
-		ContentType:  contentType,
-		Public:       req.Public,
+		FileID:       meta.FileID,
+		OriginalName: meta.OriginalName,
+		URL:          fs.FileURL(meta.Tag, meta.FileID),
+		Tag:          meta.Tag,
+		Size:         meta.Size,
+		ContentType:  meta.ContentType,
+		Public:       meta.Public,
 		UploadedAt:   meta.UploadedAt,
-		UploadedBy:   req.UploadedBy,
-	}, nil
+		UploadedBy:   meta.UploadedBy,
+		Digest:       meta.Digest,
+		Version:      meta.Version,
+		Scan:         meta.Scan,
+	}
+}
+
+// FileURL returns the public URL of a stored file
+func (fs *FileService) FileURL(tag, fileID string) string {
+	return fmt.Sprintf("%s/%s/%s", fs.config.GetBaseURL(), tag, url.PathEscape(fileID))
+}
+
+// sniffContent detects the content type from the start of an upload before
+// it is persisted and validates it against the file extension. It returns a
+// reader yielding the complete content.
+func (fs *FileService) sniffContent(filename string, src io.Reader) (io.Reader, string, error) {
+	head := make([]byte, utils.SniffLength)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, "", fmt.Errorf("failed to read uploaded file: %w", err)
+	}
+	head = head[:n]
+	detected := mimetype.Detect(head)
+
+	// Validate file content against extension
+	if fs.config.Security.ValidateFileContent {
+		if err := utils.ValidateFileContent(filename, detected, fs.allowedMimeTypes()); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return io.MultiReader(bytes.NewReader(head), src), detected.String(), nil
+}
+
+// sizeLimitReader fails once more than remaining bytes were read
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+// Read reads from the underlying reader until the limit is exceeded
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, ErrFileTooLarge
+	}
+
+	// Read one byte past the limit to tell an exact fit from an overflow
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded = true
+		return 0, ErrFileTooLarge
+	}
+	return n, err
+}
+
+// allowedMimeTypes returns the configured extension to content type map
+func (fs *FileService) allowedMimeTypes() map[string][]string {
+	if len(fs.config.Security.AllowedMimeTypes) > 0 {
+		return fs.config.Security.AllowedMimeTypes
+	}
+	return utils.DefaultAllowedMimeTypes
+}
+
+// IsValidationError reports whether an upload error was caused by invalid input
+func IsValidationError(err error) bool {
+	message := err.Error()
+	return message == "file is empty" ||
+		strings.HasPrefix(message, "invalid ") ||
+		strings.HasPrefix(message, "file ")
 }
 
-// Download retrieves file metadata for download
-func (fs *FileService) Download(tag, fileID string) (*models.FileMeta, string, error) {
+// Download retrieves file metadata and opens the file for download
+func (fs *FileService) Download(tag, fileID string) (*models.FileMeta, io.ReadCloser, *ObjectInfo, error) {
 	// Load metadata
-	meta := &models.FileMeta{
-		Tag:    tag,
-		FileID: fileID,
+	meta, err := fs.storageService.LoadMeta(tag, fileID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("file not found")
 	}
 
-	if err := meta.Load(fs.config.Storage.BasePath); err != nil {
-		return nil, "", fmt.Errorf("file not found")
+	// Open file content
+	reader, info, err := fs.storageService.OpenFile(meta)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("file not found")
 	}
 
-	// Get file path
-	filePath, err := fs.storageService.GetFile(tag, fileID)
+	return meta, reader, info, nil
+}
+
+// GetMeta returns the metadata of a stored file
+func (fs *FileService) GetMeta(tag, fileID string) (*models.FileMeta, error) {
+	meta, err := fs.storageService.LoadMeta(tag, fileID)
 	if err != nil {
-		return nil, "", fmt.Errorf("file not found")
+		return nil, fmt.Errorf("file not found")
+	}
+
+	return meta, nil
+}
+
+// SignedURL represents a signed download URL
+type SignedURL struct {
+	URL       string    `json:"url"`
+	Tag       string    `json:"tag"`
+	FileID    string    `json:"file_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	IP        string    `json:"ip,omitempty"`
+}
+
+// SignURL mints a download URL for a file that is valid until ttl elapses,
+// optionally bound to a single client IP
+func (fs *FileService) SignURL(tag, fileID string, ttl time.Duration, ip string) (*SignedURL, error) {
+	signing := fs.config.Security.SignedURL
+	if !signing.Enabled() {
+		return nil, fmt.Errorf("signed urls are not configured")
+	}
+
+	if _, err := fs.GetMeta(tag, fileID); err != nil {
+		return nil, err
+	}
+
+	if ttl <= 0 {
+		ttl = signing.DefaultTTL
+	}
+	if ttl > signing.MaxTTL {
+		return nil, fmt.Errorf("invalid expiry: maximum is %s", signing.MaxTTL)
 	}
 
-	return meta, filePath, nil
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	signature := utils.SignFileURL(signing.Secret, tag, fileID, expiresAt.Unix(), ip)
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	query.Set("sig", signature)
+
+	return &SignedURL{
+		URL:       fs.FileURL(tag, fileID) + "?" + query.Encode(),
+		Tag:       tag,
+		FileID:    fileID,
+		ExpiresAt: expiresAt,
+		IP:        ip,
+	}, nil
 }
 
-// ListRequest represents a file list request
+// ListRequest represents a file list request; TagAllowed, when set, limits
+// the listing to the tags it accepts
 type ListRequest struct {
-	Tag      string
-	Public   *bool
-	Search   string
-	Page     int
-	Limit    int
-	SortDesc bool
+	Tag        string
+	Public     *bool
+	Search     string
+	Page       int
+	Limit      int
+	SortDesc   bool
+	TagAllowed func(tag string) bool
 }
 
 // List retrieves a list of files with pagination
 func (fs *FileService) List(req *ListRequest) ([]*models.FileMeta, int, error) {
+	if fs.index != nil {
+		return fs.index.Query(req)
+	}
+
 	// Get all files matching filters
 	allFiles, err := fs.storageService.ListFiles(req.Tag, req.Public, req.Search)
 	if err != nil {
 		return nil, 0, err
 	}
+	allFiles = filterTags(allFiles, req.TagAllowed)
 
 	// Sort by upload date
 	sort.Slice(allFiles, func(i, j int) bool {
@@ -201,26 +507,50 @@ func (fs *FileService) List(req *ListRequest) ([]*models.FileMeta, int, error) {
 	return paginatedFiles, totalItems, nil
 }
 
-// Delete removes a file and its metadata
-func (fs *FileService) Delete(tag, fileID string) error {
+// Delete removes a file and its metadata, or moves them to the trash when
+// soft deletes are enabled
+func (fs *FileService) Delete(tag, fileID, deletedBy string) error {
 	// Load metadata first to check if file exists
-	meta := &models.FileMeta{
-		Tag:    tag,
-		FileID: fileID,
+	meta, err := fs.storageService.LoadMeta(tag, fileID)
+	if err != nil {
+		return fmt.Errorf("file not found")
 	}
 
-	if err := meta.Load(fs.config.Storage.BasePath); err != nil {
-		return fmt.Errorf("file not found")
+	if fs.config.Storage.Trash.Enabled {
+		if err := fs.storageService.TrashFile(meta, deletedBy); err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+	} else {
+		// Delete actual file
+		if err := fs.storageService.DeleteFile(meta); err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+
+		// Delete metadata
+		if err := fs.storageService.DeleteMeta(meta); err != nil {
+			logger.Warnf("Failed to delete metadata: %v", err)
+		}
+
+		// Delete prior versions
+		if err := fs.storageService.DeleteVersions(tag, fileID); err != nil {
+			logger.Warnf("Failed to delete prior versions: %v", err)
+		}
+	}
+
+	// Delete cached image variants
+	if err := fs.storageService.DeletePrefix(variantPrefix(tag, fileID)); err != nil {
+		logger.Warnf("Failed to delete image variants: %v", err)
 	}
 
-	// Delete actual file
-	if err := fs.storageService.DeleteFile(tag, fileID); err != nil {
-		return fmt.Errorf("failed to delete file: %w", err)
+	// Update metadata index
+	if fs.index != nil {
+		if err := fs.index.Delete(tag, fileID); err != nil {
+			logger.Warnf("Failed to remove metadata from index: %v", err)
+		}
 	}
 
-	// Delete metadata
-	if err := meta.Delete(fs.config.Storage.BasePath); err != nil {
-		logger.Warnf("Failed to delete metadata: %v", err)
+	if fs.webhooks != nil {
+		fs.webhooks.Notify(EventFileDeleted, meta, fs.FileURL(tag, fileID))
 	}
 
 	logger.WithField("file_id", fileID).Info("File deleted successfully")
@@ -228,22 +558,162 @@ func (fs *FileService) Delete(tag, fileID string) error {
 	return nil
 }
 
-// GetFile returns file reader for streaming
-func (fs *FileService) GetFile(tag, fileID string) (io.ReadCloser, error) {
-	filePath, err := fs.storageService.GetFile(tag, fileID)
+// TrashListRequest represents a trash list request; TagAllowed, when set,
+// limits the listing to the tags it accepts
+type TrashListRequest struct {
+	Tag        string
+	Page       int
+	Limit      int
+	TagAllowed func(tag string) bool
+}
+
+// ListTrash retrieves the files in the trash, most recently deleted first
+func (fs *FileService) ListTrash(req *TrashListRequest) ([]*models.FileMeta, int, error) {
+	files, err := fs.storageService.ListTrash(req.Tag)
 	if err != nil {
+		return nil, 0, err
+	}
+	files = filterTags(files, req.TagAllowed)
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].DeletedAt.After(*files[j].DeletedAt)
+	})
+
+	totalItems := len(files)
+	startIndex := (req.Page - 1) * req.Limit
+	if startIndex >= totalItems {
+		return []*models.FileMeta{}, totalItems, nil
+	}
+
+	return files[startIndex:min(startIndex+req.Limit, totalItems)], totalItems, nil
+}
+
+// Restore moves a file out of the trash
+func (fs *FileService) Restore(tag, fileID string) (*models.FileMeta, error) {
+	meta, err := fs.storageService.LoadTrashedMeta(tag, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("file not found")
+	}
+
+	if err := fs.storageService.RestoreFile(meta); err != nil {
 		return nil, err
 	}
 
-	file, err := openFile(filePath)
+	// Update metadata index
+	if fs.index != nil {
+		if err := fs.index.Put(meta); err != nil {
+			logger.Warnf("Failed to index metadata: %v", err)
+		}
+	}
+
+	if fs.webhooks != nil {
+		fs.webhooks.Notify(EventFileRestored, meta, fs.FileURL(tag, fileID))
+	}
+
+	logger.WithField("file_id", fileID).Info("File restored from trash")
+
+	return meta, nil
+}
+
+// Purge permanently removes a file from the trash
+func (fs *FileService) Purge(tag, fileID string) error {
+	meta, err := fs.storageService.LoadTrashedMeta(tag, fileID)
+	if err != nil {
+		return fmt.Errorf("file not found")
+	}
+
+	return fs.purge(meta)
+}
+
+// PurgeExpired permanently removes the files deleted longer than the
+// configured retention ago
+func (fs *FileService) PurgeExpired() (int, error) {
+	files, err := fs.storageService.ListTrash("")
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-fs.config.Storage.Trash.Retention)
+	purged := 0
+	for _, meta := range files {
+		if meta.DeletedAt.After(cutoff) {
+			continue
+		}
+
+		if err := fs.purge(meta); err != nil {
+			logger.Warnf("Failed to purge %s: %v", meta.FileKey(), err)
+			continue
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// purge deletes the content and metadata of a trashed file
+func (fs *FileService) purge(meta *models.FileMeta) error {
+	if err := fs.storageService.DeleteFile(meta); err != nil {
+		return err
+	}
+
+	if err := fs.storageService.DeleteMeta(meta); err != nil {
+		return err
+	}
+
+	if err := fs.storageService.DeleteVersions(meta.Tag, meta.FileID); err != nil {
+		return err
+	}
+
+	logger.WithField("file_id", meta.FileID).Info("File purged from trash")
+
+	return nil
+}
+
+// filterTags keeps the files in tags accepted by allowed; a nil allowed
+// accepts every tag
+func filterTags(files []*models.FileMeta, allowed func(tag string) bool) []*models.FileMeta {
+	if allowed == nil {
+		return files
+	}
+
+	kept := files[:0]
+	for _, meta := range files {
+		if allowed(meta.Tag) {
+			kept = append(kept, meta)
+		}
+	}
+	return kept
+}
+
+// RebuildIndex repopulates the metadata index from the sidecar files in storage
+func (fs *FileService) RebuildIndex() (int, error) {
+	if fs.index == nil {
+		return 0, fmt.Errorf("metadata index is disabled")
+	}
+
+	metas, err := fs.storageService.ListFiles("", nil, "")
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return 0, err
+	}
+
+	if err := fs.index.Replace(metas); err != nil {
+		return 0, fmt.Errorf("failed to rebuild metadata index: %w", err)
 	}
 
-	return file, nil
+	return len(metas), nil
 }
 
-// Helper function to open file
-func openFile(path string) (io.ReadCloser, error) {
-	return os.Open(path)
+// GetFile returns file reader for streaming
+func (fs *FileService) GetFile(tag, fileID string) (io.ReadCloser, error) {
+	meta, err := fs.GetMeta(tag, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, _, err := fs.storageService.OpenFile(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
 }
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// ReplaceRequest represents a request to replace the content of a file
+type ReplaceRequest struct {
+	Tag        string
+	FileID     string
+	Filename   string
+	Size       int64
+	Content    io.Reader
+	Public     *bool
+	UploadedBy string
+}
+
+// Replace stores new content under an existing file ID, keeping the current
+// content as a prior version
+func (fs *FileService) Replace(req *ReplaceRequest) (*UploadResponse, error) {
+	// Validate file size
+	if err := utils.ValidateFileSize(req.Size, fs.config.Storage.MaxFileSize); err != nil {
+		return nil, err
+	}
+
+	// Validate file extension; the URL keeps its extension, so the content
+	// must keep its type
+	if err := utils.ValidateFileExtension(req.Filename, fs.config.Storage.AllowedExtensions); err != nil {
+		return nil, err
+	}
+	if ext := filepath.Ext(req.FileID); !strings.EqualFold(filepath.Ext(req.Filename), ext) {
+		return nil, fmt.Errorf("invalid file extension: replacement must be a %s file", ext)
+	}
+
+	unlock := fs.lockFile(req.Tag, req.FileID)
+	defer unlock()
+
+	current, err := fs.storageService.LoadMeta(req.Tag, req.FileID)
+	if err != nil {
+		return nil, fmt.Errorf("file not found")
+	}
+
+	// The declared size is not trusted; the limit applies to the bytes read
+	maxSize := fs.config.Storage.MaxFileSize
+	limited := &sizeLimitReader{r: req.Content, remaining: maxSize}
+
+	content, contentType, err := fs.sniffContent(req.Filename, limited)
+	if err != nil {
+		if limited.exceeded {
+			return nil, errFileTooLarge(maxSize)
+		}
+		return nil, err
+	}
+
+	next := &models.FileMeta{
+		FileID:       current.FileID,
+		OriginalName: req.Filename,
+		Tag:          current.Tag,
+		Size:         req.Size,
+		ContentType:  contentType,
+		Public:       current.Public,
+		UploadedAt:   time.Now(),
+		UploadedBy:   req.UploadedBy,
+		Version:      current.Version + 1,
+	}
+	if req.Public != nil {
+		next.Public = *req.Public
+	}
+
+	size, err := fs.saveContent(next, content)
+	if err != nil {
+		if limited.exceeded {
+			return nil, errFileTooLarge(maxSize)
+		}
+		return nil, err
+	}
+	next.Size = size
+
+	if size == 0 {
+		fs.storageService.DeleteFile(next)
+		return nil, fmt.Errorf("file is empty")
+	}
+
+	if err := fs.replace(current, next); err != nil {
+		fs.storageService.DeleteFile(next)
+		return nil, err
+	}
+
+	return fs.uploadResponse(next), nil
+}
+
+// Rollback makes a prior version the current content of a file. The
+// rollback is recorded as a new version, so no history is lost.
+func (fs *FileService) Rollback(tag, fileID string, version int, rolledBackBy string) (*UploadResponse, error) {
+	unlock := fs.lockFile(tag, fileID)
+	defer unlock()
+
+	current, err := fs.storageService.LoadMeta(tag, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("file not found")
+	}
+
+	if version == current.Version {
+		return nil, fmt.Errorf("invalid version: %d is the current version", version)
+	}
+
+	prior, err := fs.storageService.LoadVersion(tag, fileID, version)
+	if err != nil {
+		return nil, fmt.Errorf("version not found")
+	}
+
+	next := *prior
+	next.Public = current.Public
+	next.UploadedAt = time.Now()
+	next.UploadedBy = rolledBackBy
+	next.Version = current.Version + 1
+	next.DeletedAt = nil
+	next.DeletedBy = ""
+
+	// The blob of a version can be lost outside the server; the scrubber
+	// reports such content as missing
+	if err := fs.storageService.retainBlob(next.Digest, next.RefKey()); err != nil {
+		if err.Error() == "file not found" {
+			return nil, fmt.Errorf("version content missing")
+		}
+		return nil, err
+	}
+
+	if err := fs.replace(current, &next); err != nil {
+		fs.storageService.DeleteFile(&next)
+		return nil, err
+	}
+
+	return fs.uploadResponse(&next), nil
+}
+
+// Versions lists all versions of a file, newest first
+func (fs *FileService) Versions(tag, fileID string) ([]*models.FileMeta, error) {
+	current, err := fs.storageService.LoadMeta(tag, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("file not found")
+	}
+
+	prior, err := fs.storageService.ListVersions(tag, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []*models.FileMeta{current}
+	for _, meta := range prior {
+		// Left over by a replacement that did not complete
+		if meta.Version >= current.Version {
+			continue
+		}
+
+		meta.Public = current.Public
+		versions = append(versions, meta)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+
+	return versions, nil
+}
+
+// DownloadVersion retrieves the metadata of a version of a file and opens it
+// for download. Prior versions share the visibility of the current one.
+func (fs *FileService) DownloadVersion(tag, fileID string, version int) (*models.FileMeta, io.ReadCloser, *ObjectInfo, error) {
+	current, err := fs.storageService.LoadMeta(tag, fileID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("file not found")
+	}
+
+	meta := current
+	if version != current.Version {
+		meta, err = fs.storageService.LoadVersion(tag, fileID, version)
+		if err != nil || version > current.Version {
+			return nil, nil, nil, fmt.Errorf("file not found")
+		}
+		meta.Public = current.Public
+	}
+
+	reader, info, err := fs.storageService.OpenFile(meta)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("file not found")
+	}
+
+	return meta, reader, info, nil
+}
+
+// replace archives the current version of a file and makes next, whose
+// content is already stored, the current one
+func (fs *FileService) replace(current, next *models.FileMeta) error {
+	if err := fs.storageService.ArchiveVersion(current); err != nil {
+		return fmt.Errorf("failed to keep prior version: %w", err)
+	}
+
+	if err := fs.storageService.SaveMeta(next); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	// Cached variants of the prior content are no longer served
+	if err := fs.storageService.DeletePrefix(variantPrefix(next.Tag, next.FileID)); err != nil {
+		logger.Warnf("Failed to delete image variants: %v", err)
+	}
+
+	// Update metadata index
+	if fs.index != nil {
+		if err := fs.index.Put(next); err != nil {
+			logger.Warnf("Failed to index metadata: %v", err)
+		}
+	}
+
+	if fs.webhooks != nil {
+		fs.webhooks.Notify(EventFileReplaced, next, fs.FileURL(next.Tag, next.FileID))
+	}
+
+	logger.WithFields(logrus.Fields{
+		"file_id": next.FileID,
+		"version": next.Version,
+	}).Info("File replaced successfully")
+
+	return nil
+}
+
+// lockFile serialises version changes of a single file; the returned
+// function releases the lock
+func (fs *FileService) lockFile(tag, fileID string) func() {
+	value, _ := fs.versionLocks.LoadOrStore(fileKey(tag, fileID), &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+)
+
+// replaceText replaces the content of a text file
+func replaceText(t *testing.T, fs *FileService, fileID, content string) {
+	t.Helper()
+
+	_, err := fs.Replace(&ReplaceRequest{
+		Tag:      "docs",
+		FileID:   fileID,
+		Filename: "notes.txt",
+		Size:     int64(len(content)),
+		Content:  strings.NewReader(content),
+	})
+	if err != nil {
+		t.Fatalf("Replace(%s): %v", fileID, err)
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		fs := newTestFileService(t, backend, false)
+
+		fileID := uploadText(t, fs, "notes.txt", "first draft")
+		replaceText(t, fs, fileID, "second draft")
+
+		// Every version holds its own reference
+		blobs, refs := blobKeys(t, backend)
+		if len(blobs) != 2 || len(refs) != 2 {
+			t.Fatalf("after replace: blobs %v, refs %v", blobs, refs)
+		}
+
+		// Rolling back shares the blob of the restored version
+		response, err := fs.Rollback("docs", fileID, 1, "test")
+		if err != nil {
+			t.Fatalf("Rollback: %v", err)
+		}
+		if response.Version != 3 {
+			t.Errorf("Rollback version = %d, want 3", response.Version)
+		}
+		if got := downloadText(t, fs, fileID); got != "first draft" {
+			t.Errorf("Download after rollback = %q", got)
+		}
+		blobs, refs = blobKeys(t, backend)
+		if len(blobs) != 2 || len(refs) != 3 {
+			t.Fatalf("after rollback: blobs %v, refs %v", blobs, refs)
+		}
+
+		versions, err := fs.Versions("docs", fileID)
+		if err != nil || len(versions) != 3 || versions[0].Version != 3 || versions[2].Version != 1 {
+			t.Fatalf("Versions = %v, %v", versions, err)
+		}
+		if versions[0].Digest != versions[2].Digest {
+			t.Errorf("rolled back digest %s, want %s", versions[0].Digest, versions[2].Digest)
+		}
+
+		_, reader, _, err := fs.DownloadVersion("docs", fileID, 2)
+		if err != nil {
+			t.Fatalf("DownloadVersion: %v", err)
+		}
+		reader.Close()
+
+		if _, err := fs.Rollback("docs", fileID, 3, "test"); !IsValidationError(err) {
+			t.Errorf("Rollback to the current version = %v", err)
+		}
+		if _, err := fs.Rollback("docs", fileID, 7, "test"); err == nil || err.Error() != "version not found" {
+			t.Errorf("Rollback to a missing version = %v", err)
+		}
+
+		// Deleting the file releases the content of all of its versions
+		if err := fs.Delete("docs", fileID, "test"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if keys := walkKeys(t, backend, ""); len(keys) != 0 {
+			t.Errorf("after delete: %v", keys)
+		}
+	})
+}
+
+func TestRollbackMissingContent(t *testing.T) {
+	backend := NewLocalBackend(t.TempDir())
+	fs := newTestFileService(t, backend, false)
+
+	fileID := uploadText(t, fs, "notes.txt", "first draft")
+	replaceText(t, fs, fileID, "second draft")
+
+	// The blob of the prior version is lost outside the server
+	prior, err := fs.storageService.LoadVersion("docs", fileID, 1)
+	if err != nil {
+		t.Fatalf("LoadVersion: %v", err)
+	}
+	if err := backend.Delete(models.BlobKey(prior.Digest)); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	_, refsBefore := blobKeys(t, backend)
+
+	if _, err := fs.Rollback("docs", fileID, 1, "test"); err == nil || err.Error() != "version content missing" {
+		t.Fatalf("Rollback = %v, want version content missing", err)
+	}
+
+	// The file keeps its current version
+	if got := downloadText(t, fs, fileID); got != "second draft" {
+		t.Errorf("Download = %q", got)
+	}
+	if _, refs := blobKeys(t, backend); len(refs) != len(refsBefore) {
+		t.Errorf("refs after failed rollback: %v, before %v", refs, refsBefore)
+	}
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Idempotency key bucket:
+//
+//	idempotency_keys  scope -> IdempotentResponse JSON
+var idempotencyBucket = []byte("idempotency_keys")
+
+// IdempotentResponse is the stored response of a request made with an
+// Idempotency-Key, replayed for repetitions of the request
+type IdempotentResponse struct {
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// IdempotencyService stores the responses of requests made with an
+// Idempotency-Key until their TTL elapses
+type IdempotencyService struct {
+	config *config.Config
+	db     *bolt.DB
+	stop   chan struct{}
+
+	// inFlight holds the keys of requests that are being processed
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+// NewIdempotencyService creates a new idempotency key store
+func NewIdempotencyService(cfg *config.Config, db *bolt.DB) (*IdempotencyService, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(idempotencyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize idempotency store: %w", err)
+	}
+
+	return &IdempotencyService{
+		config:   cfg,
+		db:       db,
+		stop:     make(chan struct{}),
+		inFlight: make(map[string]bool),
+	}, nil
+}
+
+// Start launches the periodic removal of expired keys
+func (s *IdempotencyService) Start() {
+	go func() {
+		ticker := time.NewTicker(s.config.Idempotency.CleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.removeExpired()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic removal
+func (s *IdempotencyService) Stop() {
+	close(s.stop)
+}
+
+// Lock marks a key as being processed. It returns false if a request with
+// the key is already in progress.
+func (s *IdempotencyService) Lock(scope string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inFlight[scope] {
+		return false
+	}
+	s.inFlight[scope] = true
+	return true
+}
+
+// Unlock marks a key as no longer being processed
+func (s *IdempotencyService) Unlock(scope string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inFlight, scope)
+}
+
+// Get returns the stored response for a key, or nil if there is none or it
+// expired
+func (s *IdempotencyService) Get(scope string) (*IdempotentResponse, error) {
+	var response *IdempotentResponse
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(idempotencyBucket).Get([]byte(scope))
+		if data == nil {
+			return nil
+		}
+
+		response = &IdempotentResponse{}
+		return json.Unmarshal(data, response)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load idempotency key: %w", err)
+	}
+
+	if response != nil && !time.Now().Before(response.ExpiresAt) {
+		return nil, nil
+	}
+
+	return response, nil
+}
+
+// Save stores the response for a key
+func (s *IdempotencyService) Save(scope string, response *IdempotentResponse) error {
+	response.CreatedAt = time.Now()
+	response.ExpiresAt = response.CreatedAt.Add(s.config.Idempotency.TTL)
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotent response: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(idempotencyBucket).Put([]byte(scope), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// removeExpired deletes the keys whose TTL elapsed
+func (s *IdempotencyService) removeExpired() {
+	now := time.Now()
+	removed := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+
+		var expired [][]byte
+		err := bucket.ForEach(func(scope, data []byte) error {
+			var response IdempotentResponse
+			if err := json.Unmarshal(data, &response); err != nil || !now.Before(response.ExpiresAt) {
+				expired = append(expired, scope)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, scope := range expired {
+			if err := bucket.Delete(scope); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("Failed to remove expired idempotency keys: %v", err)
+		return
+	}
+
+	if removed > 0 {
+		logger.Debugf("Removed %d expired idempotency keys", removed)
+	}
+}
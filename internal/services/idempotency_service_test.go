@@ -0,0 +1,48 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestIdempotencyExpiry(t *testing.T) {
+	cfg := &config.Config{Idempotency: config.IdempotencyConfig{Enabled: true, TTL: 20 * time.Millisecond}}
+	db := openTestDB(t)
+	idempotency, err := NewIdempotencyService(cfg, db)
+	if err != nil {
+		t.Fatalf("NewIdempotencyService: %v", err)
+	}
+
+	if err := idempotency.Save("token:a:old", &IdempotentResponse{Fingerprint: "f", Status: 200, Body: []byte("old")}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	cfg.Idempotency.TTL = time.Hour
+	if err := idempotency.Save("token:a:new", &IdempotentResponse{Fingerprint: "f", Status: 200, Body: []byte("new")}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// An expired response is not replayed, even before it is removed
+	if stored, err := idempotency.Get("token:a:old"); err != nil || stored != nil {
+		t.Errorf("Get expired = %+v, %v", stored, err)
+	}
+	if stored, err := idempotency.Get("token:a:new"); err != nil || stored == nil || string(stored.Body) != "new" {
+		t.Errorf("Get = %+v, %v", stored, err)
+	}
+
+	idempotency.removeExpired()
+	var keys []string
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(idempotencyBucket).ForEach(func(scope, _ []byte) error {
+			keys = append(keys, string(scope))
+			return nil
+		})
+	})
+	if len(keys) != 1 || keys[0] != "token:a:new" {
+		t.Errorf("keys after removal = %v", keys)
+	}
+}
@@ -0,0 +1,346 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register the WebP decoder
+	"golang.org/x/sync/singleflight"
+)
+
+// imageVariantsDir is the directory inside each tag that caches rendered variants
+const imageVariantsDir = ".variants"
+
+// Image fit modes
+const (
+	FitContain = "contain" // scale to fit inside the box, keeping the aspect ratio
+	FitCover   = "cover"   // scale to cover the box and crop the overflow
+	FitFill    = "fill"    // stretch to the exact box
+)
+
+// imageFormats maps output formats to their content types
+var imageFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+// ImageOptions describes a requested image variant
+type ImageOptions struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+// ImageService renders resized and converted variants of stored images and
+// caches them next to the original
+type ImageService struct {
+	config         *config.Config
+	storageService *StorageService
+	renders        singleflight.Group
+}
+
+// NewImageService creates a new image service
+func NewImageService(cfg *config.Config, storage *StorageService) *ImageService {
+	return &ImageService{
+		config:         cfg,
+		storageService: storage,
+	}
+}
+
+// HasImageOptions reports whether a query requests an image variant
+func HasImageOptions(query url.Values) bool {
+	for _, key := range []string{"w", "h", "fit", "format", "q"} {
+		if query.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseOptions validates the variant parameters of a query against the
+// configured limits
+func (s *ImageService) ParseOptions(query url.Values) (*ImageOptions, error) {
+	limits := s.config.Images
+	opts := &ImageOptions{
+		Fit:     FitContain,
+		Quality: limits.DefaultQuality,
+	}
+
+	var err error
+	if opts.Width, err = parseDimension(query.Get("w"), limits.MaxWidth); err != nil {
+		return nil, fmt.Errorf("invalid width: %w", err)
+	}
+	if opts.Height, err = parseDimension(query.Get("h"), limits.MaxHeight); err != nil {
+		return nil, fmt.Errorf("invalid height: %w", err)
+	}
+
+	if len(limits.AllowedWidths) > 0 && opts.Width > 0 && !containsInt(limits.AllowedWidths, opts.Width) {
+		return nil, fmt.Errorf("invalid width: allowed widths are %v", limits.AllowedWidths)
+	}
+	if len(limits.AllowedHeights) > 0 && opts.Height > 0 && !containsInt(limits.AllowedHeights, opts.Height) {
+		return nil, fmt.Errorf("invalid height: allowed heights are %v", limits.AllowedHeights)
+	}
+
+	if fit := query.Get("fit"); fit != "" {
+		if fit != FitContain && fit != FitCover && fit != FitFill {
+			return nil, fmt.Errorf("invalid fit: must be contain, cover or fill")
+		}
+		opts.Fit = fit
+	}
+
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if _, ok := imageFormats[format]; !ok {
+			return nil, fmt.Errorf("invalid format: must be webp, jpeg or png")
+		}
+		opts.Format = format
+	}
+
+	if q := query.Get("q"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("invalid quality: must be between 1 and 100")
+		}
+		if len(limits.AllowedQualities) > 0 && !containsInt(limits.AllowedQualities, quality) {
+			return nil, fmt.Errorf("invalid quality: allowed qualities are %v", limits.AllowedQualities)
+		}
+		opts.Quality = quality
+	}
+
+	if (opts.Fit == FitCover || opts.Fit == FitFill) && (opts.Width == 0 || opts.Height == 0) {
+		return nil, fmt.Errorf("invalid size: fit %s requires both w and h", opts.Fit)
+	}
+
+	return opts, nil
+}
+
+// IsSupported reports whether variants can be rendered for a content type
+func (s *ImageService) IsSupported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// Variant returns the rendered variant of an image, from cache when available.
+// A file has at most the configured number of cached variants; further
+// variants are refused.
+func (s *ImageService) Variant(meta *models.FileMeta, opts *ImageOptions) (io.ReadCloser, *ObjectInfo, string, error) {
+	if opts.Format == "" {
+		opts.Format = sourceFormat(meta.ContentType)
+	}
+	// Only JPEG output is lossy; WebP is encoded losslessly
+	if opts.Format != "jpeg" {
+		opts.Quality = 0
+	}
+	contentType := imageFormats[opts.Format]
+	key := variantKey(meta, opts)
+
+	// Serve from cache
+	if reader, info, err := s.storageService.backend.Get(key); err == nil {
+		return reader, info, contentType, nil
+	}
+
+	// Render once even when many clients request the same variant
+	result, err, _ := s.renders.Do(key, func() (interface{}, error) {
+		cached, err := s.storageService.backend.List(variantDir(meta))
+		if err != nil {
+			return nil, err
+		}
+		if len(cached) >= s.config.Images.MaxVariants {
+			return nil, fmt.Errorf("invalid image options: the file has reached its limit of %d variants", s.config.Images.MaxVariants)
+		}
+
+		data, err := s.render(meta, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := s.storageService.backend.Put(key, bytes.NewReader(data)); err != nil {
+			logger.Warnf("Failed to cache image variant %s: %v", key, err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	data := result.([]byte)
+	info := &ObjectInfo{Key: key, Size: int64(len(data)), ModTime: time.Now()}
+	return io.NopCloser(bytes.NewReader(data)), info, contentType, nil
+}
+
+// render decodes, resizes and encodes an image
+func (s *ImageService) render(meta *models.FileMeta, opts *ImageOptions) ([]byte, error) {
+	reader, _, err := s.storageService.OpenFile(meta)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Check the dimensions before decoding to bound memory use
+	var header bytes.Buffer
+	imgConfig, _, err := image.DecodeConfig(io.TeeReader(reader, &header))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+
+	if int64(imgConfig.Width)*int64(imgConfig.Height) > s.config.Images.MaxSourcePixels {
+		return nil, fmt.Errorf("invalid image: source exceeds %d pixels", s.config.Images.MaxSourcePixels)
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&header, reader))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+
+	dst := resizeImage(src, opts)
+
+	var out bytes.Buffer
+	switch opts.Format {
+	case "jpeg":
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: opts.Quality})
+	case "png":
+		err = png.Encode(&out, dst)
+	case "webp":
+		err = nativewebp.Encode(&out, dst, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// resizeImage scales src according to the requested size and fit, never
+// enlarging the source
+func resizeImage(src image.Image, opts *ImageOptions) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	srcRect := bounds
+
+	width, height := opts.Width, opts.Height
+	switch {
+	case width == 0 && height == 0:
+		width, height = srcW, srcH
+	case opts.Fit == FitContain:
+		// Scale by the most constraining side
+		scale := 1.0
+		if width > 0 {
+			scale = float64(width) / float64(srcW)
+		}
+		if height > 0 && (width == 0 || float64(height)/float64(srcH) < scale) {
+			scale = float64(height) / float64(srcH)
+		}
+		if scale > 1 {
+			scale = 1
+		}
+		width = max(1, int(float64(srcW)*scale+0.5))
+		height = max(1, int(float64(srcH)*scale+0.5))
+	case opts.Fit == FitCover:
+		// Crop the source to the target aspect ratio around its centre
+		if float64(srcW)*float64(height) > float64(srcH)*float64(width) {
+			cropW := srcH * width / height
+			srcRect.Min.X += (srcW - cropW) / 2
+			srcRect.Max.X = srcRect.Min.X + cropW
+		} else {
+			cropH := srcW * height / width
+			srcRect.Min.Y += (srcH - cropH) / 2
+			srcRect.Max.Y = srcRect.Min.Y + cropH
+		}
+		if width > srcRect.Dx() || height > srcRect.Dy() {
+			width, height = srcRect.Dx(), srcRect.Dy()
+		}
+	case opts.Fit == FitFill:
+		width, height = min(width, srcW), min(height, srcH)
+	}
+
+	// GIF and paletted images are rendered from their first frame into RGBA
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Src, nil)
+	return dst
+}
+
+// variantKey builds the cache key of a variant from the content it is
+// rendered from and its parameters, so that a render of replaced content
+// finishing late is never served for the new content
+func variantKey(meta *models.FileMeta, opts *ImageOptions) string {
+	return fmt.Sprintf("%s%dx%d_%s_q%d.%s", variantDir(meta),
+		opts.Width, opts.Height, opts.Fit, opts.Quality, opts.Format)
+}
+
+// variantDir returns the key prefix of the cached variants of the current
+// content of a file
+func variantDir(meta *models.FileMeta) string {
+	source := meta.Digest
+	if source == "" {
+		source = fmt.Sprintf("v%d", meta.Version)
+	}
+	return variantPrefix(meta.Tag, meta.FileID) + source + "/"
+}
+
+// variantPrefix returns the key prefix of all cached variants of a file
+func variantPrefix(tag, fileID string) string {
+	return tag + "/" + imageVariantsDir + "/" + fileID + "/"
+}
+
+// sourceFormat maps a source content type to the output format used when no
+// format is requested
+func sourceFormat(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return "jpeg"
+	case "image/webp":
+		return "webp"
+	default:
+		return "png"
+	}
+}
+
+// parseDimension parses a width or height, 0 meaning unspecified
+func parseDimension(value string, limit int) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, errors.New("must be a positive integer")
+	}
+	if n > limit {
+		return 0, fmt.Errorf("maximum is %d", limit)
+	}
+
+	return n, nil
+}
+
+// containsInt reports whether values contains n
+func containsInt(values []int, n int) bool {
+	for _, v := range values {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
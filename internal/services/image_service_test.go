@@ -0,0 +1,249 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+)
+
+// solidPNG encodes a square image of a single colour
+func solidPNG(t *testing.T, c color.Color) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// variantColor renders a variant and returns the colour of its first pixel
+func variantColor(t *testing.T, images *ImageService, meta *models.FileMeta, opts ImageOptions) color.NRGBA {
+	t.Helper()
+
+	reader, _, _, err := images.Variant(meta, &opts)
+	if err != nil {
+		t.Fatalf("Variant: %v", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Variant: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+}
+
+func TestImageVariantAfterReplace(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			BasePath:          t.TempDir(),
+			MaxFileSize:       1 << 20,
+			AllowedExtensions: []string{"png"},
+			Versioning:        config.VersioningConfig{Enabled: true},
+		},
+		Images: config.ImagesConfig{
+			Enabled:         true,
+			MaxWidth:        64,
+			MaxHeight:       64,
+			MaxSourcePixels: 1 << 20,
+			MaxVariants:     10,
+		},
+	}
+	backend := NewLocalBackend(cfg.Storage.BasePath)
+	storage := NewStorageService(cfg, backend)
+	fs := NewFileService(cfg, storage, nil, nil, nil)
+	images := NewImageService(cfg, storage)
+
+	original := solidPNG(t, red)
+	response, err := fs.Upload(&UploadRequest{
+		Filename: "logo.png",
+		Size:     int64(len(original)),
+		Content:  bytes.NewReader(original),
+		Tag:      "media",
+	})
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	opts := ImageOptions{Width: 4, Fit: FitContain, Format: "png"}
+	before, err := storage.LoadMeta("media", response.FileID)
+	if err != nil {
+		t.Fatalf("LoadMeta: %v", err)
+	}
+	if got := variantColor(t, images, before, opts); got != red {
+		t.Fatalf("variant before replace = %v, want red", got)
+	}
+
+	replacement := solidPNG(t, blue)
+	if _, err := fs.Replace(&ReplaceRequest{
+		Tag:      "media",
+		FileID:   response.FileID,
+		Filename: "logo.png",
+		Size:     int64(len(replacement)),
+		Content:  bytes.NewReader(replacement),
+	}); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+
+	after, err := storage.LoadMeta("media", response.FileID)
+	if err != nil {
+		t.Fatalf("LoadMeta: %v", err)
+	}
+
+	// A render of the prior content that finishes after the replacement
+	// stores its result under the key of the prior content
+	staleKey := variantKey(before, &opts)
+	if staleKey == variantKey(after, &opts) {
+		t.Fatalf("variant key %s does not change with the content", staleKey)
+	}
+	if _, err := backend.Put(staleKey, bytes.NewReader(solidPNG(t, red))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if got := variantColor(t, images, after, opts); got != blue {
+		t.Errorf("variant after replace = %v, want blue", got)
+	}
+
+	// Rolling back renders the restored content again
+	if _, err := fs.Rollback("media", response.FileID, 1, "test"); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	rolledBack, err := storage.LoadMeta("media", response.FileID)
+	if err != nil {
+		t.Fatalf("LoadMeta: %v", err)
+	}
+	if got := variantColor(t, images, rolledBack, opts); got != red {
+		t.Errorf("variant after rollback = %v, want red", got)
+	}
+
+	// Deleting the file removes all of its variants
+	if err := fs.Delete("media", response.FileID, "test"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if keys := walkKeys(t, backend, variantPrefix("media", response.FileID)); len(keys) != 0 {
+		t.Errorf("variants left after delete: %v", keys)
+	}
+}
+
+func TestImageParseOptions(t *testing.T) {
+	images := NewImageService(&config.Config{
+		Images: config.ImagesConfig{
+			Enabled:          true,
+			MaxWidth:         2048,
+			MaxHeight:        1024,
+			AllowedWidths:    []int{160, 320},
+			AllowedHeights:   []int{90, 180},
+			AllowedQualities: []int{60, 82},
+			DefaultQuality:   82,
+		},
+	}, nil)
+
+	tests := []struct {
+		query string
+		want  ImageOptions
+		err   string
+	}{
+		{query: "w=320", want: ImageOptions{Width: 320, Fit: FitContain, Quality: 82}},
+		{query: "w=160&h=90&fit=cover&format=jpg&q=60", want: ImageOptions{Width: 160, Height: 90, Fit: FitCover, Format: "jpeg", Quality: 60}},
+		{query: "w=321", err: "invalid width: allowed widths are [160 320]"},
+		{query: "w=4096", err: "invalid width: maximum is 2048"},
+		{query: "h=91", err: "invalid height: allowed heights are [90 180]"},
+		{query: "h=2000", err: "invalid height: maximum is 1024"},
+		{query: "q=61", err: "invalid quality: allowed qualities are [60 82]"},
+		{query: "q=0", err: "invalid quality: must be between 1 and 100"},
+		{query: "fit=stretch", err: "invalid fit"},
+		{query: "format=gif", err: "invalid format"},
+		{query: "w=160&fit=fill", err: "invalid size: fit fill requires both w and h"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			opts, err := images.ParseOptions(query)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("ParseOptions error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseOptions: %v", err)
+			}
+			if *opts != tt.want {
+				t.Errorf("ParseOptions = %+v, want %+v", *opts, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageVariantLimit(t *testing.T) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			BasePath:          t.TempDir(),
+			MaxFileSize:       1 << 20,
+			AllowedExtensions: []string{"png"},
+		},
+		Images: config.ImagesConfig{
+			Enabled:         true,
+			MaxWidth:        64,
+			MaxHeight:       64,
+			MaxSourcePixels: 1 << 20,
+			MaxVariants:     2,
+		},
+	}
+	storage := NewStorageService(cfg, NewLocalBackend(cfg.Storage.BasePath))
+	fs := NewFileService(cfg, storage, nil, nil, nil)
+	images := NewImageService(cfg, storage)
+
+	content := solidPNG(t, color.White)
+	response, err := fs.Upload(&UploadRequest{
+		Filename: "logo.png",
+		Size:     int64(len(content)),
+		Content:  bytes.NewReader(content),
+		Tag:      "media",
+	})
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	meta, err := storage.LoadMeta("media", response.FileID)
+	if err != nil {
+		t.Fatalf("LoadMeta: %v", err)
+	}
+
+	for _, width := range []int{2, 4, 2} {
+		reader, _, _, err := images.Variant(meta, &ImageOptions{Width: width, Fit: FitContain, Format: "png"})
+		if err != nil {
+			t.Fatalf("Variant(w=%d): %v", width, err)
+		}
+		reader.Close()
+	}
+
+	// Cached variants are still served, new ones are refused
+	_, _, _, err = images.Variant(meta, &ImageOptions{Width: 6, Fit: FitContain, Format: "png"})
+	if !IsValidationError(err) {
+		t.Errorf("Variant beyond the limit = %v, want a validation error", err)
+	}
+}
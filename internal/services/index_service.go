@@ -0,0 +1,242 @@
+package services
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Index buckets:
+//
+//	files      "tag/fileID" -> FileMeta JSON
+//	by_time    uploadedAt + "tag/fileID" -> nil
+//	by_tag     tag -> nested bucket laid out like by_time
+var (
+	indexFilesBucket  = []byte("files")
+	indexByTimeBucket = []byte("by_time")
+	indexByTagBucket  = []byte("by_tag")
+)
+
+// IndexService maintains a queryable index of file metadata. The sidecar
+// files in storage remain the source of truth; the index can be rebuilt
+// from them at any time.
+type IndexService struct {
+	db *bolt.DB
+}
+
+// NewIndexService creates a new metadata index service
+func NewIndexService(db *bolt.DB) (*IndexService, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{indexFilesBucket, indexByTimeBucket, indexByTagBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metadata index: %w", err)
+	}
+
+	return &IndexService{
+		db: db,
+	}, nil
+}
+
+// Put adds or replaces the index entry of a file
+func (s *IndexService) Put(meta *models.FileMeta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putIndexEntry(tx, meta)
+	})
+}
+
+// Delete removes the index entry of a file
+func (s *IndexService) Delete(tag, fileID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteIndexEntry(tx, fileKey(tag, fileID))
+	})
+}
+
+// Count returns the number of indexed files
+func (s *IndexService) Count() (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(indexFilesBucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+// Replace discards the whole index and fills it with the given metadata
+func (s *IndexService) Replace(metas []*models.FileMeta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{indexFilesBucket, indexByTimeBucket, indexByTagBucket} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		for _, meta := range metas {
+			if err := putIndexEntry(tx, meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Query returns one page of files matching the request, ordered by upload
+// date, together with the total number of matches
+func (s *IndexService) Query(req *ListRequest) ([]*models.FileMeta, int, error) {
+	files := []*models.FileMeta{}
+	totalItems := 0
+
+	startIndex := (req.Page - 1) * req.Limit
+	endIndex := startIndex + req.Limit
+	searchLower := strings.ToLower(req.Search)
+	needsMeta := req.Public != nil || req.Search != ""
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Pick the time-ordered bucket to scan
+		timeline := tx.Bucket(indexByTimeBucket)
+		if req.Tag != "" {
+			timeline = tx.Bucket(indexByTagBucket).Bucket([]byte(req.Tag))
+			if timeline == nil {
+				return nil
+			}
+		}
+		filesBucket := tx.Bucket(indexFilesBucket)
+
+		cursor := timeline.Cursor()
+		first, next := cursor.First, cursor.Next
+		if req.SortDesc {
+			first, next = cursor.Last, cursor.Prev
+		}
+
+		for k, _ := first(); k != nil; k, _ = next() {
+			// Keys carry the tag, so excluded tags are skipped undecoded
+			if req.TagAllowed != nil {
+				tag, _, _ := strings.Cut(string(k[8:]), "/")
+				if !req.TagAllowed(tag) {
+					continue
+				}
+			}
+
+			inPage := totalItems >= startIndex && totalItems < endIndex
+
+			// Only decode entries that are filtered or returned
+			if !needsMeta && !inPage {
+				totalItems++
+				continue
+			}
+
+			data := filesBucket.Get(k[8:])
+			if data == nil {
+				continue
+			}
+
+			var meta models.FileMeta
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return fmt.Errorf("failed to decode index entry %s: %w", k[8:], err)
+			}
+
+			if req.Public != nil && meta.Public != *req.Public {
+				continue
+			}
+
+			if searchLower != "" &&
+				!strings.Contains(strings.ToLower(meta.OriginalName), searchLower) &&
+				!strings.Contains(strings.ToLower(meta.FileID), searchLower) {
+				continue
+			}
+
+			if inPage {
+				files = append(files, &meta)
+			}
+			totalItems++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query metadata index: %w", err)
+	}
+
+	return files, totalItems, nil
+}
+
+// putIndexEntry writes a file entry and its time-ordered keys
+func putIndexEntry(tx *bolt.Tx, meta *models.FileMeta) error {
+	key := meta.FileKey()
+
+	// Drop stale ordering keys if the entry already exists
+	if err := deleteIndexEntry(tx, key); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	if err := tx.Bucket(indexFilesBucket).Put([]byte(key), data); err != nil {
+		return err
+	}
+
+	timeKey := indexTimeKey(meta)
+	if err := tx.Bucket(indexByTimeBucket).Put(timeKey, nil); err != nil {
+		return err
+	}
+
+	tagBucket, err := tx.Bucket(indexByTagBucket).CreateBucketIfNotExists([]byte(meta.Tag))
+	if err != nil {
+		return err
+	}
+	return tagBucket.Put(timeKey, nil)
+}
+
+// deleteIndexEntry removes a file entry and its time-ordered keys
+func deleteIndexEntry(tx *bolt.Tx, key string) error {
+	filesBucket := tx.Bucket(indexFilesBucket)
+
+	data := filesBucket.Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+
+	var meta models.FileMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("failed to decode index entry %s: %w", key, err)
+	}
+
+	timeKey := indexTimeKey(&meta)
+	if err := tx.Bucket(indexByTimeBucket).Delete(timeKey); err != nil {
+		return err
+	}
+
+	if tagBucket := tx.Bucket(indexByTagBucket).Bucket([]byte(meta.Tag)); tagBucket != nil {
+		if err := tagBucket.Delete(timeKey); err != nil {
+			return err
+		}
+	}
+
+	return filesBucket.Delete([]byte(key))
+}
+
+// indexTimeKey builds a key that sorts by upload time, then by file key
+func indexTimeKey(meta *models.FileMeta) []byte {
+	nanos := meta.UploadedAt.UnixNano()
+	if nanos < 0 {
+		nanos = 0
+	}
+
+	key := make([]byte, 8, 8+len(meta.FileKey()))
+	binary.BigEndian.PutUint64(key, uint64(nanos))
+	return append(key, meta.FileKey()...)
+}
@@ -0,0 +1,472 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// jwtTokenPrefix starts the IDs of tokens authenticated by a JWT, followed by
+// the subject
+const jwtTokenPrefix = "jwt:"
+
+// jwksRefetchInterval limits how often an unknown key ID triggers a refetch
+// of the JWKS before the regular refresh
+const jwksRefetchInterval = time.Minute
+
+// jwksMaxSize limits the size of a JWKS document
+const jwksMaxSize = 1 << 20
+
+// jsonWebKey is a public key of a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWTService verifies bearer JWTs against a JWKS and maps their claims to a
+// token with permissions and tag restrictions
+type JWTService struct {
+	config  *config.Config
+	client  *http.Client
+	mu      sync.RWMutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	stop    chan struct{}
+}
+
+// NewJWTService creates a new JWT verifier and loads the JWKS. A JWKS URL that
+// cannot be fetched yet is retried later rather than failing startup.
+func NewJWTService(cfg *config.Config) (*JWTService, error) {
+	s := &JWTService{
+		config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   map[string]crypto.PublicKey{},
+		stop:   make(chan struct{}),
+	}
+
+	if err := s.refresh(); err != nil {
+		if cfg.Security.JWT.JWKSFile != "" {
+			return nil, err
+		}
+		logger.Warnf("Failed to fetch JWKS, retrying later: %v", err)
+	}
+
+	return s, nil
+}
+
+// Start launches the periodic JWKS refresh
+func (s *JWTService) Start() {
+	go func() {
+		ticker := time.NewTicker(s.config.Security.JWT.RefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.refresh(); err != nil {
+					logger.Warnf("Failed to refresh JWKS: %v", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic JWKS refresh
+func (s *JWTService) Stop() {
+	close(s.stop)
+}
+
+// IsJWT reports whether a bearer credential has the form of a JWT
+func IsJWT(key string) bool {
+	return strings.HasPrefix(key, "eyJ") && strings.Count(key, ".") == 2
+}
+
+// Authenticate verifies a JWT and returns the token its claims describe, or
+// nil if it is invalid or grants no permissions
+func (s *JWTService) Authenticate(raw string) *config.TokenConfig {
+	cfg := &s.config.Security.JWT
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(cfg.Algorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(raw, claims, s.keyFor, options...); err != nil {
+		logger.WithField("reason", err.Error()).Debug("Invalid JWT")
+		return nil
+	}
+
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		logger.WithField("reason", "missing subject").Debug("Invalid JWT")
+		return nil
+	}
+
+	token := &config.TokenConfig{
+		ID:          jwtTokenPrefix + subject,
+		Name:        subject,
+		Permissions: s.permissions(claims),
+	}
+	if exp, _ := claims.GetExpirationTime(); exp != nil {
+		token.ExpiresAt = &exp.Time
+	}
+	if len(token.Permissions) == 0 {
+		logger.WithField("subject", subject).Debug("JWT grants no permissions")
+		return nil
+	}
+
+	tags, err := s.tags(claims, token)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"subject": subject,
+			"reason":  err.Error(),
+		}).Debug("Invalid JWT")
+		return nil
+	}
+	token.Tags = tags
+
+	return token
+}
+
+// permissions collects the permissions granted by the permissions and roles
+// claims, limited to the allowed permissions
+func (s *JWTService) permissions(claims jwt.MapClaims) []string {
+	cfg := &s.config.Security.JWT
+
+	granted := map[string]bool{}
+	for _, permission := range claimStrings(claims[cfg.PermissionsClaim]) {
+		granted[permission] = true
+	}
+	for _, role := range claimStrings(claims[cfg.RolesClaim]) {
+		for _, permission := range cfg.Roles[role] {
+			granted[permission] = true
+		}
+	}
+
+	var permissions []string
+	for _, permission := range cfg.AllowedPermissions {
+		if granted[permission] {
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions
+}
+
+// tags reads the tag restrictions claim: either a list of patterns for all
+// permissions, where an empty list grants no tag, or an object of patterns per
+// permission. Entries for permissions the token does not have are ignored.
+// Without the claim the token covers every tag, unless the claim is required.
+// An object without a "*" entry must name every permission of the token when
+// the claim is required; otherwise the permissions it leaves out grant no tag.
+func (s *JWTService) tags(claims jwt.MapClaims, token *config.TokenConfig) (map[string][]string, error) {
+	claim, ok := claims[s.config.Security.JWT.TagsClaim]
+	if !ok || claim == nil {
+		if s.config.Security.JWT.TagsClaimRequired() {
+			return nil, fmt.Errorf("missing tags claim")
+		}
+		return nil, nil
+	}
+
+	tags := map[string][]string{}
+	switch value := claim.(type) {
+	case string, []interface{}:
+		tags["*"] = claimStrings(value)
+	case map[string]interface{}:
+		for permission, patterns := range value {
+			if permission == "*" || token.HasPermission(permission) {
+				tags[permission] = claimStrings(patterns)
+			}
+		}
+		if _, ok := tags["*"]; !ok {
+			for _, permission := range token.Permissions {
+				if _, ok := tags[permission]; ok {
+					continue
+				}
+				if s.config.Security.JWT.TagsClaimRequired() {
+					return nil, fmt.Errorf("tags claim has no entry for permission %s", permission)
+				}
+				tags[permission] = []string{}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid tags claim")
+	}
+
+	if err := (&config.TokenConfig{Permissions: token.Permissions, Tags: tags}).ValidateTags(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// keyFor returns the verification key for a JWT, refetching the JWKS when the
+// key ID is unknown
+func (s *JWTService) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, err := s.lookup(kid, token.Method.Alg())
+	if err == nil {
+		return key, nil
+	}
+
+	// Claim the refetch so concurrent requests do not all fetch
+	s.mu.Lock()
+	stale := time.Since(s.fetched) > jwksRefetchInterval
+	if stale {
+		s.fetched = time.Now()
+	}
+	s.mu.Unlock()
+	if !stale {
+		return nil, err
+	}
+
+	if err := s.refresh(); err != nil {
+		logger.Warnf("Failed to refresh JWKS: %v", err)
+	}
+	return s.lookup(kid, token.Method.Alg())
+}
+
+// lookup finds a key by ID, or the only key usable with an algorithm when the
+// JWT names none
+func (s *JWTService) lookup(kid, alg string) (crypto.PublicKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if kid != "" {
+		if key, ok := s.keys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	var found crypto.PublicKey
+	for _, key := range s.keys {
+		if keyMatchesAlg(key, alg) {
+			if found != nil {
+				return nil, fmt.Errorf("key id required")
+			}
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no key for %s", alg)
+	}
+	return found, nil
+}
+
+// refresh loads the JWKS from its file or URL
+func (s *JWTService) refresh() error {
+	cfg := &s.config.Security.JWT
+
+	var data []byte
+	var err error
+	if cfg.JWKSFile != "" {
+		data, err = os.ReadFile(cfg.JWKSFile)
+	} else {
+		data, err = s.fetch(cfg.JWKSURL)
+	}
+
+	s.mu.Lock()
+	s.fetched = time.Now()
+	s.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to read jwks: %w", err)
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	logger.Debugf("Loaded %d keys from JWKS", len(keys))
+	return nil
+}
+
+// fetch downloads the JWKS
+func (s *JWTService) fetch(url string) ([]byte, error) {
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+}
+
+// parseJWKS decodes the signature keys of a JWKS document. Keys of unsupported
+// types are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for i, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			logger.Warnf("Skipping JWKS key %d (%s): %v", i, jwk.Kid, err)
+			continue
+		}
+
+		kid := jwk.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		keys[kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks contains no usable keys")
+	}
+	return keys, nil
+}
+
+// publicKey decodes an RSA, P-256 or Ed25519 public key
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeKeyParam(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeKeyParam(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 4 {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeKeyParam(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyParam(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid ec point")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeKeyParam(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// decodeKeyParam decodes a base64url key parameter
+func decodeKeyParam(value string) ([]byte, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing key parameter")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key parameter: %w", err)
+	}
+	return data, nil
+}
+
+// keyMatchesAlg reports whether a key can verify an algorithm
+func keyMatchesAlg(key crypto.PublicKey, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256"
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+// claimStrings reads a claim holding a list of strings or a space separated
+// string, as in the OAuth scope claim
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+)
+
+// jwtSigner signs test JWTs with a P-256 key published in a JWKS file
+type jwtSigner struct {
+	key  *ecdsa.PrivateKey
+	kid  string
+	file string
+}
+
+// newJWTSigner generates a key and writes its JWKS to a temporary file
+func newJWTSigner(t *testing.T, kid string) *jwtSigner {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	s := &jwtSigner{key: key, kid: kid, file: filepath.Join(t.TempDir(), "jwks.json")}
+	s.publish(t, s)
+	return s
+}
+
+// publish writes the JWKS holding the keys of signers to the file of s
+func (s *jwtSigner) publish(t *testing.T, signers ...*jwtSigner) {
+	t.Helper()
+
+	var keys []jsonWebKey
+	for _, signer := range signers {
+		keys = append(keys, jsonWebKey{
+			Kty: "EC",
+			Kid: signer.kid,
+			Use: "sig",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(signer.key.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(signer.key.Y.FillBytes(make([]byte, 32))),
+		})
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if err := os.WriteFile(s.file, data, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// sign returns a JWT for claims, filling in the subject, issuer, audience and
+// expiry unless given
+func (s *jwtSigner) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	defaults := jwt.MapClaims{
+		"sub": "school-app",
+		"iss": "https://id.example.com",
+		"aud": "cdn",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range defaults {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = s.kid
+	raw, err := token.SignedString(s.key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return raw
+}
+
+// jwtConfig returns a configuration verifying JWTs against the JWKS file of
+// signer, with the defaults applied by config validation
+func jwtConfig(signer *jwtSigner) *config.Config {
+	return &config.Config{
+		Security: config.SecurityConfig{
+			JWT: config.JWTConfig{
+				Enabled:            true,
+				JWKSFile:           signer.file,
+				RefreshInterval:    time.Hour,
+				Issuer:             "https://id.example.com",
+				Audience:           "cdn",
+				Algorithms:         []string{"RS256", "ES256", "EdDSA"},
+				PermissionsClaim:   "permissions",
+				RolesClaim:         "roles",
+				TagsClaim:          "tags",
+				AllowedPermissions: []string{"upload", "read", "list"},
+			},
+		},
+	}
+}
+
+func TestJWTServiceTagsClaim(t *testing.T) {
+	optional := false
+
+	tests := []struct {
+		name     string
+		tags     interface{}
+		required *bool
+		allowed  map[string]string
+		denied   map[string]string
+	}{
+		{
+			name:    "list for all permissions",
+			tags:    []string{"school-*"},
+			allowed: map[string]string{"upload": "school-a", "read": "school-b"},
+			denied:  map[string]string{"upload": "media", "read": "media"},
+		},
+		{
+			name:    "object naming every permission",
+			tags:    map[string]interface{}{"upload": []string{"school-a"}, "read": "school-a school-b"},
+			allowed: map[string]string{"upload": "school-a", "read": "school-b"},
+			denied:  map[string]string{"upload": "school-b"},
+		},
+		{
+			name:    "star fallback",
+			tags:    map[string]interface{}{"read": []string{"*"}, "*": []string{"school-a"}},
+			allowed: map[string]string{"upload": "school-a", "read": "media"},
+			denied:  map[string]string{"upload": "media"},
+		},
+		{
+			name: "empty object",
+			tags: map[string]interface{}{},
+		},
+		{
+			name: "partial object",
+			tags: map[string]interface{}{"read": []string{"school-a"}},
+		},
+		{
+			name: "missing claim",
+		},
+		{
+			name:     "partial object when not required",
+			tags:     map[string]interface{}{"read": []string{"school-a"}},
+			required: &optional,
+			allowed:  map[string]string{"read": "school-a"},
+			denied:   map[string]string{"upload": "school-a", "read": "media"},
+		},
+		{
+			name:     "empty object when not required",
+			tags:     map[string]interface{}{},
+			required: &optional,
+			denied:   map[string]string{"upload": "school-a", "read": "school-a"},
+		},
+		{
+			name:     "missing claim when not required",
+			required: &optional,
+			allowed:  map[string]string{"upload": "school-a", "read": "media"},
+		},
+	}
+
+	signer := newJWTSigner(t, "k1")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := jwtConfig(signer)
+			cfg.Security.JWT.RequireTagsClaim = tt.required
+
+			service, err := NewJWTService(cfg)
+			if err != nil {
+				t.Fatalf("NewJWTService: %v", err)
+			}
+
+			claims := jwt.MapClaims{"permissions": []string{"upload", "read"}}
+			if tt.tags != nil {
+				claims["tags"] = tt.tags
+			}
+
+			token := service.Authenticate(signer.sign(t, claims))
+			if tt.allowed == nil && tt.denied == nil {
+				if token != nil {
+					t.Fatalf("Authenticate accepted the token with tags %v", token.Tags)
+				}
+				return
+			}
+			if token == nil {
+				t.Fatal("Authenticate rejected the token")
+			}
+
+			for permission, tag := range tt.allowed {
+				if !token.AllowsTag(permission, tag) {
+					t.Errorf("AllowsTag(%s, %s) = false", permission, tag)
+				}
+			}
+			for permission, tag := range tt.denied {
+				if token.AllowsTag(permission, tag) {
+					t.Errorf("AllowsTag(%s, %s) = true", permission, tag)
+				}
+			}
+		})
+	}
+}
+
+func TestJWTServiceAuthenticate(t *testing.T) {
+	signer := newJWTSigner(t, "k1")
+	other := newJWTSigner(t, "k1")
+
+	noneToken, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"sub": "school-app", "iss": "https://id.example.com", "aud": "cdn",
+		"exp": time.Now().Add(time.Hour).Unix(), "permissions": "upload", "tags": "*",
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "school-app", "iss": "https://id.example.com", "aud": "cdn",
+		"exp": time.Now().Add(time.Hour).Unix(), "permissions": "upload", "tags": "*",
+	})
+	hmacToken.Header["kid"] = "k1"
+	hmacRaw, err := hmacToken.SignedString([]byte("k1"))
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		raw         func() string
+		algorithms  []string
+		permissions []string
+	}{
+		{
+			name:        "valid",
+			raw:         func() string { return signer.sign(t, jwt.MapClaims{"permissions": "upload read", "tags": "*"}) },
+			permissions: []string{"upload", "read"},
+		},
+		{
+			name:        "roles",
+			raw:         func() string { return signer.sign(t, jwt.MapClaims{"roles": []string{"teacher"}, "tags": "*"}) },
+			permissions: []string{"upload", "read"},
+		},
+		{
+			name:        "permissions outside the allowed ones are dropped",
+			raw:         func() string { return signer.sign(t, jwt.MapClaims{"permissions": "read admin delete", "tags": "*"}) },
+			permissions: []string{"read"},
+		},
+		{
+			name: "no allowed permission",
+			raw:  func() string { return signer.sign(t, jwt.MapClaims{"permissions": "admin", "tags": "*"}) },
+		},
+		{
+			name: "other key",
+			raw:  func() string { return other.sign(t, jwt.MapClaims{"permissions": "upload", "tags": "*"}) },
+		},
+		{
+			name: "tampered claims",
+			raw: func() string {
+				valid := signer.sign(t, jwt.MapClaims{"permissions": "read", "tags": "*"})
+				forged := signer.sign(t, jwt.MapClaims{"permissions": "upload read list", "tags": "*"})
+				parts, forgedParts := strings.Split(valid, "."), strings.Split(forged, ".")
+				return parts[0] + "." + forgedParts[1] + "." + parts[2]
+			},
+		},
+		{
+			name: "algorithm none",
+			raw:  func() string { return noneToken },
+		},
+		{
+			name: "hmac with a public key id",
+			raw:  func() string { return hmacRaw },
+		},
+		{
+			name:       "algorithm not allowed",
+			raw:        func() string { return signer.sign(t, jwt.MapClaims{"permissions": "upload", "tags": "*"}) },
+			algorithms: []string{"RS256"},
+		},
+		{
+			name: "wrong issuer",
+			raw: func() string {
+				return signer.sign(t, jwt.MapClaims{"iss": "https://evil.example.com", "permissions": "upload", "tags": "*"})
+			},
+		},
+		{
+			name: "wrong audience",
+			raw: func() string {
+				return signer.sign(t, jwt.MapClaims{"aud": "other-service", "permissions": "upload", "tags": "*"})
+			},
+		},
+		{
+			name: "expired",
+			raw: func() string {
+				return signer.sign(t, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix(), "permissions": "upload", "tags": "*"})
+			},
+		},
+		{
+			name: "without expiry",
+			raw:  func() string { return signer.sign(t, jwt.MapClaims{"exp": nil, "permissions": "upload", "tags": "*"}) },
+		},
+		{
+			name: "not yet valid",
+			raw: func() string {
+				return signer.sign(t, jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix(), "permissions": "upload", "tags": "*"})
+			},
+		},
+		{
+			name: "without subject",
+			raw:  func() string { return signer.sign(t, jwt.MapClaims{"sub": "", "permissions": "upload", "tags": "*"}) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := jwtConfig(signer)
+			cfg.Security.JWT.Roles = map[string][]string{"teacher": {"upload", "read"}}
+			if tt.algorithms != nil {
+				cfg.Security.JWT.Algorithms = tt.algorithms
+			}
+
+			service, err := NewJWTService(cfg)
+			if err != nil {
+				t.Fatalf("NewJWTService: %v", err)
+			}
+
+			token := service.Authenticate(tt.raw())
+			if tt.permissions == nil {
+				if token != nil {
+					t.Fatalf("Authenticate accepted the token: %+v", token)
+				}
+				return
+			}
+			if token == nil {
+				t.Fatal("Authenticate rejected the token")
+			}
+
+			if token.ID != jwtTokenPrefix+"school-app" || token.ExpiresAt == nil {
+				t.Errorf("token = %+v", token)
+			}
+			if strings.Join(token.Permissions, " ") != strings.Join(tt.permissions, " ") {
+				t.Errorf("Permissions = %v, want %v", token.Permissions, tt.permissions)
+			}
+		})
+	}
+}
+
+func TestJWTServiceKeyRotation(t *testing.T) {
+	current := newJWTSigner(t, "k1")
+	service, err := NewJWTService(jwtConfig(current))
+	if err != nil {
+		t.Fatalf("NewJWTService: %v", err)
+	}
+
+	// The issuer starts signing with a new key it has just published
+	next := newJWTSigner(t, "k2")
+	current.publish(t, current, next)
+	claims := func() jwt.MapClaims { return jwt.MapClaims{"permissions": "upload", "tags": "*"} }
+
+	// An unknown key ID refetches the JWKS at most once a minute
+	if service.Authenticate(next.sign(t, claims())) != nil {
+		t.Fatal("JWKS refetched right after it was loaded")
+	}
+
+	service.mu.Lock()
+	service.fetched = time.Now().Add(-2 * jwksRefetchInterval)
+	service.mu.Unlock()
+
+	if service.Authenticate(next.sign(t, claims())) == nil {
+		t.Fatal("unknown key ID did not refetch the JWKS")
+	}
+	if service.Authenticate(current.sign(t, claims())) == nil {
+		t.Error("previous key dropped while still published")
+	}
+
+	// A retired key stops working at the next refresh
+	current.publish(t, next)
+	if err := service.refresh(); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if service.Authenticate(current.sign(t, claims())) != nil {
+		t.Error("retired key still accepted")
+	}
+
+	// A JWKS that became unusable keeps the loaded keys
+	if err := os.WriteFile(current.file, []byte(`{"keys":[]}`), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := service.refresh(); err == nil {
+		t.Error("refresh accepted a JWKS without keys")
+	}
+	if service.Authenticate(next.sign(t, claims())) == nil {
+		t.Error("keys dropped after a failed refresh")
+	}
+}
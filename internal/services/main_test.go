@@ -0,0 +1,15 @@
+package services
+
+import (
+	"os"
+	"testing"
+
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Initialize(logger.Config{Level: "error", Output: "console"}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitResult describes the state of a bucket after a request
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+// rateLimitBucket is a token bucket of one client
+type rateLimitBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimitService keeps the token buckets of rate limited clients
+type RateLimitService struct {
+	config  *config.Config
+	mu      sync.Mutex
+	buckets map[string]*rateLimitBucket
+	stop    chan struct{}
+}
+
+// NewRateLimitService creates a new rate limiter
+func NewRateLimitService(cfg *config.Config) *RateLimitService {
+	return &RateLimitService{
+		config:  cfg,
+		buckets: map[string]*rateLimitBucket{},
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start launches the periodic removal of idle buckets
+func (s *RateLimitService) Start() {
+	go func() {
+		ticker := time.NewTicker(s.config.RateLimit.IdleTimeout)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.cleanup()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic removal of idle buckets
+func (s *RateLimitService) Stop() {
+	close(s.stop)
+}
+
+// Allow takes a request from a bucket
+func (s *RateLimitService) Allow(key string, rule config.RateLimitRule) *RateLimitResult {
+	limiter := s.bucket(key, rule)
+
+	now := time.Now()
+	allowed := limiter.AllowN(now, 1)
+	return bucketState(limiter, rule, now, allowed)
+}
+
+// Exhausted reports whether a byte budget is used up, and if so how long
+// until it has room again
+func (s *RateLimitService) Exhausted(key string, rule config.RateLimitRule) (bool, time.Duration) {
+	limiter := s.bucket(key, rule)
+
+	tokens := limiter.TokensAt(time.Now())
+	if tokens > 0 {
+		return false, 0
+	}
+	return true, time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+}
+
+// Consume takes bytes from a byte budget after they were transferred. The
+// budget may go into debt, which later requests have to wait out.
+func (s *RateLimitService) Consume(key string, rule config.RateLimitRule, n int64) {
+	limiter := s.bucket(key, rule)
+
+	now := time.Now()
+	for n > 0 {
+		chunk := min(n, int64(rule.Burst))
+		limiter.ReserveN(now, int(chunk))
+		n -= chunk
+	}
+}
+
+// bucket returns the bucket for a key, creating it full
+func (s *RateLimitService) bucket(key string, rule config.RateLimitRule) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{
+			limiter: rate.NewLimiter(rate.Limit(rule.Rate), rule.Burst),
+		}
+		s.buckets[key] = bucket
+	}
+	bucket.lastSeen = time.Now()
+	return bucket.limiter
+}
+
+// cleanup removes buckets that were idle long enough to have refilled, so
+// forgetting them does not forgive any debt
+func (s *RateLimitService) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.lastSeen) < s.config.RateLimit.IdleTimeout {
+			continue
+		}
+		if bucket.limiter.TokensAt(now) >= float64(bucket.limiter.Burst()) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// bucketState describes a bucket for the RateLimit headers
+func bucketState(limiter *rate.Limiter, rule config.RateLimitRule, now time.Time, allowed bool) *RateLimitResult {
+	tokens := limiter.TokensAt(now)
+
+	result := &RateLimitResult{
+		Allowed:   allowed,
+		Limit:     rule.Burst,
+		Remaining: max(int(math.Floor(tokens)), 0),
+		Reset:     time.Duration((float64(rule.Burst) - tokens) / rule.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		// Time until the next request fits
+		result.Reset = time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+)
+
+func TestRateLimitAllow(t *testing.T) {
+	limits := NewRateLimitService(&config.Config{})
+	rule := config.RateLimitRule{Rate: 1, Burst: 3}
+
+	tests := []struct {
+		key       string
+		allowed   bool
+		remaining int
+	}{
+		{key: "api:ip:10.0.0.1", allowed: true, remaining: 2},
+		{key: "api:ip:10.0.0.1", allowed: true, remaining: 1},
+		{key: "api:ip:10.0.0.1", allowed: true, remaining: 0},
+		{key: "api:ip:10.0.0.1", allowed: false, remaining: 0},
+		{key: "api:ip:10.0.0.2", allowed: true, remaining: 2},
+		{key: "upload:ip:10.0.0.1", allowed: true, remaining: 2},
+	}
+
+	for i, tt := range tests {
+		result := limits.Allow(tt.key, rule)
+		if result.Allowed != tt.allowed || result.Remaining != tt.remaining || result.Limit != 3 {
+			t.Errorf("request %d to %s = %+v", i, tt.key, result)
+		}
+		if !result.Allowed && (result.Reset <= 0 || result.Reset > time.Second) {
+			t.Errorf("request %d to %s: Reset = %v, want up to 1s", i, tt.key, result.Reset)
+		}
+	}
+}
+
+func TestRateLimitByteBudget(t *testing.T) {
+	limits := NewRateLimitService(&config.Config{})
+	rule := config.RateLimitRule{Rate: 100, Burst: 100}
+	key := "upload_bytes:token:school"
+
+	if exhausted, _ := limits.Exhausted(key, rule); exhausted {
+		t.Fatal("new budget is exhausted")
+	}
+
+	// A transfer larger than the burst leaves the budget in debt
+	limits.Consume(key, rule, 250)
+	exhausted, wait := limits.Exhausted(key, rule)
+	if !exhausted || wait < 1400*time.Millisecond || wait > 1600*time.Millisecond {
+		t.Errorf("Exhausted after debt = %v, %v, want about 1.5s", exhausted, wait)
+	}
+
+	if exhausted, _ := limits.Exhausted("upload_bytes:token:other", rule); exhausted {
+		t.Error("debt shared between clients")
+	}
+}
+
+func TestRateLimitCleanup(t *testing.T) {
+	limits := NewRateLimitService(&config.Config{
+		RateLimit: config.RateLimitConfig{IdleTimeout: time.Minute},
+	})
+
+	limits.Allow("refilled", config.RateLimitRule{Rate: 1000, Burst: 1})
+	limits.Consume("in-debt", config.RateLimitRule{Rate: 1, Burst: 10}, 20)
+	limits.Allow("active", config.RateLimitRule{Rate: 1000, Burst: 1})
+	time.Sleep(10 * time.Millisecond)
+
+	limits.mu.Lock()
+	for _, key := range []string{"refilled", "in-debt"} {
+		limits.buckets[key].lastSeen = time.Now().Add(-2 * time.Minute)
+	}
+	limits.mu.Unlock()
+
+	limits.cleanup()
+
+	// Only idle buckets that have refilled are forgotten
+	for key, want := range map[string]bool{"refilled": false, "in-debt": true, "active": true} {
+		if _, ok := limits.buckets[key]; ok != want {
+			t.Errorf("bucket %s kept = %v, want %v", key, ok, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// RecoveryReport summarises the changes made by StorageService.Recover
+type RecoveryReport struct {
+	TempFiles   int
+	OrphanFiles int
+	OrphanBlobs int
+	OrphanMeta  int
+}
+
+// Recover restores consistency between file content and metadata sidecars
+// after a crash, covering live files, the trash and prior versions. It
+// removes leftover temporary files, content without a sidecar, and sidecars
+// that are unreadable or whose content is missing. Objects younger than
+// grace are left alone, as they may belong to an upload still in progress on
+// another instance sharing the storage.
+func (s *StorageService) Recover(grace time.Duration) (*RecoveryReport, error) {
+	cutoff := time.Now().Add(-grace)
+	report := &RecoveryReport{}
+
+	var temps []ObjectInfo
+	var metaKeys, versionKeys []string
+	contents := map[string]ObjectInfo{}
+	blobs := map[string]ObjectInfo{}
+	pending := map[string]bool{}
+
+	err := s.backend.Walk("", func(info ObjectInfo) error {
+		switch {
+		case isTempKey(info.Key):
+			temps = append(temps, info)
+		case strings.HasPrefix(info.Key, blobRefsPrefix):
+			// A young reference may belong to an upload whose sidecar is not
+			// written yet
+			if digest, _, ok := parseBlobRefKey(info.Key); ok && !info.ModTime.Before(cutoff) {
+				pending[models.BlobKey(digest)] = true
+			}
+		case strings.HasPrefix(info.Key, models.BlobPrefix):
+			blobs[path.Base(info.Key)] = info
+		case strings.HasPrefix(info.Key, models.VersionPrefix):
+			if strings.HasSuffix(info.Key, models.MetaSuffix) {
+				versionKeys = append(versionKeys, info.Key)
+			}
+		case isInternalKey(strings.TrimPrefix(info.Key, models.TrashPrefix)):
+			// Variants, partial uploads and other server-managed data
+		case strings.HasSuffix(info.Key, models.MetaSuffix):
+			metaKeys = append(metaKeys, info.Key)
+		default:
+			contents[info.Key] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Leftovers of interrupted writes
+	for _, info := range temps {
+		if info.ModTime.Before(cutoff) && s.recoverDelete(info.Key, "Removed temporary file") {
+			report.TempFiles++
+		}
+	}
+
+	live := map[string]bool{}
+	for _, key := range metaKeys {
+		live[key] = true
+	}
+
+	// Sidecars must be readable and point at existing content. A trashed
+	// sidecar is stale when the file is also live, which happens when a move
+	// to or from the trash was interrupted.
+	var metas []*models.FileMeta
+	referenced := map[string]bool{}
+	for _, key := range metaKeys {
+		meta, err := s.loadMetaKey(key)
+		if err == nil && !(meta.Trashed() && live[meta.FileKey()+models.MetaSuffix]) {
+			_, hasBlob := blobs[meta.Digest]
+			_, hasContent := contents[meta.ContentKey()]
+			if (meta.Digest != "" && hasBlob) || (meta.Digest == "" && hasContent) {
+				metas = append(metas, meta)
+				referenced[meta.ContentKey()] = true
+				continue
+			}
+		}
+
+		if s.recoverDelete(key, "Removed metadata without valid content") {
+			report.OrphanMeta++
+		}
+	}
+
+	// Prior versions must refer to existing content of a live or trashed file
+	files := map[string]bool{}
+	for _, meta := range metas {
+		files[meta.FileKey()] = true
+	}
+	for _, key := range versionKeys {
+		meta, err := s.loadMetaKey(key)
+		if err == nil && files[meta.FileKey()] {
+			if _, hasBlob := blobs[meta.Digest]; hasBlob {
+				metas = append(metas, meta)
+				referenced[meta.ContentKey()] = true
+				continue
+			}
+		}
+
+		if s.recoverDelete(key, "Removed version without valid content") {
+			report.OrphanMeta++
+		}
+	}
+
+	// Content that no sidecar refers to
+	for key, info := range contents {
+		if !referenced[key] && info.ModTime.Before(cutoff) && s.recoverDelete(key, "Removed file without metadata") {
+			report.OrphanFiles++
+		}
+	}
+
+	// Blobs that no sidecar refers to
+	for _, info := range blobs {
+		if !referenced[info.Key] && !pending[info.Key] && info.ModTime.Before(cutoff) && s.recoverDelete(info.Key, "Removed unreferenced blob") {
+			report.OrphanBlobs++
+		}
+	}
+
+	if _, err := s.rebuildBlobRefs(metas, cutoff); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// recoverDelete removes an object found inconsistent by Recover
+func (s *StorageService) recoverDelete(key, message string) bool {
+	if err := s.backend.Delete(key); err != nil {
+		logger.Warnf("Failed to remove %s: %v", key, err)
+		return false
+	}
+
+	logger.WithField("key", key).Warn(message)
+	return true
+}
+
+// isTempKey reports whether a key is a temporary file of an interrupted write
+func isTempKey(key string) bool {
+	if strings.HasPrefix(key, blobTempPrefix) {
+		return true
+	}
+
+	name := path.Base(key)
+	return strings.HasPrefix(name, ".") && strings.Contains(name, utils.TempFileMarker)
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// InfectedError is returned when the antivirus scan finds malware in an
+// upload
+type InfectedError struct {
+	Signature string
+}
+
+// Error describes the detected malware
+func (e *InfectedError) Error() string {
+	return fmt.Sprintf("file rejected: malware detected (%s)", e.Signature)
+}
+
+// ScanService scans content with a clamd-compatible daemon over TCP or a
+// Unix socket
+type ScanService struct {
+	config  *config.Config
+	network string
+	address string
+}
+
+// NewScanService creates a new scanner for the configured daemon
+func NewScanService(cfg *config.Config) (*ScanService, error) {
+	network, address, err := cfg.Security.Antivirus.Endpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScanService{
+		config:  cfg,
+		network: network,
+		address: address,
+	}, nil
+}
+
+// Scan streams content to the daemon with the INSTREAM command. Infected
+// content is reported through the result, not as an error.
+func (s *ScanService) Scan(content io.Reader) (*models.ScanResult, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := s.write(conn, []byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	// Chunks are prefixed with their length; an empty chunk ends the stream
+	chunk := make([]byte, 4+s.config.Security.Antivirus.ChunkSize)
+	for {
+		n, readErr := content.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if err := s.write(conn, chunk[:4+n]); err != nil {
+				// The daemon closes the connection when the stream exceeds
+				// its size limit; its reply tells why
+				if reply, replyErr := s.reply(conn); replyErr == nil {
+					return nil, fmt.Errorf("scan failed: %s", reply)
+				}
+				return nil, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	if err := s.write(conn, []byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	reply, err := s.reply(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &models.ScanResult{ScannedAt: time.Now()}
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		result.Status = models.ScanClean
+	case strings.HasSuffix(status, " FOUND"):
+		result.Status = models.ScanInfected
+		result.Signature = strings.TrimSuffix(status, " FOUND")
+	default:
+		return nil, fmt.Errorf("scan failed: %s", reply)
+	}
+
+	// The engine version is informational; a scan does not fail without it
+	if engine, err := s.Version(); err == nil {
+		result.Engine = engine
+	} else {
+		logger.WithField("error", err).Warn("Failed to read antivirus engine version")
+	}
+
+	return result, nil
+}
+
+// Version returns the engine and signature database version of the daemon
+func (s *ScanService) Version() (string, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err := s.write(conn, []byte("zVERSION\x00")); err != nil {
+		return "", err
+	}
+
+	return s.reply(conn)
+}
+
+// dial connects to the daemon
+func (s *ScanService) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.config.Security.Antivirus.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to antivirus daemon: %w", err)
+	}
+	return conn, nil
+}
+
+// write sends data to the daemon. The timeout applies to every write, so a
+// slow upload does not fail a scan that keeps making progress.
+func (s *ScanService) write(conn net.Conn, data []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(s.config.Security.Antivirus.Timeout))
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("failed to send to antivirus daemon: %w", err)
+	}
+	return nil
+}
+
+// reply reads a null-terminated reply from the daemon
+func (s *ScanService) reply(conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(s.config.Security.Antivirus.Timeout))
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", fmt.Errorf("failed to read antivirus reply: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
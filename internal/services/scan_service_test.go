@@ -0,0 +1,273 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers the INSTREAM and VERSION commands of clamd. reply returns
+// the answer for the scanned content; an empty answer drops the connection.
+type fakeClamd struct {
+	listener net.Listener
+	reply    func(content []byte) string
+}
+
+// newFakeClamd starts a fake daemon on a free local port
+func newFakeClamd(t *testing.T, reply func(content []byte) string) *fakeClamd {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	f := &fakeClamd{listener: listener, reply: reply}
+	go f.serve()
+	return f
+}
+
+// detectEicar reports the EICAR test file as infected
+func detectEicar(content []byte) string {
+	if bytes.Contains(content, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func (f *fakeClamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch command {
+	case "zVERSION\x00":
+		conn.Write([]byte("ClamAV 1.4.1/27400/Thu Oct 15 08:00:00 2026\x00"))
+
+	case "zINSTREAM\x00":
+		var content []byte
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			content = append(content, chunk...)
+		}
+
+		if reply := f.reply(content); reply != "" {
+			conn.Write([]byte(reply + "\x00"))
+		}
+	}
+}
+
+// scanConfig returns a configuration scanning with the daemon at addr in
+// small chunks, so that content spans several of them
+func scanConfig(t *testing.T, addr string) *config.Config {
+	return &config.Config{
+		Storage: config.StorageConfig{
+			BasePath:          t.TempDir(),
+			MaxFileSize:       1 << 20,
+			AllowedExtensions: []string{"txt"},
+		},
+		Security: config.SecurityConfig{
+			Antivirus: config.AntivirusConfig{
+				Enabled:   true,
+				Address:   "tcp://" + addr,
+				Timeout:   5 * time.Second,
+				ChunkSize: 16,
+			},
+		},
+	}
+}
+
+func TestScanService(t *testing.T) {
+	tests := []struct {
+		name      string
+		reply     func(content []byte) string
+		content   string
+		status    string
+		signature string
+		err       string
+	}{
+		{
+			name:    "clean",
+			reply:   detectEicar,
+			content: "just some harmless text that spans several chunks",
+			status:  models.ScanClean,
+		},
+		{
+			name:      "infected",
+			reply:     detectEicar,
+			content:   eicar,
+			status:    models.ScanInfected,
+			signature: "Eicar-Test-Signature",
+		},
+		{
+			name:    "error reply",
+			reply:   func([]byte) string { return "INSTREAM size limit exceeded. ERROR" },
+			content: "too large",
+			err:     "scan failed: INSTREAM size limit exceeded. ERROR",
+		},
+		{
+			name:    "dropped connection",
+			reply:   func([]byte) string { return "" },
+			content: "anything",
+			err:     "failed to read antivirus reply",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daemon := newFakeClamd(t, tt.reply)
+			scanner, err := NewScanService(scanConfig(t, daemon.listener.Addr().String()))
+			if err != nil {
+				t.Fatalf("NewScanService: %v", err)
+			}
+
+			result, err := scanner.Scan(strings.NewReader(tt.content))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Scan error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Scan: %v", err)
+			}
+
+			if result.Status != tt.status || result.Signature != tt.signature {
+				t.Errorf("Scan = %s %q, want %s %q", result.Status, result.Signature, tt.status, tt.signature)
+			}
+			if !strings.HasPrefix(result.Engine, "ClamAV") {
+				t.Errorf("Engine = %q, want the daemon version", result.Engine)
+			}
+		})
+	}
+}
+
+func TestScanServiceUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	scanner, err := NewScanService(scanConfig(t, addr))
+	if err != nil {
+		t.Fatalf("NewScanService: %v", err)
+	}
+
+	if _, err := scanner.Scan(strings.NewReader("content")); err == nil {
+		t.Fatal("Scan succeeded without a daemon")
+	}
+}
+
+func TestSaveContentRejectsInfected(t *testing.T) {
+	for _, quarantine := range []bool{false, true} {
+		name := "delete"
+		if quarantine {
+			name = "quarantine"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			daemon := newFakeClamd(t, detectEicar)
+			cfg := scanConfig(t, daemon.listener.Addr().String())
+			cfg.Security.Antivirus.Quarantine = quarantine
+
+			scanner, err := NewScanService(cfg)
+			if err != nil {
+				t.Fatalf("NewScanService: %v", err)
+			}
+
+			backend := NewLocalBackend(cfg.Storage.BasePath)
+			fs := NewFileService(cfg, NewStorageService(cfg, backend), nil, nil, scanner)
+
+			_, err = fs.Upload(&UploadRequest{
+				Filename: "eicar.txt",
+				Size:     -1,
+				Content:  strings.NewReader(eicar),
+				Tag:      "docs",
+			})
+
+			var infected *InfectedError
+			if !errors.As(err, &infected) {
+				t.Fatalf("Upload error = %v, want an InfectedError", err)
+			}
+			if infected.Signature != "Eicar-Test-Signature" {
+				t.Errorf("Signature = %q", infected.Signature)
+			}
+
+			// Nothing but the quarantined copy may be left behind: no sidecar,
+			// no blob and no blob reference
+			err = backend.Walk("", func(info ObjectInfo) error {
+				if !quarantine || !strings.HasPrefix(info.Key, models.QuarantinePrefix) {
+					t.Errorf("object left behind: %s", info.Key)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Walk: %v", err)
+			}
+
+			if quarantine {
+				found := false
+				backend.Walk(models.QuarantinePrefix, func(info ObjectInfo) error {
+					found = found || strings.HasSuffix(info.Key, models.MetaSuffix)
+					return nil
+				})
+				if !found {
+					t.Error("infected upload was not quarantined")
+				}
+			}
+
+			// A clean upload through the same service is stored and marked clean
+			response, err := fs.Upload(&UploadRequest{
+				Filename: "notes.txt",
+				Size:     -1,
+				Content:  strings.NewReader("harmless notes"),
+				Tag:      "docs",
+			})
+			if err != nil {
+				t.Fatalf("clean Upload: %v", err)
+			}
+			if response.Scan == nil || response.Scan.Status != models.ScanClean {
+				t.Errorf("clean Upload scan = %+v", response.Scan)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Scrub problems
+const (
+	ScrubMissing = "missing"
+	ScrubCorrupt = "corrupt"
+)
+
+// Scrub bucket:
+//
+//	scrub  "report" -> ScrubReport JSON of the last completed pass
+var (
+	scrubBucket    = []byte("scrub")
+	scrubReportKey = []byte("report")
+)
+
+// ScrubIssue describes stored content that failed verification
+type ScrubIssue struct {
+	Digest     string    `json:"digest"`
+	Problem    string    `json:"problem"`
+	Files      []string  `json:"files"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// ScrubReport summarises the last scrub pass
+type ScrubReport struct {
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Checked    int          `json:"checked"`
+	Issues     []ScrubIssue `json:"issues"`
+}
+
+// ScrubService periodically re-hashes stored content and compares it with
+// the digests recorded at upload time to detect corruption and lost data
+type ScrubService struct {
+	config         *config.Config
+	storageService *StorageService
+	db             *bolt.DB
+
+	mu      sync.RWMutex
+	report  *ScrubReport
+	running bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewScrubService creates a new integrity scrubber
+func NewScrubService(cfg *config.Config, storage *StorageService, db *bolt.DB) (*ScrubService, error) {
+	var report *ScrubReport
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(scrubBucket)
+		if err != nil {
+			return err
+		}
+
+		if data := bucket.Get(scrubReportKey); data != nil {
+			report = &ScrubReport{}
+			return json.Unmarshal(data, report)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize scrubber: %w", err)
+	}
+
+	return &ScrubService{
+		config:         cfg,
+		storageService: storage,
+		db:             db,
+		report:         report,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}, nil
+}
+
+// Report returns the result of the last completed pass, or nil if none ran
+// yet, and whether a pass is currently running
+func (s *ScrubService) Report() (*ScrubReport, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.report, s.running
+}
+
+// Start launches the periodic scrub; the schedule carries over restarts
+func (s *ScrubService) Start() {
+	go func() {
+		defer close(s.done)
+
+		// Give the server time to settle before the first pass
+		delay := time.Minute
+		if report, _ := s.Report(); report != nil {
+			delay = max(delay, time.Until(report.FinishedAt.Add(s.config.Storage.Scrub.Interval)))
+		}
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-timer.C:
+				s.Run()
+				timer.Reset(s.config.Storage.Scrub.Interval)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the scrubber, interrupting a pass in progress
+func (s *ScrubService) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// Run verifies all referenced content once
+func (s *ScrubService) Run() {
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	report := &ScrubReport{
+		StartedAt: time.Now(),
+		Issues:    []ScrubIssue{},
+	}
+
+	digests, err := s.storageService.blobDigests()
+	if err != nil {
+		logger.Warnf("Failed to list blobs for scrubbing: %v", err)
+		return
+	}
+
+	logger.Infof("Integrity scrub started for %d blobs", len(digests))
+
+	for _, digest := range digests {
+		select {
+		case <-s.stop:
+			logger.Info("Integrity scrub interrupted")
+			return
+		default:
+		}
+
+		problem, err := s.verify(digest)
+		if err != nil {
+			logger.Warnf("Failed to verify blob %s: %v", digest, err)
+			continue
+		}
+		report.Checked++
+
+		if problem == "" {
+			continue
+		}
+
+		// Content released while the scrub was running is not a problem
+		files, err := s.storageService.blobRefs(digest)
+		if err != nil || len(files) == 0 {
+			continue
+		}
+
+		logger.WithFields(logrus.Fields{
+			"digest":  digest,
+			"problem": problem,
+			"files":   files,
+		}).Error("Integrity scrub found damaged content")
+
+		report.Issues = append(report.Issues, ScrubIssue{
+			Digest:     digest,
+			Problem:    problem,
+			Files:      files,
+			DetectedAt: time.Now(),
+		})
+	}
+
+	report.FinishedAt = time.Now()
+	s.save(report)
+
+	logger.WithFields(logrus.Fields{
+		"checked": report.Checked,
+		"issues":  len(report.Issues),
+	}).Info("Integrity scrub finished")
+}
+
+// verify re-hashes a blob, returning the problem found if any
+func (s *ScrubService) verify(digest string) (string, error) {
+	reader, _, err := s.storageService.backend.Get(models.BlobKey(digest))
+	if errors.Is(err, ErrObjectNotFound) {
+		return ScrubMissing, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != digest {
+		return ScrubCorrupt, nil
+	}
+
+	return "", nil
+}
+
+// save publishes and persists a completed report
+func (s *ScrubService) save(report *ScrubReport) {
+	s.mu.Lock()
+	s.report = report
+	s.mu.Unlock()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		logger.Warnf("Failed to marshal scrub report: %v", err)
+		return
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(scrubBucket).Put(scrubReportKey, data)
+	})
+	if err != nil {
+		logger.Warnf("Failed to save scrub report: %v", err)
+	}
+}
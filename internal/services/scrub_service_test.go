@@ -0,0 +1,74 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+)
+
+func TestScrub(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		fs := newTestFileService(t, backend, false)
+		storage := fs.storageService
+		db := openTestDB(t)
+
+		scrub, err := NewScrubService(fs.config, storage, db)
+		if err != nil {
+			t.Fatalf("NewScrubService: %v", err)
+		}
+		if report, _ := scrub.Report(); report != nil {
+			t.Fatalf("Report before the first pass = %+v", report)
+		}
+
+		uploadText(t, fs, "intact.txt", "intact content")
+		corrupt := uploadText(t, fs, "corrupt.txt", "corrupt content")
+		missing := uploadText(t, fs, "missing.txt", "missing content")
+
+		// meta returns the metadata of a file
+		meta := func(fileID string) *models.FileMeta {
+			meta, err := storage.LoadMeta("docs", fileID)
+			if err != nil {
+				t.Fatalf("LoadMeta: %v", err)
+			}
+			return meta
+		}
+		corruptMeta, missingMeta := meta(corrupt), meta(missing)
+
+		if _, err := backend.Put(models.BlobKey(corruptMeta.Digest), strings.NewReader("c0rrupt content")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if err := backend.Delete(models.BlobKey(missingMeta.Digest)); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+
+		scrub.Run()
+
+		report, running := scrub.Report()
+		if report == nil || running {
+			t.Fatalf("Report = %+v, running %v", report, running)
+		}
+		if report.Checked != 3 || len(report.Issues) != 2 {
+			t.Fatalf("Report = %+v", report)
+		}
+
+		want := map[string]string{
+			corruptMeta.Digest: ScrubCorrupt + " docs/" + corrupt,
+			missingMeta.Digest: ScrubMissing + " docs/" + missing,
+		}
+		for _, issue := range report.Issues {
+			if got := issue.Problem + " " + strings.Join(issue.Files, ","); got != want[issue.Digest] {
+				t.Errorf("issue for %s = %q, want %q", issue.Digest, got, want[issue.Digest])
+			}
+		}
+
+		// The last report survives a restart
+		restarted, err := NewScrubService(fs.config, storage, db)
+		if err != nil {
+			t.Fatalf("NewScrubService: %v", err)
+		}
+		if saved, _ := restarted.Report(); saved == nil || len(saved.Issues) != 2 {
+			t.Errorf("Report after restart = %+v", saved)
+		}
+	})
+}
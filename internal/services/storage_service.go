@@ -1,11 +1,13 @@
 package services
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/maarifnu/cdn-fileserver/internal/config"
 	"github.com/maarifnu/cdn-fileserver/internal/models"
@@ -15,93 +17,213 @@ import (
 
 // StorageService handles file storage operations
 type StorageService struct {
-	config *config.Config
+	config  *config.Config
+	backend Backend
+	blobMu  sync.Mutex
 }
 
 // NewStorageService creates a new storage service
-func NewStorageService(cfg *config.Config) *StorageService {
+func NewStorageService(cfg *config.Config, backend Backend) *StorageService {
 	return &StorageService{
-		config: cfg,
+		config:  cfg,
+		backend: backend,
 	}
 }
 
-// SaveFile saves a file to storage
-func (s *StorageService) SaveFile(tag, fileID string, src io.Reader) error {
-	// Create directory if it doesn't exist
-	dirPath := filepath.Join(s.config.Storage.BasePath, tag)
-	if err := utils.CreateDirectory(dirPath); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+// Driver returns the name of the active storage driver
+func (s *StorageService) Driver() string {
+	return s.backend.Name()
+}
+
+// SaveFile stores file content in the shared content store, records the file
+// version as a reference to it and sets its digest. It returns the size of
+// the content.
+func (s *StorageService) SaveFile(meta *models.FileMeta, src io.Reader) (int64, error) {
+	digest, size, err := s.putBlob(src, meta.RefKey())
+	if err != nil {
+		return 0, fmt.Errorf("failed to save file: %w", err)
 	}
 
-	// Create destination file
-	filePath := filepath.Join(dirPath, fileID)
-	dst, err := os.Create(filePath)
+	meta.Digest = digest
+	return size, nil
+}
+
+// OpenFile opens the content of a stored file for reading
+func (s *StorageService) OpenFile(meta *models.FileMeta) (io.ReadCloser, *ObjectInfo, error) {
+	reader, info, err := s.backend.Get(meta.ContentKey())
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil, fmt.Errorf("file not found")
+		}
+		return nil, nil, err
 	}
-	defer dst.Close()
 
-	// Copy file content
-	if _, err := io.Copy(dst, src); err != nil {
-		// Clean up on error
-		os.Remove(filePath)
-		return fmt.Errorf("failed to save file: %w", err)
+	return reader, info, nil
+}
+
+// DeleteFile deletes the content of a file from storage. Shared content is
+// only removed once no other file refers to it.
+func (s *StorageService) DeleteFile(meta *models.FileMeta) error {
+	if meta.Digest != "" {
+		if err := s.releaseBlob(meta.Digest, meta.RefKey()); err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+		return nil
 	}
 
-	// Set file permissions
-	if err := os.Chmod(filePath, 0644); err != nil {
-		logger.Warnf("Failed to set file permissions: %v", err)
+	if err := s.backend.Delete(meta.ContentKey()); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
 	}
 
 	return nil
 }
 
-// GetFile retrieves a file from storage
-func (s *StorageService) GetFile(tag, fileID string) (string, error) {
-	filePath := filepath.Join(s.config.Storage.BasePath, tag, fileID)
+// QuarantineFile keeps a copy of the content and metadata of a file under
+// the quarantine prefix, where it is never served
+func (s *StorageService) QuarantineFile(meta *models.FileMeta) error {
+	reader, _, err := s.backend.Get(meta.ContentKey())
+	if err != nil {
+		return fmt.Errorf("failed to quarantine file: %w", err)
+	}
+	defer reader.Close()
 
-	if !utils.FileExists(filePath) {
-		return "", fmt.Errorf("file not found")
+	key := models.QuarantinePrefix + meta.RefKey()
+	if _, err := s.backend.Put(key, reader); err != nil {
+		return fmt.Errorf("failed to quarantine file: %w", err)
 	}
 
-	return filePath, nil
+	return s.saveMetaKey(key+models.MetaSuffix, meta)
 }
 
-// DeleteFile deletes a file from storage
-func (s *StorageService) DeleteFile(tag, fileID string) error {
-	filePath := filepath.Join(s.config.Storage.BasePath, tag, fileID)
+// TrashFile moves a file to the trash. Shared content stays where it is and
+// keeps its reference until the file is purged. The trashed sidecar is
+// written first, so an interrupted move leaves a file that startup recovery
+// resolves to either the live or the trashed copy.
+func (s *StorageService) TrashFile(meta *models.FileMeta, deletedBy string) error {
+	liveMeta := meta.MetaKey()
+	liveContent := meta.ContentKey()
 
-	if err := utils.DeleteFile(filePath); err != nil {
-		return fmt.Errorf("failed to delete file: %w", err)
+	now := time.Now()
+	meta.DeletedAt = &now
+	meta.DeletedBy = deletedBy
+
+	if err := s.SaveMeta(meta); err != nil {
+		return err
+	}
+
+	if meta.Digest == "" {
+		if err := s.backend.Rename(liveContent, meta.ContentKey()); err != nil {
+			s.backend.Delete(meta.MetaKey())
+			return fmt.Errorf("failed to move file to trash: %w", err)
+		}
+	}
+
+	if err := s.backend.Delete(liveMeta); err != nil {
+		return fmt.Errorf("failed to delete metadata file: %w", err)
 	}
 
 	return nil
 }
 
-// ListFiles lists all files in storage with optional filters
-func (s *StorageService) ListFiles(filterTag string, filterPublic *bool, search string) ([]*models.FileMeta, error) {
-	var files []*models.FileMeta
+// RestoreFile moves a file out of the trash, in the reverse order of TrashFile
+func (s *StorageService) RestoreFile(meta *models.FileMeta) error {
+	if s.FileExists(meta.Tag, meta.FileID) {
+		return fmt.Errorf("file already exists")
+	}
 
-	// Walk through storage directory
-	err := filepath.Walk(s.config.Storage.BasePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	trashMeta := meta.MetaKey()
+	trashContent := meta.ContentKey()
+
+	meta.DeletedAt = nil
+	meta.DeletedBy = ""
+
+	if err := s.SaveMeta(meta); err != nil {
+		return err
+	}
+
+	if meta.Digest == "" {
+		if err := s.backend.Rename(trashContent, meta.ContentKey()); err != nil {
+			s.backend.Delete(meta.MetaKey())
+			return fmt.Errorf("failed to restore file: %w", err)
 		}
+	}
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
+	if err := s.backend.Delete(trashMeta); err != nil {
+		return fmt.Errorf("failed to delete metadata file: %w", err)
+	}
+
+	return nil
+}
+
+// SaveMeta writes the metadata sidecar of a file
+func (s *StorageService) SaveMeta(meta *models.FileMeta) error {
+	return s.saveMetaKey(meta.MetaKey(), meta)
+}
+
+// LoadMeta reads the metadata sidecar of a file
+func (s *StorageService) LoadMeta(tag, fileID string) (*models.FileMeta, error) {
+	meta := &models.FileMeta{
+		Tag:    tag,
+		FileID: fileID,
+	}
+
+	return s.loadMetaKey(meta.MetaKey())
+}
+
+// LoadTrashedMeta reads the metadata sidecar of a file in the trash
+func (s *StorageService) LoadTrashedMeta(tag, fileID string) (*models.FileMeta, error) {
+	return s.loadMetaKey(models.TrashPrefix + fileKey(tag, fileID) + models.MetaSuffix)
+}
+
+// DeleteMeta deletes the metadata sidecar of a file
+func (s *StorageService) DeleteMeta(meta *models.FileMeta) error {
+	if err := s.backend.Delete(meta.MetaKey()); err != nil {
+		return fmt.Errorf("failed to delete metadata file: %w", err)
+	}
+
+	return nil
+}
+
+// DeletePrefix deletes every object whose key starts with prefix
+func (s *StorageService) DeletePrefix(prefix string) error {
+	var keys []string
+	err := s.backend.Walk(prefix, func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	for _, key := range keys {
+		if err := s.backend.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete object: %w", err)
 		}
+	}
+
+	return nil
+}
 
+// ListFiles lists all files in storage with optional filters
+func (s *StorageService) ListFiles(filterTag string, filterPublic *bool, search string) ([]*models.FileMeta, error) {
+	var files []*models.FileMeta
+
+	prefix := ""
+	if filterTag != "" {
+		prefix = filterTag + "/"
+	}
+
+	// Walk through storage
+	err := s.backend.Walk(prefix, func(info ObjectInfo) error {
 		// Only process .meta.json files
-		if !strings.HasSuffix(path, ".meta.json") {
+		if !strings.HasSuffix(info.Key, models.MetaSuffix) || isInternalKey(info.Key) {
 			return nil
 		}
 
 		// Load metadata
-		meta, err := models.LoadFromFile(path)
+		meta, err := s.loadMetaKey(info.Key)
 		if err != nil {
-			logger.Warnf("Failed to load metadata from %s: %v", path, err)
+			logger.Warnf("Failed to load metadata from %s: %v", info.Key, err)
 			return nil // Skip this file
 		}
 
@@ -133,42 +255,97 @@ func (s *StorageService) ListFiles(filterTag string, filterPublic *bool, search
 	return files, nil
 }
 
-// GetStorageInfo returns storage statistics
-func (s *StorageService) GetStorageInfo() (map[string]interface{}, error) {
-	totalFiles := 0
-	var totalSize int64
+// ListTrash lists the files in the trash, optionally limited to one tag
+func (s *StorageService) ListTrash(filterTag string) ([]*models.FileMeta, error) {
+	files := []*models.FileMeta{}
 
-	// Walk through storage directory
-	err := filepath.Walk(s.config.Storage.BasePath, func(path string, info os.FileInfo, err error) error {
+	prefix := models.TrashPrefix
+	if filterTag != "" {
+		prefix += filterTag + "/"
+	}
+
+	err := s.backend.Walk(prefix, func(info ObjectInfo) error {
+		if !strings.HasSuffix(info.Key, models.MetaSuffix) || isInternalKey(strings.TrimPrefix(info.Key, models.TrashPrefix)) {
+			return nil
+		}
+
+		meta, err := s.loadMetaKey(info.Key)
 		if err != nil {
-			return err
+			logger.Warnf("Failed to load metadata from %s: %v", info.Key, err)
+			return nil
 		}
 
-		// Skip directories
-		if info.IsDir() {
+		if !meta.Trashed() || (filterTag != "" && meta.Tag != filterTag) {
 			return nil
 		}
 
-		// Skip metadata files
-		if strings.HasSuffix(path, ".meta.json") {
+		files = append(files, meta)
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trash: %w", err)
+	}
+
+	return files, nil
+}
+
+// Stats returns the number of stored files and the bytes they occupy;
+// deduplicated content is counted once
+func (s *StorageService) Stats() (int64, int64, error) {
+	var totalFiles, totalSize int64
+
+	// Walk through storage
+	err := s.backend.Walk("", func(info ObjectInfo) error {
+		// Count shared content, skipping uploads still being written and
+		// reference markers
+		if strings.HasPrefix(info.Key, models.BlobPrefix) {
+			if !strings.HasPrefix(info.Key, blobTempPrefix) && !strings.HasPrefix(info.Key, blobRefsPrefix) {
+				totalSize += info.Size
+			}
+			return nil
+		}
+
+		// Count trashed content stored before deduplication
+		if strings.HasPrefix(info.Key, models.TrashPrefix) {
+			if !strings.HasSuffix(info.Key, models.MetaSuffix) && !isTempKey(info.Key) {
+				totalSize += info.Size
+			}
 			return nil
 		}
 
-		// Skip .gitkeep files
-		if info.Name() == ".gitkeep" {
+		// Skip internal files such as .gitkeep
+		if isInternalKey(info.Key) {
 			return nil
 		}
 
-		totalFiles++
-		totalSize += info.Size()
+		// Every file has exactly one metadata sidecar
+		if strings.HasSuffix(info.Key, models.MetaSuffix) {
+			totalFiles++
+			return nil
+		}
+
+		// Content stored before deduplication
+		totalSize += info.Size
 		return nil
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to get storage info: %w", err)
+		return 0, 0, fmt.Errorf("failed to get storage info: %w", err)
+	}
+
+	return totalFiles, totalSize, nil
+}
+
+// GetStorageInfo returns storage statistics
+func (s *StorageService) GetStorageInfo() (map[string]interface{}, error) {
+	totalFiles, totalSize, err := s.Stats()
+	if err != nil {
+		return nil, err
 	}
 
 	return map[string]interface{}{
+		"driver":      s.backend.Name(),
 		"total_files": totalFiles,
 		"total_size":  utils.FormatFileSize(totalSize),
 	}, nil
@@ -176,6 +353,41 @@ func (s *StorageService) GetStorageInfo() (map[string]interface{}, error) {
 
 // FileExists checks if a file exists
 func (s *StorageService) FileExists(tag, fileID string) bool {
-	filePath := filepath.Join(s.config.Storage.BasePath, tag, fileID)
-	return utils.FileExists(filePath)
+	_, err := s.backend.Stat(fileKey(tag, fileID) + models.MetaSuffix)
+	return err == nil
+}
+
+// saveMetaKey encodes and writes a metadata object
+func (s *StorageService) saveMetaKey(key string, meta *models.FileMeta) error {
+	data, err := meta.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.backend.Put(key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+
+	return nil
+}
+
+// loadMetaKey reads and decodes a metadata object
+func (s *StorageService) loadMetaKey(key string) (*models.FileMeta, error) {
+	reader, _, err := s.backend.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+
+	return models.ParseFileMeta(data)
+}
+
+// fileKey returns the backend key of a stored file
+func fileKey(tag, fileID string) string {
+	return tag + "/" + fileID
 }
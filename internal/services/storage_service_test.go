@@ -0,0 +1,431 @@
+package services
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+)
+
+// newTestFileService returns a file service storing in backend
+func newTestFileService(t *testing.T, backend Backend, trash bool) *FileService {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			BasePath:          t.TempDir(),
+			MaxFileSize:       1 << 20,
+			AllowedExtensions: []string{"txt"},
+			Trash:             config.TrashConfig{Enabled: trash, Retention: time.Hour},
+		},
+	}
+	return NewFileService(cfg, NewStorageService(cfg, backend), nil, nil, nil)
+}
+
+// uploadText uploads content as a text file and returns its ID
+func uploadText(t *testing.T, fs *FileService, filename, content string) string {
+	t.Helper()
+
+	response, err := fs.Upload(&UploadRequest{
+		Filename: filename,
+		Size:     -1,
+		Content:  strings.NewReader(content),
+		Tag:      "docs",
+	})
+	if err != nil {
+		t.Fatalf("Upload(%s): %v", filename, err)
+	}
+	return response.FileID
+}
+
+// downloadText returns the content of a file
+func downloadText(t *testing.T, fs *FileService, fileID string) string {
+	t.Helper()
+
+	_, reader, _, err := fs.Download("docs", fileID)
+	if err != nil {
+		t.Fatalf("Download(%s): %v", fileID, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Download(%s): %v", fileID, err)
+	}
+	return string(data)
+}
+
+// blobKeys returns the stored blobs and reference markers
+func blobKeys(t *testing.T, backend Backend) (blobs, refs []string) {
+	t.Helper()
+
+	for _, key := range walkKeys(t, backend, models.BlobPrefix) {
+		if strings.HasPrefix(key, blobRefsPrefix) {
+			refs = append(refs, key)
+		} else {
+			blobs = append(blobs, key)
+		}
+	}
+	return blobs, refs
+}
+
+func TestStorageDeduplication(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		fs := newTestFileService(t, backend, false)
+
+		first := uploadText(t, fs, "first.txt", "shared content")
+		second := uploadText(t, fs, "second.txt", "shared content")
+
+		blobs, refs := blobKeys(t, backend)
+		if len(blobs) != 1 || len(refs) != 2 {
+			t.Fatalf("after two uploads: blobs %v, refs %v", blobs, refs)
+		}
+
+		// The content stays while another file refers to it
+		if err := fs.Delete("docs", first, "test"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		blobs, refs = blobKeys(t, backend)
+		if len(blobs) != 1 || len(refs) != 1 {
+			t.Fatalf("after one delete: blobs %v, refs %v", blobs, refs)
+		}
+		if got := downloadText(t, fs, second); got != "shared content" {
+			t.Errorf("Download = %q", got)
+		}
+
+		if err := fs.Delete("docs", second, "test"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if keys := walkKeys(t, backend, models.BlobPrefix); len(keys) != 0 {
+			t.Errorf("after both deletes: %v", keys)
+		}
+	})
+}
+
+func TestStorageSharedBlobRefs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		fs := newTestFileService(t, backend, false)
+		storage := fs.storageService
+
+		// Concurrent uploads of the same content share one blob
+		fileIDs := make([]string, 5)
+		errs := make(chan error, len(fileIDs))
+		var wg sync.WaitGroup
+		for i := range fileIDs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				response, err := fs.Upload(&UploadRequest{
+					Filename: "copy.txt",
+					Size:     -1,
+					Content:  strings.NewReader("shared content"),
+					Tag:      "docs",
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				fileIDs[i] = response.FileID
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("Upload: %v", err)
+		}
+
+		blobs, refs := blobKeys(t, backend)
+		if len(blobs) != 1 || len(refs) != len(fileIDs) {
+			t.Fatalf("after concurrent uploads: blobs %v, refs %v", blobs, refs)
+		}
+
+		// References lost, or never recorded by an older version, are
+		// rebuilt from the sidecars
+		for _, key := range refs {
+			if err := backend.Delete(key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+		}
+		if has, err := storage.HasBlobRefs(); err != nil || has {
+			t.Fatalf("HasBlobRefs = %v, %v", has, err)
+		}
+		if count, err := storage.RebuildBlobRefs(); err != nil || count != len(fileIDs) {
+			t.Fatalf("RebuildBlobRefs = %d, %v", count, err)
+		}
+		if _, rebuilt := blobKeys(t, backend); strings.Join(rebuilt, ",") != strings.Join(refs, ",") {
+			t.Fatalf("rebuilt refs %v, want %v", rebuilt, refs)
+		}
+
+		// The last of concurrent deletes removes the content
+		errs = make(chan error, len(fileIDs))
+		for _, fileID := range fileIDs {
+			wg.Add(1)
+			go func(fileID string) {
+				defer wg.Done()
+				if err := fs.Delete("docs", fileID, "test"); err != nil {
+					errs <- err
+				}
+			}(fileID)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("Delete: %v", err)
+		}
+
+		if keys := walkKeys(t, backend, ""); len(keys) != 0 {
+			t.Errorf("after deleting all copies: %v", keys)
+		}
+	})
+}
+
+func TestStorageTrash(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		fs := newTestFileService(t, backend, true)
+
+		fileID := uploadText(t, fs, "notes.txt", "trashed content")
+		if err := fs.Delete("docs", fileID, "test"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+
+		if _, err := fs.GetMeta("docs", fileID); err == nil {
+			t.Error("trashed file is still served")
+		}
+		trashed, total, err := fs.ListTrash(&TrashListRequest{Page: 1, Limit: 10})
+		if err != nil || total != 1 || trashed[0].FileID != fileID {
+			t.Fatalf("ListTrash = %v, %d, %v", trashed, total, err)
+		}
+
+		// Trashed content keeps its reference
+		blobs, refs := blobKeys(t, backend)
+		if len(blobs) != 1 || len(refs) != 1 {
+			t.Fatalf("in trash: blobs %v, refs %v", blobs, refs)
+		}
+
+		if _, err := fs.Restore("docs", fileID); err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		if got := downloadText(t, fs, fileID); got != "trashed content" {
+			t.Errorf("Download after restore = %q", got)
+		}
+
+		if err := fs.Delete("docs", fileID, "test"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := fs.Purge("docs", fileID); err != nil {
+			t.Fatalf("Purge: %v", err)
+		}
+		if keys := walkKeys(t, backend, ""); len(keys) != 0 {
+			t.Errorf("after purge: %v", keys)
+		}
+	})
+}
+
+func TestStorageRecover(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		fs := newTestFileService(t, backend, false)
+		storage := fs.storageService
+
+		kept := uploadText(t, fs, "kept.txt", "kept content")
+
+		// An upload interrupted before its sidecar was written leaves a blob
+		// and a reference that no file refers to
+		orphan := uploadText(t, fs, "orphan.txt", "orphan content")
+		meta, err := storage.LoadMeta("docs", orphan)
+		if err != nil {
+			t.Fatalf("LoadMeta: %v", err)
+		}
+		if err := storage.DeleteMeta(meta); err != nil {
+			t.Fatalf("DeleteMeta: %v", err)
+		}
+
+		// A leftover of an interrupted write
+		if _, err := backend.Put(blobTempPrefix+"interrupted", strings.NewReader("partial")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		// Within the grace period nothing is removed, as the upload may still
+		// be in progress on another instance
+		report, err := storage.Recover(time.Hour)
+		if err != nil {
+			t.Fatalf("Recover: %v", err)
+		}
+		if *report != (RecoveryReport{}) {
+			t.Errorf("Recover within grace = %+v", report)
+		}
+		if blobs, _ := blobKeys(t, backend); len(blobs) != 3 {
+			t.Fatalf("blobs within grace: %v", blobs)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		report, err = storage.Recover(0)
+		if err != nil {
+			t.Fatalf("Recover: %v", err)
+		}
+		if report.OrphanBlobs != 1 || report.TempFiles != 1 {
+			t.Errorf("Recover = %+v", report)
+		}
+
+		blobs, refs := blobKeys(t, backend)
+		if len(blobs) != 1 || len(refs) != 1 || strings.Contains(refs[0], meta.Digest) {
+			t.Errorf("after recovery: blobs %v, refs %v", blobs, refs)
+		}
+		if got := downloadText(t, fs, kept); got != "kept content" {
+			t.Errorf("Download = %q", got)
+		}
+
+		// Lost references of live files are recorded again
+		for _, key := range refs {
+			if err := backend.Delete(key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+		}
+		if _, err := storage.Recover(0); err != nil {
+			t.Fatalf("Recover: %v", err)
+		}
+		if _, refs := blobKeys(t, backend); len(refs) != 1 {
+			t.Errorf("rebuilt refs: %v", refs)
+		}
+	})
+}
+
+// ageObject sets the modification time of a key in a local backend back
+func ageObject(t *testing.T, backend *LocalBackend, key string, age time.Duration) {
+	t.Helper()
+
+	path, err := backend.path(key)
+	if err != nil {
+		t.Fatalf("path: %v", err)
+	}
+	past := time.Now().Add(-age)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+}
+
+func TestStorageRecoverGrace(t *testing.T) {
+	backend := NewLocalBackend(t.TempDir())
+	fs := newTestFileService(t, backend, false)
+	storage := fs.storageService
+
+	// orphan uploads content and removes its sidecar, as an upload
+	// interrupted before the sidecar was written does
+	orphan := func(filename, content string) *models.FileMeta {
+		fileID := uploadText(t, fs, filename, content)
+		meta, err := storage.LoadMeta("docs", fileID)
+		if err != nil {
+			t.Fatalf("LoadMeta: %v", err)
+		}
+		if err := storage.DeleteMeta(meta); err != nil {
+			t.Fatalf("DeleteMeta: %v", err)
+		}
+		return meta
+	}
+
+	kept := uploadText(t, fs, "kept.txt", "kept content")
+	old := orphan("old.txt", "old orphan")
+	recent := orphan("recent.txt", "recent orphan")
+
+	// A blob only referenced by an orphan is removed once it and its
+	// reference are older than the grace period
+	ageObject(t, backend, models.BlobKey(old.Digest), 2*time.Hour)
+	ageObject(t, backend, blobRefKey(old.Digest, old.RefKey()), 2*time.Hour)
+
+	// A blob shared with a live file stays
+	shared := orphan("shared.txt", "kept content")
+	ageObject(t, backend, blobRefKey(shared.Digest, shared.RefKey()), 2*time.Hour)
+
+	for name, age := range map[string]time.Duration{"old": 2 * time.Hour, "recent": 0} {
+		key := blobTempPrefix + name
+		if _, err := backend.Put(key, strings.NewReader("partial")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		ageObject(t, backend, key, age)
+	}
+
+	report, err := storage.Recover(time.Hour)
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if *report != (RecoveryReport{OrphanBlobs: 1, TempFiles: 1}) {
+		t.Errorf("Recover = %+v", report)
+	}
+
+	blobs, refs := blobKeys(t, backend)
+	want := map[string]bool{
+		models.BlobKey(recent.Digest):              true,
+		models.BlobKey(shared.Digest):              true,
+		blobTempPrefix + "recent":                  true,
+		blobRefKey(recent.Digest, recent.RefKey()): true,
+		blobRefKey(shared.Digest, "docs/"+kept):    true,
+	}
+	for _, key := range append(blobs, refs...) {
+		if !want[key] {
+			t.Errorf("left after recovery: %s", key)
+		}
+		delete(want, key)
+	}
+	for key := range want {
+		t.Errorf("removed by recovery: %s", key)
+	}
+
+	if got := downloadText(t, fs, kept); got != "kept content" {
+		t.Errorf("Download = %q", got)
+	}
+}
+
+func TestStoragePurgeSharedContent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		fs := newTestFileService(t, backend, true)
+
+		first := uploadText(t, fs, "first.txt", "shared content")
+		second := uploadText(t, fs, "second.txt", "shared content")
+
+		// The prior version of the second file keeps sharing the content
+		_, err := fs.Replace(&ReplaceRequest{
+			Tag:      "docs",
+			FileID:   second,
+			Filename: "second.txt",
+			Size:     11,
+			Content:  strings.NewReader("new content"),
+		})
+		if err != nil {
+			t.Fatalf("Replace: %v", err)
+		}
+
+		if err := fs.Delete("docs", first, "test"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := fs.Purge("docs", first); err != nil {
+			t.Fatalf("Purge: %v", err)
+		}
+		blobs, refs := blobKeys(t, backend)
+		if len(blobs) != 2 || len(refs) != 2 {
+			t.Fatalf("after purging one file: blobs %v, refs %v", blobs, refs)
+		}
+		if _, reader, _, err := fs.DownloadVersion("docs", second, 1); err != nil {
+			t.Fatalf("DownloadVersion: %v", err)
+		} else {
+			reader.Close()
+		}
+
+		// Files are only purged once the retention has passed
+		if err := fs.Delete("docs", second, "test"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if purged, err := fs.PurgeExpired(); err != nil || purged != 0 {
+			t.Fatalf("PurgeExpired within retention = %d, %v", purged, err)
+		}
+
+		fs.config.Storage.Trash.Retention = 0
+		if purged, err := fs.PurgeExpired(); err != nil || purged != 1 {
+			t.Fatalf("PurgeExpired = %d, %v", purged, err)
+		}
+		if keys := walkKeys(t, backend, ""); len(keys) != 0 {
+			t.Errorf("after purging both files: %v", keys)
+		}
+	})
+}
@@ -0,0 +1,456 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Token sources
+const (
+	TokenSourceConfig = "config"
+	TokenSourceStore  = "store"
+)
+
+// storedTokenPrefix starts the IDs of tokens created through the API, so they
+// never collide with the IDs of tokens from the config file
+const storedTokenPrefix = "tk_"
+
+// Token bucket:
+//
+//	tokens  ID -> StoredToken JSON
+var tokensBucket = []byte("tokens")
+
+// StoredToken is a token created through the API. Only a salted hash of its
+// secret is kept; the key handed out is "<id>.<secret>".
+type StoredToken struct {
+	ID          string              `json:"id"`
+	Name        string              `json:"name"`
+	Permissions []string            `json:"permissions"`
+	Tags        map[string][]string `json:"tags,omitempty"`
+	Salt        string              `json:"salt"`
+	Hash        string              `json:"hash"`
+	CreatedAt   time.Time           `json:"created_at"`
+	CreatedBy   string              `json:"created_by"`
+	RotatedAt   *time.Time          `json:"rotated_at,omitempty"`
+	ExpiresAt   *time.Time          `json:"expires_at,omitempty"`
+	RevokedAt   *time.Time          `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the token can be used at the given time
+func (t *StoredToken) Active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+// TokenInfo describes a token without its secret
+type TokenInfo struct {
+	ID          string              `json:"id"`
+	Name        string              `json:"name"`
+	Source      string              `json:"source"`
+	Permissions []string            `json:"permissions"`
+	Tags        map[string][]string `json:"tags,omitempty"`
+	CreatedAt   *time.Time          `json:"created_at,omitempty"`
+	CreatedBy   string              `json:"created_by,omitempty"`
+	RotatedAt   *time.Time          `json:"rotated_at,omitempty"`
+	ExpiresAt   *time.Time          `json:"expires_at,omitempty"`
+	RevokedAt   *time.Time          `json:"revoked_at,omitempty"`
+	Active      bool                `json:"active"`
+}
+
+// IssuedToken is a token together with its key, returned once on creation
+// and rotation
+type IssuedToken struct {
+	*TokenInfo
+	Key string `json:"key"`
+}
+
+// TokenCreateRequest represents a request to create a token
+type TokenCreateRequest struct {
+	Name        string
+	Permissions []string
+	Tags        map[string][]string
+	ExpiresAt   *time.Time
+	CreatedBy   string
+}
+
+// TokenService authenticates API tokens: tokens created through the API and
+// persisted as salted hashes, the bootstrap tokens of the config file and,
+// when configured, JWTs issued by another service
+type TokenService struct {
+	config     *config.Config
+	db         *bolt.DB
+	jwtService *JWTService
+}
+
+// NewTokenService creates a new token service; db may be nil, in which case
+// tokens cannot be created through the API, and jwtService may be nil, in
+// which case JWTs are not accepted
+func NewTokenService(cfg *config.Config, db *bolt.DB, jwtService *JWTService) (*TokenService, error) {
+	if db != nil {
+		err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(tokensBucket)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize token store: %w", err)
+		}
+	}
+
+	return &TokenService{
+		config:     cfg,
+		db:         db,
+		jwtService: jwtService,
+	}, nil
+}
+
+// Managed reports whether tokens can be created and managed through the API
+func (s *TokenService) Managed() bool {
+	return s.db != nil
+}
+
+// Authenticate returns the token a key belongs to, or nil if the key is
+// unknown, expired or revoked
+func (s *TokenService) Authenticate(key string) *config.TokenConfig {
+	if s.jwtService != nil && IsJWT(key) {
+		return s.jwtService.Authenticate(key)
+	}
+
+	if id, secret, ok := strings.Cut(key, "."); ok && strings.HasPrefix(id, storedTokenPrefix) {
+		token, err := s.load(id)
+		if err != nil {
+			logger.WithField("error", err).Error("Failed to load token")
+			return nil
+		}
+
+		if token != nil {
+			if !token.Active(time.Now()) || !verifyTokenSecret(token, secret) {
+				return nil
+			}
+
+			return storedTokenConfig(token)
+		}
+	}
+
+	return s.config.FindTokenByKey(key)
+}
+
+// Permits reports whether the token with an ID can still be used with a
+// permission on a tag, for credentials that act on its behalf such as upload
+// URLs. JWTs are not kept and cannot be revoked; credentials minted with one
+// expire with it, so they are permitted.
+func (s *TokenService) Permits(id, permission, tag string) bool {
+	if strings.HasPrefix(id, jwtTokenPrefix) {
+		return true
+	}
+
+	var token *config.TokenConfig
+	if strings.HasPrefix(id, storedTokenPrefix) {
+		stored, err := s.load(id)
+		if err != nil {
+			logger.WithField("error", err).Error("Failed to load token")
+			return false
+		}
+		if stored == nil || !stored.Active(time.Now()) {
+			return false
+		}
+		token = storedTokenConfig(stored)
+	} else {
+		for i := range s.config.Tokens {
+			if s.config.Tokens[i].ID == id {
+				token = &s.config.Tokens[i]
+			}
+		}
+	}
+
+	return token != nil && token.HasPermission(permission) && token.AllowsTag(permission, tag)
+}
+
+// Create issues a new token
+func (s *TokenService) Create(req *TokenCreateRequest) (*IssuedToken, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, fmt.Errorf("invalid token: name is required")
+	}
+	if len(req.Permissions) == 0 {
+		return nil, fmt.Errorf("invalid token: at least one permission is required")
+	}
+	if err := (&config.TokenConfig{Permissions: req.Permissions, Tags: req.Tags}).ValidateTags(); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("invalid token: expiry must be in the future")
+	}
+
+	id, err := randomString(8)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &StoredToken{
+		ID:          storedTokenPrefix + id,
+		Name:        req.Name,
+		Permissions: req.Permissions,
+		Tags:        req.Tags,
+		CreatedAt:   time.Now(),
+		CreatedBy:   req.CreatedBy,
+		ExpiresAt:   req.ExpiresAt,
+	}
+
+	secret, err := setTokenSecret(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.save(token); err != nil {
+		return nil, err
+	}
+
+	return &IssuedToken{
+		TokenInfo: storedTokenInfo(token),
+		Key:       token.ID + "." + secret,
+	}, nil
+}
+
+// List returns all tokens, bootstrap tokens from the config file first
+func (s *TokenService) List() ([]*TokenInfo, error) {
+	tokens := make([]*TokenInfo, 0, len(s.config.Tokens))
+	for _, token := range s.config.Tokens {
+		tokens = append(tokens, &TokenInfo{
+			ID:          token.ID,
+			Name:        token.Name,
+			Source:      TokenSourceConfig,
+			Permissions: token.Permissions,
+			Tags:        token.Tags,
+			Active:      true,
+		})
+	}
+
+	var stored []*TokenInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).ForEach(func(_, data []byte) error {
+			var token StoredToken
+			if err := json.Unmarshal(data, &token); err != nil {
+				return err
+			}
+			stored = append(stored, storedTokenInfo(&token))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].CreatedAt.Before(*stored[j].CreatedAt)
+	})
+
+	return append(tokens, stored...), nil
+}
+
+// Rotate replaces the secret of a token; the previous key stops working
+func (s *TokenService) Rotate(id string) (*IssuedToken, error) {
+	var secret string
+	token, err := s.update(id, func(token *StoredToken) error {
+		if token.RevokedAt != nil {
+			return fmt.Errorf("invalid token: token is revoked")
+		}
+
+		var err error
+		secret, err = setTokenSecret(token)
+		now := time.Now()
+		token.RotatedAt = &now
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &IssuedToken{
+		TokenInfo: storedTokenInfo(token),
+		Key:       token.ID + "." + secret,
+	}, nil
+}
+
+// Expire sets the time after which a token stops working
+func (s *TokenService) Expire(id string, expiresAt time.Time) (*TokenInfo, error) {
+	token, err := s.update(id, func(token *StoredToken) error {
+		if token.RevokedAt != nil {
+			return fmt.Errorf("invalid token: token is revoked")
+		}
+
+		token.ExpiresAt = &expiresAt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return storedTokenInfo(token), nil
+}
+
+// Revoke permanently disables a token. The record is kept so the token stays
+// visible in the list.
+func (s *TokenService) Revoke(id string) (*TokenInfo, error) {
+	token, err := s.update(id, func(token *StoredToken) error {
+		if token.RevokedAt == nil {
+			now := time.Now()
+			token.RevokedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return storedTokenInfo(token), nil
+}
+
+// load reads a stored token, returning nil if it does not exist
+func (s *TokenService) load(id string) (*StoredToken, error) {
+	if s.db == nil {
+		return nil, nil
+	}
+
+	var token *StoredToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(tokensBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+
+		token = &StoredToken{}
+		return json.Unmarshal(data, token)
+	})
+	return token, err
+}
+
+// save writes a stored token
+func (s *TokenService) save(token *StoredToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).Put([]byte(token.ID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save token: %w", err)
+	}
+
+	return nil
+}
+
+// update applies fn to a stored token and saves the result
+func (s *TokenService) update(id string, fn func(token *StoredToken) error) (*StoredToken, error) {
+	for _, token := range s.config.Tokens {
+		if token.ID == id {
+			return nil, fmt.Errorf("invalid token: tokens from the config file can only be changed there")
+		}
+	}
+
+	var token StoredToken
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("token not found")
+		}
+
+		if err := json.Unmarshal(data, &token); err != nil {
+			return err
+		}
+
+		if err := fn(&token); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(&token)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// setTokenSecret gives a token a new random secret and returns it
+func setTokenSecret(token *StoredToken) (string, error) {
+	secret, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	salt, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	token.Salt = salt
+	token.Hash = hashTokenSecret(salt, secret)
+	return secret, nil
+}
+
+// verifyTokenSecret compares a secret with the stored hash in constant time
+func verifyTokenSecret(token *StoredToken, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashTokenSecret(token.Salt, secret)), []byte(token.Hash)) == 1
+}
+
+// hashTokenSecret returns the hex SHA-256 of a salted secret. Secrets are
+// random, so a fast hash is sufficient.
+func hashTokenSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes encoded as unpadded URL-safe base64
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random data: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// storedTokenConfig returns the authenticated form of a stored token
+func storedTokenConfig(token *StoredToken) *config.TokenConfig {
+	return &config.TokenConfig{
+		ID:          token.ID,
+		Name:        token.Name,
+		Permissions: token.Permissions,
+		Tags:        token.Tags,
+		ExpiresAt:   token.ExpiresAt,
+	}
+}
+
+// storedTokenInfo describes a stored token
+func storedTokenInfo(token *StoredToken) *TokenInfo {
+	createdAt := token.CreatedAt
+	return &TokenInfo{
+		ID:          token.ID,
+		Name:        token.Name,
+		Source:      TokenSourceStore,
+		Permissions: token.Permissions,
+		Tags:        token.Tags,
+		CreatedAt:   &createdAt,
+		CreatedBy:   token.CreatedBy,
+		RotatedAt:   token.RotatedAt,
+		ExpiresAt:   token.ExpiresAt,
+		RevokedAt:   token.RevokedAt,
+		Active:      token.Active(time.Now()),
+	}
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/database"
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestDB opens a state database in a temporary directory
+func openTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "cdn.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestTokenService returns a token service with one token from the
+// config file and a store for managed tokens
+func newTestTokenService(t *testing.T) *TokenService {
+	t.Helper()
+
+	cfg := &config.Config{
+		Tokens: []config.TokenConfig{
+			{ID: "admin", Key: "admin-key", Name: "Admin", Permissions: []string{"upload", "read", "admin"}},
+		},
+	}
+	tokens, err := NewTokenService(cfg, openTestDB(t), nil)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+	return tokens
+}
+
+func TestTokenServiceLifecycle(t *testing.T) {
+	tokens := newTestTokenService(t)
+
+	issued, err := tokens.Create(&TokenCreateRequest{
+		Name:        "School A",
+		Permissions: []string{"upload", "read"},
+		Tags:        map[string][]string{"*": {"school-a"}},
+		CreatedBy:   "Admin",
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if !strings.HasPrefix(issued.ID, storedTokenPrefix) || !strings.HasPrefix(issued.Key, issued.ID+".") {
+		t.Fatalf("Create = %s %s", issued.ID, issued.Key)
+	}
+
+	token := tokens.Authenticate(issued.Key)
+	if token == nil || token.ID != issued.ID || !token.AllowsTag("upload", "school-a") || token.AllowsTag("upload", "media") {
+		t.Fatalf("Authenticate = %+v", token)
+	}
+	if !tokens.Permits(issued.ID, "upload", "school-a") || tokens.Permits(issued.ID, "upload", "media") || tokens.Permits(issued.ID, "admin", "school-a") {
+		t.Error("Permits does not follow the token's permissions and tags")
+	}
+
+	// Only a salted hash of the secret is stored
+	secret := strings.TrimPrefix(issued.Key, issued.ID+".")
+	stored, err := tokens.load(issued.ID)
+	if err != nil || stored == nil {
+		t.Fatalf("load = %v, %v", stored, err)
+	}
+	if stored.Hash == "" || stored.Salt == "" || stored.Hash == hashTokenSecret("", secret) || strings.Contains(stored.Hash+stored.Salt, secret) {
+		t.Errorf("stored secret = %q salted with %q", stored.Hash, stored.Salt)
+	}
+
+	// Wrong secrets, unknown IDs and config tokens in the stored form fail
+	for _, key := range []string{issued.ID + ".wrong", storedTokenPrefix + "unknown." + secret, issued.ID, "admin.admin-key"} {
+		if tokens.Authenticate(key) != nil {
+			t.Errorf("Authenticate(%s) succeeded", key)
+		}
+	}
+
+	rotated, err := tokens.Rotate(issued.ID)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if tokens.Authenticate(issued.Key) != nil {
+		t.Error("previous key still works after rotation")
+	}
+	if tokens.Authenticate(rotated.Key) == nil {
+		t.Error("rotated key does not work")
+	}
+
+	if _, err := tokens.Expire(issued.ID, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	if tokens.Authenticate(rotated.Key) != nil || tokens.Permits(issued.ID, "upload", "school-a") {
+		t.Error("expired token still works")
+	}
+
+	if _, err := tokens.Expire(issued.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	if token := tokens.Authenticate(rotated.Key); token == nil || token.ExpiresAt == nil {
+		t.Fatalf("Authenticate after extending = %+v", token)
+	}
+
+	info, err := tokens.Revoke(issued.ID)
+	if err != nil || info.Active || info.RevokedAt == nil {
+		t.Fatalf("Revoke = %+v, %v", info, err)
+	}
+	if tokens.Authenticate(rotated.Key) != nil || tokens.Permits(issued.ID, "upload", "school-a") {
+		t.Error("revoked token still works")
+	}
+	if _, err := tokens.Rotate(issued.ID); err == nil {
+		t.Error("Rotate revived a revoked token")
+	}
+	if _, err := tokens.Expire(issued.ID, time.Now().Add(time.Hour)); err == nil {
+		t.Error("Expire revived a revoked token")
+	}
+
+	// Revoked tokens stay listed after the config tokens
+	list, err := tokens.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 2 || list[0].Source != TokenSourceConfig || list[1].ID != issued.ID || list[1].Active {
+		t.Errorf("List = %+v %+v", list[0], list[1])
+	}
+}
+
+func TestTokenServiceConfigTokens(t *testing.T) {
+	tokens := newTestTokenService(t)
+
+	if token := tokens.Authenticate("admin-key"); token == nil || token.ID != "admin" {
+		t.Fatalf("Authenticate config token = %+v", token)
+	}
+	if !tokens.Permits("admin", "upload", "media") || tokens.Permits("admin", "delete", "media") || tokens.Permits("missing", "upload", "media") {
+		t.Error("Permits does not follow the config tokens")
+	}
+
+	// Config tokens can only be changed in the config file
+	if _, err := tokens.Revoke("admin"); err == nil {
+		t.Error("Revoke changed a config token")
+	}
+	if _, err := tokens.Rotate("missing"); err == nil || err.Error() != "token not found" {
+		t.Errorf("Rotate missing = %v", err)
+	}
+}
+
+func TestTokenServiceCreateValidation(t *testing.T) {
+	tokens := newTestTokenService(t)
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name string
+		req  TokenCreateRequest
+		err  string
+	}{
+		{name: "name", req: TokenCreateRequest{Permissions: []string{"read"}}, err: "invalid token: name is required"},
+		{name: "permissions", req: TokenCreateRequest{Name: "x"}, err: "invalid token: at least one permission is required"},
+		{name: "tags", req: TokenCreateRequest{Name: "x", Permissions: []string{"read"}, Tags: map[string][]string{"upload": {"a"}}}, err: "invalid token: tags given for missing permission upload"},
+		{name: "expiry", req: TokenCreateRequest{Name: "x", Permissions: []string{"read"}, ExpiresAt: &past}, err: "invalid token: expiry must be in the future"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			if _, err := tokens.Create(&req); err == nil || err.Error() != tt.err {
+				t.Errorf("Create error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTokenServiceWithoutStore(t *testing.T) {
+	cfg := &config.Config{
+		Tokens: []config.TokenConfig{{ID: "admin", Key: "admin-key", Permissions: []string{"upload"}}},
+	}
+	tokens, err := NewTokenService(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+
+	if tokens.Managed() {
+		t.Error("Managed without a store")
+	}
+	if tokens.Authenticate("admin-key") == nil {
+		t.Error("config token rejected without a store")
+	}
+	if tokens.Authenticate(storedTokenPrefix+"abc.secret") != nil {
+		t.Error("stored token accepted without a store")
+	}
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// TrashService periodically purges files that stayed in the trash longer
+// than the configured retention
+type TrashService struct {
+	config      *config.Config
+	fileService *FileService
+	stop        chan struct{}
+}
+
+// NewTrashService creates a new trash purger
+func NewTrashService(cfg *config.Config, fileService *FileService) *TrashService {
+	return &TrashService{
+		config:      cfg,
+		fileService: fileService,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Start launches the periodic purge
+func (s *TrashService) Start() {
+	go func() {
+		ticker := time.NewTicker(s.config.Storage.Trash.PurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.purgeExpired()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic purge
+func (s *TrashService) Stop() {
+	close(s.stop)
+}
+
+// purgeExpired removes the files whose retention elapsed
+func (s *TrashService) purgeExpired() {
+	purged, err := s.fileService.PurgeExpired()
+	if err != nil {
+		logger.Warnf("Failed to purge trash: %v", err)
+		return
+	}
+
+	if purged > 0 {
+		logger.Infof("Purged %d expired files from trash", purged)
+	}
+}
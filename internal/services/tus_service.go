@@ -0,0 +1,369 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// tusUploadsDir is the directory inside each tag that holds partial uploads
+const tusUploadsDir = ".uploads"
+
+// Errors returned by TusService
+var (
+	ErrUploadNotFound       = errors.New("upload not found")
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	ErrUploadLocked         = errors.New("upload is locked by another request")
+)
+
+// TusUpload describes a resumable upload in progress
+type TusUpload struct {
+	ID         string            `json:"id"`
+	Tag        string            `json:"tag"`
+	Filename   string            `json:"filename"`
+	Public     bool              `json:"public"`
+	Length     int64             `json:"length"`
+	Metadata   map[string]string `json:"metadata"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+	TokenID    string            `json:"token_id"`
+	UploadedBy string            `json:"uploaded_by"`
+	Result     *UploadResponse   `json:"result,omitempty"`
+
+	// Offset is the number of bytes received so far (not persisted)
+	Offset int64 `json:"-"`
+}
+
+// TusCreateRequest represents a tus creation request
+type TusCreateRequest struct {
+	Tag        string
+	Filename   string
+	Public     bool
+	Length     int64
+	Metadata   map[string]string
+	TokenID    string
+	UploadedBy string
+}
+
+// TusService implements the storage side of the tus resumable upload protocol.
+// Partial data is staged on local disk below the staging path and handed to
+// FileService.Upload once complete, which stores it through the backend.
+type TusService struct {
+	config      *config.Config
+	fileService *FileService
+	locks       sync.Map
+	stop        chan struct{}
+}
+
+// NewTusService creates a new tus upload service
+func NewTusService(cfg *config.Config, fileService *FileService) *TusService {
+	return &TusService{
+		config:      cfg,
+		fileService: fileService,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Create registers a new upload and allocates its partial file
+func (s *TusService) Create(req *TusCreateRequest) (*TusUpload, error) {
+	// Validate up front so clients don't send data that would be rejected
+	if err := utils.ValidateTag(req.Tag); err != nil {
+		return nil, fmt.Errorf("invalid tag: %w", err)
+	}
+
+	if err := utils.ValidateFileSize(req.Length, s.config.Storage.MaxFileSize); err != nil {
+		return nil, err
+	}
+
+	if err := utils.ValidateFileExtension(req.Filename, s.config.Storage.AllowedExtensions); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	upload := &TusUpload{
+		ID:         uuid.New().String(),
+		Tag:        req.Tag,
+		Filename:   req.Filename,
+		Public:     req.Public,
+		Length:     req.Length,
+		Metadata:   req.Metadata,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(s.config.Tus.Expiration),
+		TokenID:    req.TokenID,
+		UploadedBy: req.UploadedBy,
+	}
+
+	if err := utils.CreateDirectory(s.uploadDir(req.Tag)); err != nil {
+		return nil, err
+	}
+
+	part, err := os.OpenFile(s.partPath(upload.Tag, upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	part.Close()
+
+	if err := s.saveInfo(upload); err != nil {
+		os.Remove(s.partPath(upload.Tag, upload.ID))
+		return nil, err
+	}
+
+	logger.WithField("upload_id", upload.ID).Info("Resumable upload created")
+
+	return upload, nil
+}
+
+// Get returns an upload together with its current offset
+func (s *TusService) Get(tag, id string) (*TusUpload, error) {
+	upload, err := s.loadInfo(tag, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+
+	if upload.Result != nil {
+		upload.Offset = upload.Length
+		return upload, nil
+	}
+
+	info, err := os.Stat(s.partPath(tag, id))
+	if err != nil {
+		return nil, ErrUploadNotFound
+	}
+	upload.Offset = info.Size()
+
+	return upload, nil
+}
+
+// Append writes data at the given offset and finalises the upload once all
+// bytes have been received
+func (s *TusService) Append(tag, id string, offset int64, src io.Reader) (*TusUpload, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	upload, err := s.Get(tag, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset != upload.Offset {
+		return upload, ErrUploadOffsetMismatch
+	}
+
+	// Completed uploads are reported again so clients can retry the last request
+	if upload.Result != nil {
+		return upload, nil
+	}
+
+	part, err := os.OpenFile(s.partPath(tag, id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %w", err)
+	}
+
+	// Keep whatever was received even if the connection drops mid-request
+	written, copyErr := io.Copy(part, io.LimitReader(src, upload.Length-upload.Offset))
+	if err := part.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	part.Close()
+
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().Add(s.config.Tus.Expiration)
+	if err := s.saveInfo(upload); err != nil {
+		return nil, err
+	}
+
+	if copyErr != nil {
+		return upload, fmt.Errorf("failed to write upload data: %w", copyErr)
+	}
+
+	if upload.Offset == upload.Length {
+		if err := s.finalize(upload); err != nil {
+			return upload, err
+		}
+	}
+
+	return upload, nil
+}
+
+// Terminate removes an upload and its partial data
+func (s *TusService) Terminate(tag, id string) error {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := s.loadInfo(tag, id); err != nil {
+		return err
+	}
+
+	s.remove(tag, id)
+
+	logger.WithField("upload_id", id).Info("Resumable upload terminated")
+
+	return nil
+}
+
+// Start launches the background removal of expired uploads
+func (s *TusService) Start() {
+	go func() {
+		ticker := time.NewTicker(s.config.Tus.CleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.removeExpired()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background cleanup
+func (s *TusService) Stop() {
+	close(s.stop)
+}
+
+// finalize hands the completed data to FileService.Upload
+func (s *TusService) finalize(upload *TusUpload) error {
+	part, err := os.Open(s.partPath(upload.Tag, upload.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open upload file: %w", err)
+	}
+	defer part.Close()
+
+	response, err := s.fileService.Upload(&UploadRequest{
+		Filename:   upload.Filename,
+		Size:       upload.Length,
+		Content:    part,
+		Tag:        upload.Tag,
+		Public:     upload.Public,
+		UploadedBy: upload.UploadedBy,
+	})
+	if err != nil {
+		// Rejected data can never be accepted, so the upload is discarded;
+		// other failures are retried by the next request
+		if IsValidationError(err) {
+			s.remove(upload.Tag, upload.ID)
+		}
+		return err
+	}
+
+	// Keep the result until expiry so a retried final request gets the same answer
+	upload.Result = response
+	if err := s.saveInfo(upload); err != nil {
+		logger.Warnf("Failed to record upload result: %v", err)
+	}
+	os.Remove(s.partPath(upload.Tag, upload.ID))
+
+	logger.WithField("upload_id", upload.ID).Info("Resumable upload completed")
+
+	return nil
+}
+
+// removeExpired deletes uploads past their expiration date
+func (s *TusService) removeExpired() {
+	infos, err := filepath.Glob(filepath.Join(s.config.Tus.StagingPath, "*", tusUploadsDir, "*.info"))
+	if err != nil {
+		logger.Warnf("Failed to list resumable uploads: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, infoPath := range infos {
+		tag := filepath.Base(filepath.Dir(filepath.Dir(infoPath)))
+		id := strings.TrimSuffix(filepath.Base(infoPath), ".info")
+
+		upload, err := s.loadInfo(tag, id)
+		if err != nil || now.After(upload.ExpiresAt) {
+			s.remove(tag, id)
+			logger.WithField("upload_id", id).Info("Expired resumable upload removed")
+		}
+	}
+}
+
+// lock serialises requests for one upload
+func (s *TusService) lock(id string) (func(), error) {
+	value, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	mutex := value.(*sync.Mutex)
+	if !mutex.TryLock() {
+		return nil, ErrUploadLocked
+	}
+	return mutex.Unlock, nil
+}
+
+// remove deletes the partial file and info of an upload
+func (s *TusService) remove(tag, id string) {
+	os.Remove(s.partPath(tag, id))
+	os.Remove(s.infoPath(tag, id))
+	s.locks.Delete(id)
+}
+
+// saveInfo persists the upload description
+func (s *TusService) saveInfo(upload *TusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload info: %w", err)
+	}
+
+	if _, err := utils.WriteFileAtomic(s.infoPath(upload.Tag, upload.ID), bytes.NewReader(data), 0600); err != nil {
+		return fmt.Errorf("failed to write upload info: %w", err)
+	}
+
+	return nil
+}
+
+// loadInfo reads the upload description
+func (s *TusService) loadInfo(tag, id string) (*TusUpload, error) {
+	if utils.ValidateTag(tag) != nil || uuid.Validate(id) != nil {
+		return nil, ErrUploadNotFound
+	}
+
+	data, err := os.ReadFile(s.infoPath(tag, id))
+	if err != nil {
+		return nil, ErrUploadNotFound
+	}
+
+	var upload TusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload info: %w", err)
+	}
+
+	return &upload, nil
+}
+
+// uploadDir returns the directory holding partial uploads of a tag
+func (s *TusService) uploadDir(tag string) string {
+	return filepath.Join(s.config.Tus.StagingPath, tag, tusUploadsDir)
+}
+
+// partPath returns the path of the partial data of an upload
+func (s *TusService) partPath(tag, id string) string {
+	return filepath.Join(s.uploadDir(tag), id+".part")
+}
+
+// infoPath returns the path of the description of an upload
+func (s *TusService) infoPath(tag, id string) string {
+	return filepath.Join(s.uploadDir(tag), id+".info")
+}
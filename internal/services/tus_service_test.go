@@ -0,0 +1,161 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+)
+
+// newTestTusService returns a tus service staging in a temporary directory
+// and storing completed uploads in backend
+func newTestTusService(t *testing.T, backend Backend) (*TusService, *FileService) {
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			BasePath:          t.TempDir(),
+			MaxFileSize:       64,
+			AllowedExtensions: []string{"txt"},
+		},
+		Tus: config.TusConfig{
+			Enabled:     true,
+			StagingPath: t.TempDir(),
+			Expiration:  time.Hour,
+		},
+	}
+	fs := NewFileService(cfg, NewStorageService(cfg, backend), nil, nil, nil)
+	return NewTusService(cfg, fs), fs
+}
+
+// stagedFiles returns the files left in the staging directory
+func stagedFiles(t *testing.T, s *TusService) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(s.config.Tus.StagingPath, "*", tusUploadsDir, "*"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	return files
+}
+
+func TestTusUpload(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend Backend) {
+		tus, fs := newTestTusService(t, backend)
+
+		upload, err := tus.Create(&TusCreateRequest{Tag: "docs", Filename: "notes.txt", Length: 11})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		got, err := tus.Get("docs", upload.ID)
+		if err != nil || got.Offset != 0 {
+			t.Fatalf("Get = %+v, %v", got, err)
+		}
+
+		if got, err = tus.Append("docs", upload.ID, 0, strings.NewReader("hello ")); err != nil || got.Offset != 6 {
+			t.Fatalf("Append = %+v, %v", got, err)
+		}
+
+		// A request resuming from the wrong offset is refused and reports the
+		// current one
+		got, err = tus.Append("docs", upload.ID, 3, strings.NewReader("lo world"))
+		if !errors.Is(err, ErrUploadOffsetMismatch) || got.Offset != 6 {
+			t.Fatalf("Append at a wrong offset = %+v, %v", got, err)
+		}
+
+		// Bytes past the declared length are not read
+		got, err = tus.Append("docs", upload.ID, 6, strings.NewReader("world and more"))
+		if err != nil || got.Offset != 11 || got.Result == nil {
+			t.Fatalf("final Append = %+v, %v", got, err)
+		}
+		if content := downloadText(t, fs, got.Result.FileID); content != "hello world" {
+			t.Errorf("Download = %q", content)
+		}
+
+		// The final request can be retried and gets the same result
+		retried, err := tus.Append("docs", upload.ID, 11, strings.NewReader(""))
+		if err != nil || retried.Result == nil || retried.Result.FileID != got.Result.FileID {
+			t.Errorf("retried Append = %+v, %v", retried, err)
+		}
+
+		// Only the description is kept, for the retries
+		if files := stagedFiles(t, tus); len(files) != 1 || !strings.HasSuffix(files[0], ".info") {
+			t.Errorf("staged files = %v", files)
+		}
+	})
+}
+
+func TestTusCreateValidation(t *testing.T) {
+	tus, _ := newTestTusService(t, NewLocalBackend(t.TempDir()))
+
+	tests := []struct {
+		name string
+		req  TusCreateRequest
+		err  string
+	}{
+		{name: "invalid tag", req: TusCreateRequest{Tag: "../docs", Filename: "a.txt", Length: 1}, err: "invalid tag"},
+		{name: "too large", req: TusCreateRequest{Tag: "docs", Filename: "a.txt", Length: 65}, err: "file size exceeds"},
+		{name: "empty", req: TusCreateRequest{Tag: "docs", Filename: "a.txt", Length: 0}, err: "file is empty"},
+		{name: "extension", req: TusCreateRequest{Tag: "docs", Filename: "a.exe", Length: 1}, err: "file extension '.exe' is not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			if _, err := tus.Create(&req); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Create error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	if files := stagedFiles(t, tus); len(files) != 0 {
+		t.Errorf("staged files = %v", files)
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	tus, _ := newTestTusService(t, NewLocalBackend(t.TempDir()))
+	tus.config.Tus.Expiration = 20 * time.Millisecond
+
+	expired, err := tus.Create(&TusCreateRequest{Tag: "docs", Filename: "old.txt", Length: 4})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	tus.config.Tus.Expiration = time.Hour
+	active, err := tus.Create(&TusCreateRequest{Tag: "docs", Filename: "new.txt", Length: 4})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if _, err := tus.Get("docs", expired.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("Get expired = %v, want ErrUploadNotFound", err)
+	}
+	if _, err := tus.Append("docs", expired.ID, 0, strings.NewReader("data")); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("Append expired = %v, want ErrUploadNotFound", err)
+	}
+
+	tus.removeExpired()
+	for _, file := range stagedFiles(t, tus) {
+		if strings.Contains(file, expired.ID) {
+			t.Errorf("expired upload left behind: %s", file)
+		}
+	}
+	if _, err := tus.Get("docs", active.ID); err != nil {
+		t.Errorf("Get active: %v", err)
+	}
+
+	// Terminating removes an upload at once
+	if err := tus.Terminate("docs", active.ID); err != nil {
+		t.Fatalf("Terminate: %v", err)
+	}
+	if files := stagedFiles(t, tus); len(files) != 0 {
+		t.Errorf("staged files after terminate = %v", files)
+	}
+	if err := tus.Terminate("docs", active.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("Terminate again = %v, want ErrUploadNotFound", err)
+	}
+}
@@ -0,0 +1,307 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+// uploadGrantPrefix starts the IDs of upload grants
+const uploadGrantPrefix = "up_"
+
+// Upload grant bucket:
+//
+//	upload_grants  ID -> UploadGrant JSON
+var uploadGrantsBucket = []byte("upload_grants")
+
+// UploadGrant is a presigned upload URL. Like stored tokens, only a salted
+// hash of its secret is kept.
+type UploadGrant struct {
+	ID         string     `json:"id"`
+	Tag        string     `json:"tag"`
+	MaxSize    int64      `json:"max_size"`
+	Extensions []string   `json:"extensions,omitempty"`
+	Public     bool       `json:"public"`
+	TokenID    string     `json:"token_id"`
+	TokenName  string     `json:"token_name"`
+	Salt       string     `json:"salt"`
+	Hash       string     `json:"hash"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+}
+
+// UploadURLRequest represents a request to mint an upload URL
+type UploadURLRequest struct {
+	Tag        string
+	MaxSize    int64
+	Extensions []string
+	Public     bool
+	TTL        time.Duration
+	Token      *config.TokenConfig
+}
+
+// UploadURL represents a minted upload URL
+type UploadURL struct {
+	URL        string    `json:"url"`
+	ID         string    `json:"id"`
+	Tag        string    `json:"tag"`
+	MaxSize    int64     `json:"max_size"`
+	Extensions []string  `json:"extensions,omitempty"`
+	Public     bool      `json:"public"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// UploadURLService mints presigned, single-use upload URLs that let clients
+// upload without holding a token
+type UploadURLService struct {
+	config *config.Config
+	db     *bolt.DB
+}
+
+// NewUploadURLService creates a new upload URL service
+func NewUploadURLService(cfg *config.Config, db *bolt.DB) (*UploadURLService, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(uploadGrantsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize upload url store: %w", err)
+	}
+
+	return &UploadURLService{
+		config: cfg,
+		db:     db,
+	}, nil
+}
+
+// Create mints an upload URL for a token
+func (s *UploadURLService) Create(req *UploadURLRequest) (*UploadURL, error) {
+	if err := utils.ValidateTag(req.Tag); err != nil {
+		return nil, fmt.Errorf("invalid tag: %w", err)
+	}
+
+	maxSize := req.MaxSize
+	switch {
+	case maxSize < 0:
+		return nil, fmt.Errorf("invalid max_size: must not be negative")
+	case maxSize == 0:
+		maxSize = s.config.Storage.MaxFileSize
+	case maxSize > s.config.Storage.MaxFileSize:
+		return nil, fmt.Errorf("invalid max_size: exceeds the maximum file size of %d bytes", s.config.Storage.MaxFileSize)
+	}
+
+	extensions, err := s.normalizeExtensions(req.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := req.TTL
+	if ttl == 0 {
+		ttl = s.config.Security.UploadURL.DefaultTTL
+	}
+	if ttl < 0 || ttl > s.config.Security.UploadURL.MaxTTL {
+		return nil, fmt.Errorf("invalid expires_in: must be between 1 and %d seconds", int64(s.config.Security.UploadURL.MaxTTL.Seconds()))
+	}
+
+	id, err := randomString(12)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	// The URL does not outlive the token that mints it
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	if req.Token.ExpiresAt != nil && req.Token.ExpiresAt.Before(expiresAt) {
+		expiresAt = *req.Token.ExpiresAt
+	}
+
+	grant := &UploadGrant{
+		ID:         uploadGrantPrefix + id,
+		Tag:        req.Tag,
+		MaxSize:    maxSize,
+		Extensions: extensions,
+		Public:     req.Public,
+		TokenID:    req.Token.ID,
+		TokenName:  req.Token.Name,
+		Salt:       salt,
+		Hash:       hashTokenSecret(salt, secret),
+		CreatedAt:  now,
+		ExpiresAt:  expiresAt,
+	}
+
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal upload url: %w", err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(uploadGrantsBucket)
+		if err := pruneUploadGrants(bucket, now); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(grant.ID), data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save upload url: %w", err)
+	}
+
+	query := url.Values{"upload_token": {grant.ID + "." + secret}}
+	return &UploadURL{
+		URL:        s.config.GetBaseURL() + "/upload?" + query.Encode(),
+		ID:         grant.ID,
+		Tag:        grant.Tag,
+		MaxSize:    grant.MaxSize,
+		Extensions: grant.Extensions,
+		Public:     grant.Public,
+		ExpiresAt:  grant.ExpiresAt,
+	}, nil
+}
+
+// Verify returns the grant of an upload URL key if its secret matches and it
+// has not expired. Whether it was used is left to Claim, so that a repeated
+// upload can still be matched to its stored response.
+func (s *UploadURLService) Verify(key string) (*UploadGrant, error) {
+	id, secret, ok := strings.Cut(key, ".")
+	if !ok || !strings.HasPrefix(id, uploadGrantPrefix) {
+		return nil, fmt.Errorf("malformed upload token")
+	}
+
+	var grant *UploadGrant
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(uploadGrantsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+
+		grant = &UploadGrant{}
+		return json.Unmarshal(data, grant)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load upload url: %w", err)
+	}
+
+	switch {
+	case grant == nil || !verifyTokenSecret(&StoredToken{Salt: grant.Salt, Hash: grant.Hash}, secret):
+		return nil, fmt.Errorf("upload url not found")
+	case !time.Now().Before(grant.ExpiresAt):
+		return nil, fmt.Errorf("upload url expired")
+	}
+
+	return grant, nil
+}
+
+// Claim marks a grant as used. A grant can only be claimed once; Release
+// makes it usable again after a failed upload.
+func (s *UploadURLService) Claim(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(uploadGrantsBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("upload url not found")
+		}
+
+		var grant UploadGrant
+		if err := json.Unmarshal(data, &grant); err != nil {
+			return err
+		}
+
+		switch {
+		case !time.Now().Before(grant.ExpiresAt):
+			return fmt.Errorf("upload url expired")
+		case grant.UsedAt != nil:
+			return fmt.Errorf("upload url already used")
+		}
+
+		now := time.Now()
+		grant.UsedAt = &now
+
+		data, err := json.Marshal(&grant)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+}
+
+// Release makes a claimed grant usable again
+func (s *UploadURLService) Release(id string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(uploadGrantsBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+
+		var grant UploadGrant
+		if err := json.Unmarshal(data, &grant); err != nil {
+			return err
+		}
+		grant.UsedAt = nil
+
+		data, err := json.Marshal(&grant)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), data)
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to release upload url")
+	}
+}
+
+// normalizeExtensions lowercases the extensions of an upload URL and checks
+// that the server allows them
+func (s *UploadURLService) normalizeExtensions(extensions []string) ([]string, error) {
+	normalized := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if err := utils.ValidateFileExtension("file."+ext, s.config.Storage.AllowedExtensions); err != nil {
+			return nil, fmt.Errorf("invalid extensions: '.%s' is not allowed", ext)
+		}
+		normalized = append(normalized, ext)
+	}
+	return normalized, nil
+}
+
+// pruneUploadGrants removes expired grants
+func pruneUploadGrants(bucket *bolt.Bucket, now time.Time) error {
+	var expired [][]byte
+	err := bucket.ForEach(func(id, data []byte) error {
+		var grant UploadGrant
+		if err := json.Unmarshal(data, &grant); err != nil {
+			return err
+		}
+		if !now.Before(grant.ExpiresAt) {
+			expired = append(expired, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range expired {
+		if err := bucket.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+)
+
+// newTestUploadURLService returns an upload URL service with its own store
+func newTestUploadURLService(t *testing.T) *UploadURLService {
+	t.Helper()
+
+	cfg := &config.Config{
+		App: config.AppConfig{Env: "production", Domain: "cdn.example.com"},
+		Storage: config.StorageConfig{
+			MaxFileSize:       1024,
+			AllowedExtensions: []string{"txt", "pdf"},
+		},
+		Security: config.SecurityConfig{
+			UploadURL: config.UploadURLConfig{Enabled: true, DefaultTTL: 15 * time.Minute, MaxTTL: time.Hour},
+		},
+	}
+	uploadURLs, err := NewUploadURLService(cfg, openTestDB(t))
+	if err != nil {
+		t.Fatalf("NewUploadURLService: %v", err)
+	}
+	return uploadURLs
+}
+
+// uploadURLKey returns the upload_token of a minted URL
+func uploadURLKey(t *testing.T, minted *UploadURL) string {
+	t.Helper()
+
+	parsed, err := url.Parse(minted.URL)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return parsed.Query().Get("upload_token")
+}
+
+func TestUploadURLCreate(t *testing.T) {
+	uploadURLs := newTestUploadURLService(t)
+	token := &config.TokenConfig{ID: "school", Name: "School"}
+	soon := time.Now().Add(10 * time.Minute)
+
+	tests := []struct {
+		name       string
+		req        UploadURLRequest
+		maxSize    int64
+		extensions []string
+		expiresIn  time.Duration
+		err        string
+	}{
+		{name: "defaults", req: UploadURLRequest{Tag: "docs"}, maxSize: 1024, extensions: []string{}, expiresIn: 15 * time.Minute},
+		{name: "restricted", req: UploadURLRequest{Tag: "docs", MaxSize: 100, Extensions: []string{".PDF", "txt"}, TTL: time.Hour}, maxSize: 100, extensions: []string{"pdf", "txt"}, expiresIn: time.Hour},
+		{name: "capped by the token expiry", req: UploadURLRequest{Tag: "docs", TTL: time.Hour, Token: &config.TokenConfig{ID: "jwt:app", ExpiresAt: &soon}}, maxSize: 1024, extensions: []string{}, expiresIn: 10 * time.Minute},
+		{name: "invalid tag", req: UploadURLRequest{Tag: "../docs"}, err: "invalid tag"},
+		{name: "negative size", req: UploadURLRequest{Tag: "docs", MaxSize: -1}, err: "invalid max_size: must not be negative"},
+		{name: "size over the maximum", req: UploadURLRequest{Tag: "docs", MaxSize: 1025}, err: "invalid max_size: exceeds the maximum file size of 1024 bytes"},
+		{name: "extension not allowed", req: UploadURLRequest{Tag: "docs", Extensions: []string{"exe"}}, err: "invalid extensions: '.exe' is not allowed"},
+		{name: "ttl over the maximum", req: UploadURLRequest{Tag: "docs", TTL: 2 * time.Hour}, err: "invalid expires_in: must be between 1 and 3600 seconds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			if req.Token == nil {
+				req.Token = token
+			}
+
+			minted, err := uploadURLs.Create(&req)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("Create error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+
+			if minted.MaxSize != tt.maxSize || strings.Join(minted.Extensions, ",") != strings.Join(tt.extensions, ",") {
+				t.Errorf("Create = %+v", minted)
+			}
+			if expiresIn := time.Until(minted.ExpiresAt); expiresIn > tt.expiresIn || expiresIn < tt.expiresIn-time.Minute {
+				t.Errorf("expires in %v, want %v", expiresIn, tt.expiresIn)
+			}
+			if !strings.HasPrefix(minted.URL, "https://cdn.example.com/upload?upload_token="+minted.ID+".") {
+				t.Errorf("URL = %s", minted.URL)
+			}
+
+			grant, err := uploadURLs.Verify(uploadURLKey(t, minted))
+			if err != nil || grant.TokenID != req.Token.ID || grant.Tag != "docs" {
+				t.Errorf("Verify = %+v, %v", grant, err)
+			}
+		})
+	}
+}
+
+func TestUploadURLVerify(t *testing.T) {
+	uploadURLs := newTestUploadURLService(t)
+	minted, err := uploadURLs.Create(&UploadURLRequest{Tag: "docs", Token: &config.TokenConfig{ID: "school"}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	key := uploadURLKey(t, minted)
+
+	tests := []struct {
+		name string
+		key  string
+		err  string
+	}{
+		{name: "valid", key: key},
+		{name: "without secret", key: minted.ID, err: "malformed upload token"},
+		{name: "not an upload token", key: "tok_abc.secret", err: "malformed upload token"},
+		{name: "wrong secret", key: minted.ID + ".wrong", err: "upload url not found"},
+		{name: "unknown id", key: "up_unknown." + strings.SplitN(key, ".", 2)[1], err: "upload url not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := uploadURLs.Verify(tt.key)
+			if tt.err == "" && err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Fatalf("Verify error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUploadURLClaim(t *testing.T) {
+	uploadURLs := newTestUploadURLService(t)
+	minted, err := uploadURLs.Create(&UploadURLRequest{Tag: "docs", Token: &config.TokenConfig{ID: "school"}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := uploadURLs.Claim(minted.ID); err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	if err := uploadURLs.Claim(minted.ID); err == nil || err.Error() != "upload url already used" {
+		t.Fatalf("second Claim = %v", err)
+	}
+
+	// A used URL still verifies, so a repeated upload can be matched to its
+	// stored response
+	if _, err := uploadURLs.Verify(uploadURLKey(t, minted)); err != nil {
+		t.Errorf("Verify after Claim: %v", err)
+	}
+
+	// A released URL can be claimed again after a failed upload
+	uploadURLs.Release(minted.ID)
+	if err := uploadURLs.Claim(minted.ID); err != nil {
+		t.Errorf("Claim after Release: %v", err)
+	}
+
+	if err := uploadURLs.Claim("up_unknown"); err == nil || err.Error() != "upload url not found" {
+		t.Errorf("Claim unknown = %v", err)
+	}
+}
+
+func TestUploadURLExpiry(t *testing.T) {
+	uploadURLs := newTestUploadURLService(t)
+	expiresAt := time.Now().Add(20 * time.Millisecond)
+
+	minted, err := uploadURLs.Create(&UploadURLRequest{Tag: "docs", Token: &config.TokenConfig{ID: "jwt:app", ExpiresAt: &expiresAt}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	key := uploadURLKey(t, minted)
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := uploadURLs.Verify(key); err == nil || err.Error() != "upload url expired" {
+		t.Errorf("Verify expired = %v", err)
+	}
+	if err := uploadURLs.Claim(minted.ID); err == nil || err.Error() != "upload url expired" {
+		t.Errorf("Claim expired = %v", err)
+	}
+
+	// Minting another URL removes the expired ones
+	if _, err := uploadURLs.Create(&UploadURLRequest{Tag: "docs", Token: &config.TokenConfig{ID: "school"}}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := uploadURLs.Verify(key); err == nil || err.Error() != "upload url not found" {
+		t.Errorf("Verify pruned = %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+)
+
+// ArchiveVersion keeps the current version of a file as a prior version.
+// Content stored before deduplication is moved into the content store first,
+// so every prior version refers to a blob.
+func (s *StorageService) ArchiveVersion(meta *models.FileMeta) error {
+	if meta.Digest == "" {
+		if err := s.adoptContent(meta); err != nil {
+			return err
+		}
+	}
+
+	return s.saveMetaKey(models.VersionMetaKey(meta.Tag, meta.FileID, meta.Version), meta)
+}
+
+// LoadVersion reads the metadata of a prior version of a file
+func (s *StorageService) LoadVersion(tag, fileID string, version int) (*models.FileMeta, error) {
+	return s.loadMetaKey(models.VersionMetaKey(tag, fileID, version))
+}
+
+// ListVersions lists the prior versions of a file
+func (s *StorageService) ListVersions(tag, fileID string) ([]*models.FileMeta, error) {
+	return s.listVersions(versionPrefix(tag, fileID))
+}
+
+// DeleteVersions deletes all prior versions of a file
+func (s *StorageService) DeleteVersions(tag, fileID string) error {
+	versions, err := s.ListVersions(tag, fileID)
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range versions {
+		if err := s.DeleteFile(meta); err != nil {
+			return err
+		}
+		if err := s.backend.Delete(models.VersionMetaKey(tag, fileID, meta.Version)); err != nil {
+			return fmt.Errorf("failed to delete metadata file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// adoptContent moves the content of a file stored before deduplication into
+// the content store and points its sidecar at the blob
+func (s *StorageService) adoptContent(meta *models.FileMeta) error {
+	legacyKey := meta.ContentKey()
+
+	reader, _, err := s.backend.Get(legacyKey)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	defer reader.Close()
+
+	if _, err := s.SaveFile(meta, reader); err != nil {
+		return err
+	}
+
+	if err := s.SaveMeta(meta); err != nil {
+		return err
+	}
+
+	if err := s.backend.Delete(legacyKey); err != nil {
+		logger.Warnf("Failed to delete %s: %v", legacyKey, err)
+	}
+
+	return nil
+}
+
+// listVersions lists the metadata of the prior versions below prefix
+func (s *StorageService) listVersions(prefix string) ([]*models.FileMeta, error) {
+	versions := []*models.FileMeta{}
+
+	err := s.backend.Walk(prefix, func(info ObjectInfo) error {
+		if !strings.HasSuffix(info.Key, models.MetaSuffix) || isTempKey(info.Key) {
+			return nil
+		}
+
+		meta, err := s.loadMetaKey(info.Key)
+		if err != nil {
+			logger.Warnf("Failed to load metadata from %s: %v", info.Key, err)
+			return nil
+		}
+
+		versions = append(versions, meta)
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+
+	return versions, nil
+}
+
+// versionPrefix returns the key prefix of the prior versions of a file
+func versionPrefix(tag, fileID string) string {
+	return models.VersionPrefix + fileKey(tag, fileID) + "/"
+}
@@ -0,0 +1,490 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/maarifnu/cdn-fileserver/internal/config"
+	"github.com/maarifnu/cdn-fileserver/internal/models"
+	"github.com/maarifnu/cdn-fileserver/internal/utils"
+	"github.com/maarifnu/cdn-fileserver/pkg/logger"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Webhook events
+const (
+	EventFileUploaded = "file.uploaded"
+	EventFileDeleted  = "file.deleted"
+	EventFileRestored = "file.restored"
+	EventFileReplaced = "file.replaced"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook buckets:
+//
+//	webhook_deliveries  deliveryID -> WebhookDelivery JSON (IDs sort by creation time)
+//	webhook_queue       nextAttemptAt + deliveryID -> nil
+var (
+	webhookDeliveriesBucket = []byte("webhook_deliveries")
+	webhookQueueBucket      = []byte("webhook_queue")
+)
+
+// webhookLease is how long a claimed delivery stays hidden from the queue in
+// addition to the request timeout; deliveries interrupted by a crash are
+// retried once it expires
+const webhookLease = time.Minute
+
+// WebhookPayload is the JSON body sent to webhook endpoints
+type WebhookPayload struct {
+	ID        string           `json:"id"`
+	Event     string           `json:"event"`
+	CreatedAt time.Time        `json:"created_at"`
+	File      *models.FileMeta `json:"file"`
+	URL       string           `json:"url"`
+}
+
+// WebhookDelivery records the delivery of an event to one endpoint
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	Endpoint       string          `json:"endpoint"`
+	URL            string          `json:"url"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// DeliveryListRequest represents a delivery log query
+type DeliveryListRequest struct {
+	Status   string
+	Event    string
+	Endpoint string
+	Page     int
+	Limit    int
+}
+
+// WebhookService delivers file lifecycle events to the configured endpoints.
+// Deliveries are persisted before they are attempted and retried with
+// exponential backoff, so events survive restarts and endpoint outages.
+type WebhookService struct {
+	config *config.Config
+	db     *bolt.DB
+	client *http.Client
+	slots  chan struct{}
+	wake   chan struct{}
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewWebhookService creates a new webhook service
+func NewWebhookService(cfg *config.Config, db *bolt.DB) (*WebhookService, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{webhookDeliveriesBucket, webhookQueueBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize webhook queue: %w", err)
+	}
+
+	return &WebhookService{
+		config: cfg,
+		db:     db,
+		client: &http.Client{Timeout: cfg.Webhooks.Timeout},
+		slots:  make(chan struct{}, cfg.Webhooks.Workers),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Notify queues an event for every endpoint subscribed to it
+func (s *WebhookService) Notify(event string, meta *models.FileMeta, fileURL string) {
+	now := time.Now()
+	payload, err := json.Marshal(&WebhookPayload{
+		ID:        uuid.New().String(),
+		Event:     event,
+		CreatedAt: now,
+		File:      meta,
+		URL:       fileURL,
+	})
+	if err != nil {
+		logger.Warnf("Failed to marshal webhook payload: %v", err)
+		return
+	}
+
+	var deliveries []*WebhookDelivery
+	for _, endpoint := range s.config.Webhooks.Endpoints {
+		if !endpoint.Subscribes(event) {
+			continue
+		}
+
+		id, err := uuid.NewV7()
+		if err != nil {
+			logger.Warnf("Failed to generate webhook delivery ID: %v", err)
+			return
+		}
+
+		deliveries = append(deliveries, &WebhookDelivery{
+			ID:            id.String(),
+			Endpoint:      endpoint.ID,
+			URL:           endpoint.URL,
+			Event:         event,
+			Status:        DeliveryPending,
+			CreatedAt:     now,
+			NextAttemptAt: &now,
+			Payload:       payload,
+		})
+	}
+
+	if len(deliveries) == 0 {
+		return
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, delivery := range deliveries {
+			if err := putDelivery(tx, delivery); err != nil {
+				return err
+			}
+			if err := tx.Bucket(webhookQueueBucket).Put(queueKey(now, delivery.ID), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("Failed to queue webhook deliveries: %v", err)
+		return
+	}
+
+	s.signal()
+}
+
+// Deliveries returns the delivery log, newest first
+func (s *WebhookService) Deliveries(req *DeliveryListRequest) ([]*WebhookDelivery, int, error) {
+	deliveries := []*WebhookDelivery{}
+	total := 0
+	start := (req.Page - 1) * req.Limit
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(webhookDeliveriesBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var delivery WebhookDelivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return fmt.Errorf("failed to unmarshal webhook delivery: %w", err)
+			}
+
+			if (req.Status != "" && delivery.Status != req.Status) ||
+				(req.Event != "" && delivery.Event != req.Event) ||
+				(req.Endpoint != "" && delivery.Endpoint != req.Endpoint) {
+				continue
+			}
+
+			if total >= start && len(deliveries) < req.Limit {
+				deliveries = append(deliveries, &delivery)
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return deliveries, total, nil
+}
+
+// Start launches the background delivery of queued events
+func (s *WebhookService) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		purge := time.NewTicker(time.Hour)
+		defer purge.Stop()
+
+		s.purgeLog()
+		for {
+			s.dispatch()
+
+			select {
+			case <-ticker.C:
+			case <-s.wake:
+			case <-purge.C:
+				s.purgeLog()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background delivery and waits for requests in flight
+func (s *WebhookService) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// dispatch starts due deliveries while workers are available
+func (s *WebhookService) dispatch() {
+	for {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			return
+		}
+
+		delivery, lease, err := s.claim()
+		if err != nil || delivery == nil {
+			<-s.slots
+			if err != nil {
+				logger.Warnf("Failed to read webhook queue: %v", err)
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.deliver(delivery, lease)
+			<-s.slots
+			s.signal()
+		}()
+	}
+}
+
+// claim takes the next due delivery off the queue, leaving a lease entry in
+// its place until the attempt completes
+func (s *WebhookService) claim() (*WebhookDelivery, []byte, error) {
+	var delivery *WebhookDelivery
+	var lease []byte
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(webhookQueueBucket)
+		k, _ := queue.Cursor().First()
+		if k == nil || int64(binary.BigEndian.Uint64(k[:8])) > time.Now().UnixNano() {
+			return nil
+		}
+
+		id := string(k[8:])
+		if err := queue.Delete(k); err != nil {
+			return err
+		}
+
+		data := tx.Bucket(webhookDeliveriesBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+
+		delivery = &WebhookDelivery{}
+		if err := json.Unmarshal(data, delivery); err != nil {
+			return fmt.Errorf("failed to unmarshal webhook delivery: %w", err)
+		}
+
+		lease = queueKey(time.Now().Add(s.config.Webhooks.Timeout+webhookLease), id)
+		return queue.Put(lease, nil)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return delivery, lease, nil
+}
+
+// deliver attempts a delivery and records the outcome
+func (s *WebhookService) deliver(delivery *WebhookDelivery, lease []byte) {
+	endpoint := s.endpoint(delivery.Endpoint)
+
+	delivery.Attempts++
+	delivery.LastStatusCode = 0
+	delivery.LastError = ""
+
+	now := time.Now()
+	if endpoint == nil {
+		delivery.LastError = "endpoint is no longer configured"
+		delivery.Attempts = s.config.Webhooks.MaxAttempts
+	} else {
+		statusCode, err := s.send(endpoint, delivery)
+		delivery.LastStatusCode = statusCode
+		if err != nil {
+			delivery.LastError = err.Error()
+		}
+	}
+
+	entry := logger.WithFields(logrus.Fields{
+		"delivery_id": delivery.ID,
+		"endpoint":    delivery.Endpoint,
+		"event":       delivery.Event,
+		"attempt":     delivery.Attempts,
+	})
+
+	var next []byte
+	switch {
+	case delivery.LastError == "":
+		delivery.Status = DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+		entry.Info("Webhook delivered")
+	case delivery.Attempts >= s.config.Webhooks.MaxAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.NextAttemptAt = nil
+		entry.WithField("error", delivery.LastError).Error("Webhook delivery failed permanently")
+	default:
+		retryAt := now.Add(s.backoff(delivery.Attempts))
+		delivery.NextAttemptAt = &retryAt
+		next = queueKey(retryAt, delivery.ID)
+		entry.WithField("error", delivery.LastError).Warn("Webhook delivery failed, will retry")
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(webhookQueueBucket)
+		if err := queue.Delete(lease); err != nil {
+			return err
+		}
+		if next != nil {
+			if err := queue.Put(next, nil); err != nil {
+				return err
+			}
+		}
+		return putDelivery(tx, delivery)
+	})
+	if err != nil {
+		logger.Warnf("Failed to record webhook delivery: %v", err)
+	}
+}
+
+// send posts the signed payload to an endpoint
+func (s *WebhookService) send(endpoint *config.WebhookConfig, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("invalid request: %w", err)
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", s.config.App.Name+"/"+s.config.App.Version)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", utils.SignWebhookPayload(endpoint.Secret, timestamp, delivery.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Drain a bounded amount so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// purgeLog removes finished deliveries older than the log retention
+func (s *WebhookService) purgeLog() {
+	cutoff := time.Now().Add(-s.config.Webhooks.LogRetention)
+	removed := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(webhookDeliveriesBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var delivery WebhookDelivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return fmt.Errorf("failed to unmarshal webhook delivery: %w", err)
+			}
+
+			// Deliveries are ordered by creation time
+			if delivery.CreatedAt.After(cutoff) {
+				break
+			}
+
+			if delivery.Status == DeliveryPending {
+				continue
+			}
+
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("Failed to purge webhook delivery log: %v", err)
+		return
+	}
+
+	if removed > 0 {
+		logger.Infof("Purged %d webhook deliveries from the log", removed)
+	}
+}
+
+// backoff returns the delay before the next attempt
+func (s *WebhookService) backoff(attempts int) time.Duration {
+	delay := s.config.Webhooks.InitialBackoff
+	for i := 1; i < attempts && delay < s.config.Webhooks.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, s.config.Webhooks.MaxBackoff)
+}
+
+// endpoint returns the configured endpoint with the given ID
+func (s *WebhookService) endpoint(id string) *config.WebhookConfig {
+	for i := range s.config.Webhooks.Endpoints {
+		if s.config.Webhooks.Endpoints[i].ID == id {
+			return &s.config.Webhooks.Endpoints[i]
+		}
+	}
+	return nil
+}
+
+// signal wakes the dispatcher without blocking
+func (s *WebhookService) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// putDelivery stores a delivery record
+func putDelivery(tx *bolt.Tx, delivery *WebhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook delivery: %w", err)
+	}
+	return tx.Bucket(webhookDeliveriesBucket).Put([]byte(delivery.ID), data)
+}
+
+// queueKey builds a queue key that sorts by attempt time
+func queueKey(at time.Time, id string) []byte {
+	key := make([]byte, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(at.UnixNano()))
+	copy(key[8:], id)
+	return key
+}
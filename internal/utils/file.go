@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"mime"
 	"os"
 	"path/filepath"
@@ -26,6 +29,15 @@ func GetContentType(filePath string) (string, error) {
 	return mtype.String(), nil
 }
 
+// DigestHeader formats a hex SHA-256 digest as a Digest header value (RFC 3230)
+func DigestHeader(digest string) string {
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
 // CreateDirectory creates a directory if it doesn't exist
 func CreateDirectory(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -36,6 +48,48 @@ func CreateDirectory(path string) error {
 	return nil
 }
 
+// TempFileMarker appears in the names of temporary files written by WriteFileAtomic
+const TempFileMarker = ".tmp-"
+
+// WriteFileAtomic writes the content of r to path so that readers and crashes
+// see either the previous file or the complete new one. The data is staged in
+// a hidden temporary file in the same directory, synced and renamed into place.
+func WriteFileAtomic(path string, r io.Reader, perm os.FileMode) (int64, error) {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+TempFileMarker+"*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	written, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return written, nil
+}
+
 // GetFileSize returns the size of a file in bytes
 func GetFileSize(filePath string) (int64, error) {
 	info, err := os.Stat(filePath)
@@ -10,9 +10,13 @@ import (
 
 // GenerateUniqueFilename generates a unique filename with UUID
 // Format: {sanitized_name}_{uuid}.{ext}
-func GenerateUniqueFilename(originalName string) string {
+// With sanitize disabled the name is only stripped of unsafe characters.
+func GenerateUniqueFilename(originalName string, sanitize bool) string {
 	// Sanitize the original name
-	sanitized := SanitizeFilename(originalName)
+	sanitized := StripUnsafeFilename(originalName)
+	if sanitize {
+		sanitized = SanitizeFilename(originalName)
+	}
 
 	// Extract extension
 	ext := ExtractExtension(sanitized)
@@ -82,6 +82,12 @@ func ForbiddenResponse(c *gin.Context, message string) {
 	c.Abort()
 }
 
+// TooManyRequestsResponse sends a rate limit response
+func TooManyRequestsResponse(c *gin.Context, message string) {
+	ErrorResponse(c, http.StatusTooManyRequests, "Too Many Requests", message)
+	c.Abort()
+}
+
 // NotFoundResponse sends a not found response
 func NotFoundResponse(c *gin.Context, message string) {
 	ErrorResponse(c, http.StatusNotFound, "Not Found", message)
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+)
+
+// SignFileURL computes the signature of a signed download URL. The signature
+// covers the tag, filename, expiry (unix seconds) and an optional client IP.
+func SignFileURL(secret, tag, filename string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tag + "\n" + filename + "\n" + strconv.FormatInt(expires, 10) + "\n" + ip))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyFileURLSignature checks a signature produced by SignFileURL in constant time
+func VerifyFileURLSignature(secret, tag, filename string, expires int64, ip, signature string) bool {
+	expected := SignFileURL(secret, tag, filename, expires, ip)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// SignWebhookPayload computes the signature sent with a webhook delivery. The
+// signature covers the timestamp (unix seconds) and the raw request body.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -5,8 +5,41 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gabriel-vasile/mimetype"
+	"golang.org/x/text/unicode/norm"
 )
 
+// SniffLength is the number of leading bytes inspected to detect file content
+const SniffLength = 3072
+
+// DefaultAllowedMimeTypes maps file extensions to the content types they may
+// contain, used when security.allowed_mime_types is not configured. Entries
+// ending in "/*" match every subtype.
+var DefaultAllowedMimeTypes = map[string][]string{
+	"jpg":  {"image/jpeg"},
+	"jpeg": {"image/jpeg"},
+	"png":  {"image/png"},
+	"gif":  {"image/gif"},
+	"webp": {"image/webp"},
+	"pdf":  {"application/pdf"},
+	"doc":  {"application/msword", "application/x-ole-storage"},
+	"xls":  {"application/vnd.ms-excel", "application/x-ole-storage"},
+	"ppt":  {"application/vnd.ms-powerpoint", "application/x-ole-storage"},
+	"docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip"},
+	"xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "application/zip"},
+	"pptx": {"application/vnd.openxmlformats-officedocument.presentationml.presentation", "application/zip"},
+	"zip":  {"application/zip"},
+	"rar":  {"application/x-rar-compressed"},
+	"mp4":  {"video/*", "audio/mp4"},
+	"avi":  {"video/x-msvideo"},
+	"mov":  {"video/quicktime", "video/mp4"},
+	"txt":  {"text/plain"},
+	"csv":  {"text/csv", "text/plain"},
+}
+
 var (
 	// tagRegex allows alphanumeric, dash, and underscore
 	tagRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
@@ -47,6 +80,32 @@ func ValidateFileExtension(filename string, allowedExtensions []string) error {
 	return fmt.Errorf("file extension '.%s' is not allowed", ext)
 }
 
+// ValidateFileContent checks that the detected content type is allowed for the
+// file extension. Extensions without an entry in allowed are not restricted.
+func ValidateFileContent(filename string, detected *mimetype.MIME, allowed map[string][]string) error {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+
+	allowedTypes, ok := allowed[ext]
+	if !ok {
+		return nil
+	}
+
+	// Accept the detected type or any format it is a specialisation of
+	for m := detected; m != nil; m = m.Parent() {
+		for _, allowedType := range allowedTypes {
+			if m.Is(allowedType) {
+				return nil
+			}
+
+			if prefix, found := strings.CutSuffix(allowedType, "/*"); found && strings.HasPrefix(m.String(), prefix+"/") {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("file content does not match extension '.%s' (detected %s)", ext, detected.String())
+}
+
 // ValidateFileSize checks if file size is within limit
 func ValidateFileSize(size int64, maxSize int64) error {
 	if size <= 0 {
@@ -60,35 +119,115 @@ func ValidateFileSize(size int64, maxSize int64) error {
 	return nil
 }
 
-// SanitizeFilename removes potentially dangerous characters from filename
+// latinTransliterations spells out Latin letters that do not decompose into a
+// base letter plus accents
+var latinTransliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'đ': "d", 'Đ': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "TH", 'ı': "i",
+}
+
+// SanitizeFilename turns a filename into a readable, URL-safe slug. Letters and
+// digits of every script are kept (Arabic, Javanese, ...), Latin letters lose
+// their accents, whitespace becomes an underscore and everything else except
+// dash, underscore and dot is removed. The result is NFKC-normalised.
 func SanitizeFilename(filename string) string {
-	// Remove path separators
-	filename = filepath.Base(filename)
+	filename = baseFilename(filename)
+
+	// Decompose so accents can be separated from Latin base letters
+	decomposed := norm.NFKD.String(filename)
+
+	var b strings.Builder
+	var base rune
+	lastUnderscore := false
+	for _, r := range decomposed {
+		switch {
+		case unicode.IsMark(r):
+			// Drop accents on Latin letters, keep marks other scripts need
+			if base == 0 || unicode.Is(unicode.Latin, base) {
+				continue
+			}
+			b.WriteRune(r)
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if replacement, ok := latinTransliterations[r]; ok {
+				b.WriteString(replacement)
+			} else {
+				b.WriteRune(r)
+			}
+		case r == '-' || r == '.':
+			b.WriteRune(r)
+		case r == '_' || unicode.IsSpace(r):
+			if lastUnderscore {
+				continue
+			}
+			b.WriteRune('_')
+		default:
+			// Remove anything else, including punctuation and symbols
+			continue
+		}
+		base = r
+		lastUnderscore = r == '_' || unicode.IsSpace(r)
+	}
 
-	// Remove any null bytes
-	filename = strings.ReplaceAll(filename, "\x00", "")
+	filename = norm.NFKC.String(b.String())
 
-	// Replace spaces with underscores
-	filename = strings.ReplaceAll(filename, " ", "_")
+	// Remove leading dots (hidden files)
+	filename = strings.TrimLeft(filename, ".")
 
-	// Remove any characters that are not alphanumeric, dash, underscore, or dot
-	reg := regexp.MustCompile(`[^a-zA-Z0-9._-]`)
-	filename = reg.ReplaceAllString(filename, "")
+	return truncateFilename(filename, 200)
+}
+
+// StripUnsafeFilename only removes what cannot be stored safely (path
+// components, control characters and leading dots), keeping the name as-is.
+// Used when security.sanitize_filename is disabled.
+func StripUnsafeFilename(filename string) string {
+	filename = baseFilename(filename)
+
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, filename)
+
+	filename = norm.NFC.String(filename)
 
 	// Remove leading dots (hidden files)
-	filename = strings.TrimPrefix(filename, ".")
+	filename = strings.TrimLeft(filename, ".")
 
-	// Limit length
-	if len(filename) > 200 {
-		ext := filepath.Ext(filename)
-		name := strings.TrimSuffix(filename, ext)
-		name = name[:200-len(ext)]
-		filename = name + ext
-	}
+	return truncateFilename(filename, 200)
+}
 
+// baseFilename strips any directory part, using either path separator
+func baseFilename(filename string) string {
+	filename = strings.ReplaceAll(filename, "\\", "/")
+	if i := strings.LastIndex(filename, "/"); i >= 0 {
+		filename = filename[i+1:]
+	}
 	return filename
 }
 
+// truncateFilename limits a filename to maxBytes, keeping the extension and
+// never splitting a multi-byte character
+func truncateFilename(filename string, maxBytes int) string {
+	if len(filename) <= maxBytes {
+		return filename
+	}
+
+	ext := filepath.Ext(filename)
+	if len(ext) >= maxBytes {
+		ext = ""
+	}
+	name := strings.TrimSuffix(filename, ext)
+
+	limit := maxBytes - len(ext)
+	for limit > 0 && !utf8.RuneStart(name[limit]) {
+		limit--
+	}
+
+	return name[:limit] + ext
+}
+
 // IsValidFilename checks if filename is valid
 func IsValidFilename(filename string) bool {
 	if filename == "" {